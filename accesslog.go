@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// accessLogLine は middleware.Logger と同じ項目のアクセスログの1行です。
+type accessLogLine struct {
+	Time         string `json:"time"`
+	ID           string `json:"id"`
+	RemoteIP     string `json:"remote_ip"`
+	Host         string `json:"host"`
+	Method       string `json:"method"`
+	URI          string `json:"uri"`
+	UserAgent    string `json:"user_agent"`
+	Status       int    `json:"status"`
+	Error        string `json:"error"`
+	Latency      int64  `json:"latency"`
+	LatencyHuman string `json:"latency_human"`
+	BytesIn      int64  `json:"bytes_in"`
+	BytesOut     int64  `json:"bytes_out"`
+	// UserID と Action は ACCESS_LOG_USER_FIELDS が有効な場合に、/users/:id のルートで出力します。
+	UserID int    `json:"user_id,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+// userAction はHTTPメソッドをユーザーに対する操作（create/read/update/delete）に変換します。
+func userAction(method string) string {
+	switch method {
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut, http.MethodPatch:
+		return "update"
+	case http.MethodDelete:
+		return "delete"
+	default:
+		return "read"
+	}
+}
+
+// accessLogger は、エラー（4xx/5xx）のリクエストはすべて、成功したリクエストは sampleRate の割合だけ
+// アクセスログに出力するミドルウェアを返します。出力の形式は middleware.Logger と同じです。
+// userFields がtrueの場合、/users/:id のルートではパスのユーザーIDと操作の種類も出力し、
+// 特定のユーザーに対する操作をログから検索できるようにします。
+func accessLogger(sampleRate float64, userFields bool) echo.MiddlewareFunc {
+	enc := json.NewEncoder(os.Stdout)
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		// ステータスコードを確定させてから記録するため、エラーはここでエラーハンドラに渡す
+		HandleError:      true,
+		LogLatency:       true,
+		LogRemoteIP:      true,
+		LogHost:          true,
+		LogMethod:        true,
+		LogURI:           true,
+		LogRequestID:     true,
+		LogUserAgent:     true,
+		LogStatus:        true,
+		LogError:         true,
+		LogContentLength: true,
+		LogResponseSize:  true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			if v.Status < 400 && v.Error == nil && rand.Float64() >= sampleRate {
+				return nil
+			}
+			line := accessLogLine{
+				Time:         v.StartTime.Format(time.RFC3339Nano),
+				ID:           v.RequestID,
+				RemoteIP:     v.RemoteIP,
+				Host:         v.Host,
+				Method:       v.Method,
+				URI:          v.URI,
+				UserAgent:    v.UserAgent,
+				Status:       v.Status,
+				Latency:      int64(v.Latency),
+				LatencyHuman: v.Latency.String(),
+				BytesOut:     v.ResponseSize,
+			}
+			if v.Error != nil {
+				line.Error = v.Error.Error()
+			}
+			line.BytesIn, _ = strconv.ParseInt(v.ContentLength, 10, 64)
+			// ルートのパラメータはハンドラの実行後もコンテキストに残っている
+			if userFields && strings.HasPrefix(c.Path(), "/users/:id") {
+				if id, err := strconv.Atoi(c.Param("id")); err == nil {
+					line.UserID, line.Action = id, userAction(v.Method)
+				}
+			}
+			return enc.Encode(line)
+		},
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// captureStdout はテストの間、標準出力をファイルに書き出し、書き出した先のパスを返します。
+// アクセスログは作成時の os.Stdout に書き込むので、サーバーを作る前に呼びます。
+func captureStdout(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stdout")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = f
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		f.Close()
+	})
+	return path
+}
+
+// readAccessLog は書き出されたアクセスログの行を読み込みます。
+func readAccessLog(t *testing.T, path string) []accessLogLine {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []accessLogLine
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var line accessLogLine
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("invalid access log line %q: %v", sc.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	path := captureStdout(t)
+	// 成功したリクエストは1件も出力しない設定でも、エラーはすべて出力する
+	s := newTestServer(t, map[string]string{"ACCESS_LOG_SAMPLE_RATE": "0", "ACCESS_LOG_USER_FIELDS": "true"})
+	for i := 0; i < 10; i++ {
+		expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusOK)
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/abc", ""), http.StatusBadRequest)
+	expectStatus(t, request(s, http.MethodGet, "/users/42", ""), http.StatusNotFound)
+	expectStatus(t, request(s, http.MethodPost, "/users", `{"name":""}`), http.StatusBadRequest)
+
+	lines := readAccessLog(t, path)
+	if len(lines) != 3 {
+		t.Fatalf("access log has %d lines, want 3: %+v", len(lines), lines)
+	}
+	for _, line := range lines {
+		if line.Status < 400 {
+			t.Errorf("successful request was logged: %+v", line)
+		}
+	}
+	if got := lines[1]; got.URI != "/users/42" || got.UserID != 42 || got.Action != "read" {
+		t.Errorf("user fields = %+v", got)
+	}
+}
+
+func TestAccessLogUserFields(t *testing.T) {
+	path := captureStdout(t)
+	s := newTestServer(t, map[string]string{"ACCESS_LOG_USER_FIELDS": "true"})
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+	userPath := fmt.Sprintf("/users/%d", u.ID)
+	expectStatus(t, request(s, http.MethodGet, userPath, ""), http.StatusOK)
+	expectStatus(t, request(s, http.MethodPatch, userPath, `{"age":31}`), http.StatusOK)
+	expectStatus(t, request(s, http.MethodGet, userPath+"/posts", ""), http.StatusOK)
+	expectStatus(t, request(s, http.MethodDelete, userPath, ""), http.StatusNoContent)
+
+	// POST /users はパスにIDがないので出力しない
+	want := []struct {
+		userID int
+		action string
+	}{{0, ""}, {u.ID, "read"}, {u.ID, "update"}, {u.ID, "read"}, {u.ID, "delete"}}
+	lines := readAccessLog(t, path)
+	if len(lines) != len(want) {
+		t.Fatalf("access log has %d lines, want %d", len(lines), len(want))
+	}
+	for i, w := range want {
+		if lines[i].UserID != w.userID || lines[i].Action != w.action {
+			t.Errorf("%s %s: user_id = %d, action = %q, want %d %q",
+				lines[i].Method, lines[i].URI, lines[i].UserID, lines[i].Action, w.userID, w.action)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestResetSequence(t *testing.T) {
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys})
+	admin := []string{"X-API-Key", "admin-secret"}
+	rec := request(s, http.MethodPost, "/users", `{"name":"Taro","age":30,"email":"taro@example.com"}`, admin...)
+	expectStatus(t, rec, http.StatusCreated)
+
+	// 論理削除しただけの行もIDを使っているので、リセットできない
+	expectStatus(t, request(s, http.MethodDelete, "/users/1", "", admin...), http.StatusNoContent)
+	expectStatus(t, request(s, http.MethodPost, "/admin/reset-sequence", "", admin...), http.StatusConflict)
+
+	if _, err := s.db.Exec("DELETE FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, request(s, http.MethodPost, "/admin/reset-sequence", "", "X-API-Key", "reader-secret"), http.StatusForbidden)
+	expectStatus(t, request(s, http.MethodPost, "/admin/reset-sequence", "", admin...), http.StatusNoContent)
+
+	rec = request(s, http.MethodPost, "/users", `{"name":"Hanako","age":25,"email":"hanako@example.com"}`, admin...)
+	expectStatus(t, rec, http.StatusCreated)
+	var again User
+	decode(t, rec, &again)
+	if again.ID != 1 {
+		t.Errorf("id after reset = %d, want 1", again.ID)
+	}
+}
+
+func TestCompactIDs(t *testing.T) {
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys})
+	admin := []string{"X-API-Key", "admin-secret"}
+	for i := 1; i <= 5; i++ {
+		rec := request(s, http.MethodPost, "/users", fmt.Sprintf(`{"name":"user%d","age":20}`, i), admin...)
+		expectStatus(t, rec, http.StatusCreated)
+	}
+	for _, id := range []int{3, 5} {
+		rec := request(s, http.MethodPost, fmt.Sprintf("/users/%d/posts", id), fmt.Sprintf("title=post+by+user%d", id),
+			append([]string{echo.HeaderContentType, echo.MIMEApplicationForm}, admin...)...)
+		expectStatus(t, rec, http.StatusCreated)
+	}
+	if _, err := s.db.Exec("DELETE FROM users WHERE id IN (2, 4)"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, request(s, http.MethodPost, "/admin/compact-ids", "", admin...), http.StatusBadRequest)
+	expectStatus(t, request(s, http.MethodPost, "/admin/compact-ids?confirm=true", "", "X-API-Key", "reader-secret"), http.StatusForbidden)
+	rec := request(s, http.MethodPost, "/admin/compact-ids?confirm=true", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	var res struct {
+		Mapping map[int]int `json:"mapping"`
+	}
+	decode(t, rec, &res)
+	if fmt.Sprint(res.Mapping) != "map[3:2 5:3]" {
+		t.Errorf("mapping = %v, want map[3:2 5:3]", res.Mapping)
+	}
+
+	// IDは1からの連番になり、投稿は同じユーザーを指したまま
+	rec = request(s, http.MethodGet, "/users?sort=id", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	var users []User
+	decode(t, rec, &users)
+	got := []string{}
+	for _, u := range users {
+		got = append(got, fmt.Sprintf("%d:%s", u.ID, u.Name))
+	}
+	if fmt.Sprint(got) != "[1:user1 2:user3 3:user5]" {
+		t.Errorf("users after compaction = %v", got)
+	}
+	rows, err := s.db.Query("SELECT p.title, u.name FROM posts p JOIN users u ON u.id = p.user_id ORDER BY p.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	posts := []string{}
+	for rows.Next() {
+		var title, name string
+		if err := rows.Scan(&title, &name); err != nil {
+			t.Fatal(err)
+		}
+		posts = append(posts, title+"="+name)
+	}
+	if fmt.Sprint(posts) != "[post by user3=user3 post by user5=user5]" {
+		t.Errorf("posts after compaction = %v", posts)
+	}
+
+	// 次のユーザーは最後のIDの次から採番する
+	rec = request(s, http.MethodPost, "/users", `{"name":"user6","age":20}`, admin...)
+	expectStatus(t, rec, http.StatusCreated)
+	var next User
+	decode(t, rec, &next)
+	if next.ID != 4 {
+		t.Errorf("id after compaction = %d, want 4", next.ID)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys})
+	admin := []string{"X-API-Key", "admin-secret"}
+	for i, age := range []int{30, 25, 45} {
+		rec := request(s, http.MethodPost, "/users", fmt.Sprintf(`{"name":"user%d","age":%d,"email":"user%d@example.com"}`, i+1, age, i+1), admin...)
+		expectStatus(t, rec, http.StatusCreated)
+	}
+	rec := request(s, http.MethodPost, "/users/1/posts", "title=first",
+		append([]string{echo.HeaderContentType, echo.MIMEApplicationForm}, admin...)...)
+	expectStatus(t, rec, http.StatusCreated)
+
+	anonymize := func(body string, want int64) {
+		t.Helper()
+		rec := request(s, http.MethodPost, "/admin/anonymize", body, admin...)
+		expectStatus(t, rec, http.StatusOK)
+		var res struct {
+			Anonymized int64 `json:"anonymized"`
+		}
+		decode(t, rec, &res)
+		if res.Anonymized != want {
+			t.Errorf("anonymize %s = %d, want %d", body, res.Anonymized, want)
+		}
+	}
+	anonymize(`{"ids":[1]}`, 1)
+	anonymize(`{"min_age":40}`, 1)
+	// 匿名化済みのユーザーは数えない
+	anonymize(`{"ids":[1,3]}`, 0)
+
+	// 名前とメールアドレスだけを消し、IDと投稿は残す
+	for _, id := range []int{1, 3} {
+		rec := request(s, http.MethodGet, fmt.Sprintf("/users/%d", id), "", admin...)
+		expectStatus(t, rec, http.StatusOK)
+		var u User
+		decode(t, rec, &u)
+		if u.ID != id || u.Name != anonymizedName || u.Email != "" || u.AnonymizedAt == nil || u.Age == 0 {
+			t.Errorf("user %d after anonymize = %+v", id, u)
+		}
+	}
+	rec = request(s, http.MethodGet, "/users/2", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	var kept User
+	decode(t, rec, &kept)
+	if kept.Name != "user2" || kept.Email != "user2@example.com" || kept.AnonymizedAt != nil {
+		t.Errorf("user 2 was changed: %+v", kept)
+	}
+	rec = request(s, http.MethodGet, "/users/1/posts", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), `"first"`) {
+		t.Errorf("posts of an anonymized user = %s", rec.Body.String())
+	}
+
+	expectStatus(t, request(s, http.MethodPost, "/admin/anonymize", `{}`, admin...), http.StatusBadRequest)
+	expectStatus(t, request(s, http.MethodPost, "/admin/anonymize", `{"ids":[2]}`, "X-API-Key", "reader-secret"), http.StatusForbidden)
+
+	// UNIQUE_NAMES=true の場合は、匿名化した名前が重ならないようにIDを付ける
+	s = newTestServer(t, map[string]string{"UNIQUE_NAMES": "true"})
+	for i := 1; i <= 2; i++ {
+		expectStatus(t, request(s, http.MethodPost, "/users", fmt.Sprintf(`{"name":"user%d","age":20}`, i), admin...), http.StatusCreated)
+	}
+	anonymize(`{"ids":[1,2]}`, 2)
+	rec = request(s, http.MethodGet, "/users/2", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &kept)
+	if kept.Name != anonymizedName+" 2" {
+		t.Errorf("anonymized name with UNIQUE_NAMES = %q", kept.Name)
+	}
+}
+
+func TestAdminWithoutAPIKeys(t *testing.T) {
+	s := newTestServer(t, map[string]string{"MASKED_FIELDS": "email"})
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	// 認証が無効でも、キーのないリクエストを管理者としては扱わない
+	for _, target := range []string{"/admin/dump", "/admin/requests", "/debug/info", "/debug/routes"} {
+		expectStatus(t, request(s, http.MethodGet, target, ""), http.StatusForbidden)
+	}
+	expectStatus(t, request(s, http.MethodPost, "/admin/compact-ids?confirm=true", ""), http.StatusForbidden)
+
+	// 一般のルートは今まで通り使え、フィールドの変更も制限しない
+	rec := request(s, http.MethodPut, "/users/1", `{"name":"Jiro","age":31,"email":"jiro@example.com"}`)
+	expectStatus(t, rec, http.StatusOK)
+	var u User
+	decode(t, rec, &u)
+	if u.Name != "Jiro" || u.Email != "jiro@example.com" {
+		t.Errorf("PUT without auth = %+v", u)
+	}
+}
+
+func TestAdminRoutesDisabledWithoutAPIKeys(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+	tests := []struct {
+		method, target, body string
+	}{
+		{http.MethodGet, "/admin/dump", ""},
+		{http.MethodGet, "/admin/requests", ""},
+		{http.MethodPost, "/admin/wal-checkpoint", ""},
+		{http.MethodPost, "/admin/reset-sequence", ""},
+		{http.MethodPost, "/admin/compact-ids?confirm=true", ""},
+		{http.MethodPost, "/admin/anonymize", `{"ids":[1]}`},
+		{http.MethodGet, "/debug/routes", ""},
+		{http.MethodGet, "/debug/info", ""},
+		{http.MethodDelete, "/users?confirm=true", `{"name":"Taro"}`},
+		{http.MethodPost, "/users/bulk-upsert", `[{"name":"Hanako","age":25,"email":"hanako@example.com"}]`},
+	}
+	for _, tt := range tests {
+		rec := request(s, tt.method, tt.target, tt.body)
+		expectStatus(t, rec, http.StatusForbidden)
+		if !strings.Contains(rec.Body.String(), "configure API_KEYS") {
+			t.Errorf("%s %s = %s", tt.method, tt.target, rec.Body.String())
+		}
+	}
+	// 拒否したリクエストは何も変更しない
+	rec := request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	var users []User
+	decode(t, rec, &users)
+	if len(users) != 1 || users[0].Name != "Taro" {
+		t.Errorf("users = %+v", users)
+	}
+}
+
+func TestBulkDelete(t *testing.T) {
+	s := newAdminTestServer(t, nil)
+	createUser(t, s, "Taro", 17, "taro@example.com")
+	createUser(t, s, "Taro Yamada", 30, "yamada@example.com")
+	createUser(t, s, "Jiro", 35, "jiro@example.com")
+	createUser(t, s, "Hanako", 30, "hanako@example.com")
+	createUser(t, s, "Taro Suzuki", 60, "suzuki@example.com")
+
+	activeNames := func() string {
+		t.Helper()
+		rows, err := s.db.Query("SELECT name FROM users WHERE deleted_at IS NULL ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		names := []string{}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		return strings.Join(names, ",")
+	}
+	all := activeNames()
+
+	// confirm=true がない場合や、条件がない場合は何も削除しない
+	expectStatus(t, request(s, http.MethodDelete, "/users", `{"name":"Taro"}`), http.StatusBadRequest)
+	expectStatus(t, request(s, http.MethodDelete, "/users?confirm=yes", `{"name":"Taro"}`), http.StatusBadRequest)
+	expectStatus(t, request(s, http.MethodDelete, "/users?confirm=true", `{}`), http.StatusBadRequest)
+	if got := activeNames(); got != all {
+		t.Fatalf("rejected bulk delete removed users: %s", got)
+	}
+
+	// 名前に Taro を含み、18歳以上40歳以下のユーザーだけを削除する
+	rec := request(s, http.MethodDelete, "/users?confirm=true", `{"name":"Taro","min_age":18,"max_age":40}`)
+	expectStatus(t, rec, http.StatusOK)
+	var res map[string]int64
+	decode(t, rec, &res)
+	if res["deleted"] != 1 {
+		t.Errorf("deleted = %d, want 1", res["deleted"])
+	}
+	if got, want := activeNames(), "Taro,Jiro,Hanako,Taro Suzuki"; got != want {
+		t.Errorf("active users = %s, want %s", got, want)
+	}
+
+	rec = request(s, http.MethodDelete, "/users?confirm=true", `{"min_age":30}`)
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &res)
+	if res["deleted"] != 3 {
+		t.Errorf("deleted = %d, want 3", res["deleted"])
+	}
+	if got, want := activeNames(), "Taro"; got != want {
+		t.Errorf("active users = %s, want %s", got, want)
+	}
+
+	// 削除済みのユーザーは数えない
+	rec = request(s, http.MethodDelete, "/users?confirm=true", `{"name_prefix":"Taro"}`)
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &res)
+	if res["deleted"] != 1 {
+		t.Errorf("deleted = %d, want 1", res["deleted"])
+	}
+	if got := activeNames(); got != "" {
+		t.Errorf("active users = %s, want none", got)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// apiKey はAPIキーの設定です。Label はログや記録に使う名前で、Secret は外に出しません。
+type apiKey struct {
+	Label  string
+	Secret string
+	Admin  bool
+}
+
+// parseAPIKeys は "label:secret[:admin],..." 形式の文字列をAPIキーの一覧に変換します。
+func parseAPIKeys(s string) []apiKey {
+	var keys []apiKey
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		keys = append(keys, apiKey{
+			Label:  parts[0],
+			Secret: parts[1],
+			Admin:  len(parts) > 2 && parts[2] == "admin",
+		})
+	}
+	return keys
+}
+
+// publicPaths は認証なしでアクセスできるルートです。
+var publicPaths = map[string]bool{
+	"/":            true,
+	"/favicon.ico": true,
+	"/healthz":     true,
+}
+
+// actorKey はリクエストのコンテキストに、認証したAPIキーのラベルを保存するためのキーです。
+// リポジトリは created_by / updated_by にこの値を記録します。
+type actorKey struct{}
+
+// actor は ctx のリクエストを認証したAPIキーのラベルを返します。認証が無効な場合は空文字です。
+func actor(ctx context.Context) string {
+	label, _ := ctx.Value(actorKey{}).(string)
+	return label
+}
+
+// apiKeyAuth は X-API-Key ヘッダーでリクエストを認証するミドルウェアを返します。
+// 認証に成功したキーはコンテキストに "apiKey" として、そのラベルはリクエストのコンテキストに保存されます。
+func apiKeyAuth(keys []apiKey) echo.MiddlewareFunc {
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Skipper: func(c echo.Context) bool {
+			// OPTIONSはルーターが自動で204とAllowヘッダーを返すため、認証なしで許可します。
+			return publicPaths[c.Path()] || c.Request().Method == http.MethodOptions
+		},
+		KeyLookup: "header:X-API-Key",
+		Validator: func(secret string, c echo.Context) (bool, error) {
+			for i := range keys {
+				if subtle.ConstantTimeCompare([]byte(secret), []byte(keys[i].Secret)) == 1 {
+					c.Set("apiKey", &keys[i])
+					req := c.Request()
+					c.SetRequest(req.WithContext(context.WithValue(req.Context(), actorKey{}, keys[i].Label)))
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		// キーがないときも間違っているときも、同じ401で拒否します（既定ではキーがないと400になります）。
+		ErrorHandler: func(err error, c echo.Context) error {
+			return &echo.HTTPError{Code: http.StatusUnauthorized, Message: "Unauthorized", Internal: err}
+		},
+	})
+}
+
+// currentKey は認証済みのAPIキーを返します。認証が無効な場合はnilです。
+func currentKey(c echo.Context) *apiKey {
+	key, _ := c.Get("apiKey").(*apiKey)
+	return key
+}
+
+// authDisabledKey はコンテキストに、認証が無効（API_KEYS が空）であることを保存するためのキーです。
+const authDisabledKey = "authDisabled"
+
+// withoutAuth は API_KEYS が空の場合に apiKeyAuth の代わりに使うミドルウェアで、認証が無効なことを記録します。
+func withoutAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Set(authDisabledKey, true)
+		return next(c)
+	}
+}
+
+// authDisabled は認証が無効な設定で受け付けたリクエストかどうかを返します。
+func authDisabled(c echo.Context) bool {
+	disabled, _ := c.Get(authDisabledKey).(bool)
+	return disabled
+}
+
+// isAdmin は管理者のキーで認証したリクエストかどうかを返します。
+// キーのないリクエストは、認証が無効な場合も含めて管理者として扱いません。
+func isAdmin(c echo.Context) bool {
+	key := currentKey(c)
+	return key != nil && key.Admin
+}
+
+// requireAdmin は管理者のキーでないリクエストを403で拒否するミドルウェアです。
+// 認証が無効な場合は誰でも使えてしまうため、管理者用のルートはすべて拒否します。
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if authDisabled(c) {
+			return echo.NewHTTPError(http.StatusForbidden, "admin endpoints are disabled: configure API_KEYS with an admin key")
+		}
+		if !isAdmin(c) {
+			return echo.NewHTTPError(http.StatusForbidden, "admin key required")
+		}
+		return next(c)
+	}
+}
+
+// checkFieldPermissions は管理者以外のキーが、許可されていないフィールドを変更しようとしていないか確認します。
+// 認証が無効な場合は、すべてのフィールドを変更できます。
+func checkFieldPermissions(c echo.Context, changed []string, allowed map[string]bool) error {
+	if authDisabled(c) || isAdmin(c) {
+		return nil
+	}
+	for _, field := range changed {
+		if !allowed[field] {
+			return echo.NewHTTPError(http.StatusForbidden, "not allowed to modify field: "+field)
+		}
+	}
+	return nil
+}
+
+// changedFields は現在の値から変更されるフィールド名を返します。
+func changedFields(current, updated User) []string {
+	var fields []string
+	if current.Name != updated.Name {
+		fields = append(fields, "name")
+	}
+	if current.Age != updated.Age {
+		fields = append(fields, "age")
+	}
+	if current.Email != updated.Email {
+		fields = append(fields, "email")
+	}
+	return fields
+}
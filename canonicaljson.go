@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+// canonicalKeyOrder はオブジェクトのキーを並べる順番です。ここにないキーはその後ろに名前順で並べます。
+// 構造体のフィールドの順番を変えてもレスポンスのバイト列が変わらないよう、順番をここで決めています。
+var canonicalKeyOrder = []string{"id", "user_id", "name", "age", "email", "status", "title", "created_at", "updated_at", "deleted_at", "anonymized_at"}
+
+// canonicalJSONSerializer はレスポンスのJSONを常に同じバイト列で出力する echo.JSONSerializer です。
+// キーを canonicalKeyOrder と名前順で並べ、インデントやHTMLのエスケープを行いません（?pretty も無視します）。
+// テストでレスポンスをスナップショットとして比較するためのものです。
+type canonicalJSONSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (canonicalJSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	b, err := canonicalJSON(i)
+	if err != nil {
+		return err
+	}
+	_, err = c.Response().Write(append(b, '\n'))
+	return err
+}
+
+// canonicalJSON は v を正規化したJSONに変換します。
+func canonicalJSON(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// 一度汎用の値に戻してから、キーの順番を決めて書き直す。数値は精度を保つため json.Number で読む
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, tree); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sortCanonicalKeys(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case string:
+		writeString(buf, v)
+	default:
+		// json.Number、bool、nil
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+// writeString は文字列をHTMLのエスケープなしでJSONの文字列として書き込みます。
+func writeString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	// Encode が付ける改行を取り除く
+	buf.Truncate(buf.Len() - 1)
+}
+
+func sortCanonicalKeys(keys []string) {
+	rank := func(k string) int {
+		for i, o := range canonicalKeyOrder {
+			if o == k {
+				return i
+			}
+		}
+		return len(canonicalKeyOrder)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := rank(keys[i]), rank(keys[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+}
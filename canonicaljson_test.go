@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want string
+	}{
+		{map[string]interface{}{"zeta": 1, "email": "a@example.com", "id": 7, "alpha": true, "name": "<Taro>"},
+			`{"id":7,"name":"<Taro>","email":"a@example.com","alpha":true,"zeta":1}`},
+		{[]interface{}{map[string]int{"b": 1, "a": 2}, nil, 1.5}, `[{"a":2,"b":1},null,1.5]`},
+		{struct {
+			Email string `json:"email"`
+			Big   int64  `json:"big"`
+			ID    int    `json:"id"`
+		}{"x@example.com", 1 << 60, 1}, `{"id":1,"email":"x@example.com","big":1152921504606846976}`},
+	}
+	for _, tt := range tests {
+		b, err := canonicalJSON(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("canonicalJSON(%v) = %s, want %s", tt.in, b, tt.want)
+		}
+	}
+}
+
+func TestCanonicalJSONResponse(t *testing.T) {
+	s := newTestServer(t, map[string]string{"CANONICAL_JSON": "true"})
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(timestampFormat)
+	if _, err := s.db.Exec("INSERT INTO users (name, age, email, created_at, updated_at) VALUES ('Taro', 30, 'taro@example.com', ?, ?)", ts, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	// ?pretty を指定しても同じバイト列になる
+	want := `{"id":1,"name":"Taro","age":30,"email":"taro@example.com","status":"active",` +
+		`"created_at":"2024-01-02T03:04:05Z","updated_at":"2024-01-02T03:04:05Z"}` + "\n"
+	for _, path := range []string{"/users/1", "/users/1?pretty"} {
+		rec := request(s, http.MethodGet, path, "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := rec.Body.String(); got != want {
+			t.Errorf("GET %s = %s, want %s", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// chaos はクライアントのリトライ処理を試すため、リクエストに遅延やエラーをわざと注入します。
+type chaos struct {
+	delay     time.Duration
+	delayRate float64 // 遅延を入れるリクエストの割合（0〜1）
+	errorRate float64 // 500を返すリクエストの割合（0〜1）
+	random    func() float64
+}
+
+func newChaos(delay time.Duration, delayRate, errorRate float64) *chaos {
+	return &chaos{delay: delay, delayRate: delayRate, errorRate: errorRate, random: rand.Float64}
+}
+
+// enabled は遅延かエラーのどちらかが有効かどうかを返します。
+func (ch *chaos) enabled() bool {
+	return (ch.delay > 0 && ch.delayRate > 0) || ch.errorRate > 0
+}
+
+func (ch *chaos) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if ch.delay > 0 && ch.random() < ch.delayRate {
+				t := time.NewTimer(ch.delay)
+				select {
+				case <-t.C:
+				case <-c.Request().Context().Done():
+					t.Stop()
+				}
+			}
+			if ch.random() < ch.errorRate {
+				return echo.NewHTTPError(http.StatusInternalServerError, "chaos: injected error")
+			}
+			return next(c)
+		}
+	}
+}
+
+// useChaos は開発モードの場合のみカオス注入を有効にします。本番で誤って有効にならないよう、それ以外では無視して警告を出します。
+func useChaos(e *echo.Echo, cfg config) {
+	ch := newChaos(cfg.ChaosDelay, cfg.ChaosDelayRate, cfg.ChaosErrorRate)
+	if !ch.enabled() {
+		return
+	}
+	if !cfg.Development {
+		log.Println("chaos: CHAOS_* settings are ignored unless ENV=development")
+		return
+	}
+	log.Printf("chaos: ENABLED delay=%s delay_rate=%.2f error_rate=%.2f", ch.delay, ch.delayRate, ch.errorRate)
+	e.Use(ch.middleware())
+}
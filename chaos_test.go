@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestChaosErrorRate(t *testing.T) {
+	for _, rate := range []float64{0, 0.3, 1} {
+		ch := newChaos(0, 0, rate)
+		ch.random = rand.New(rand.NewSource(1)).Float64
+		e := echo.New()
+		e.Use(ch.middleware())
+		e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+		const n = 1000
+		failed := 0
+		for i := 0; i < n; i++ {
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code == http.StatusInternalServerError {
+				failed++
+			}
+		}
+		// 注入したエラーの割合が設定した割合に近い
+		if got := float64(failed) / n; got < rate-0.05 || got > rate+0.05 {
+			t.Errorf("error rate %.2f: %d of %d requests failed", rate, failed, n)
+		}
+	}
+}
+
+func TestChaosDelay(t *testing.T) {
+	ch := newChaos(50*time.Millisecond, 1, 0)
+	e := echo.New()
+	e.Use(ch.middleware())
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	expectStatus(t, rec, http.StatusOK)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("request took %v, want at least 50ms", elapsed)
+	}
+}
+
+func TestChaosOnlyInDevelopment(t *testing.T) {
+	// 本番では CHAOS_* を設定しても注入しない
+	s := newTestServer(t, map[string]string{"CHAOS_ERROR_RATE": "1"})
+	expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusOK)
+
+	s = newTestServer(t, map[string]string{"CHAOS_ERROR_RATE": "1", "ENV": "development"})
+	expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusInternalServerError)
+}
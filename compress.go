@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// gzipMiddleware はクライアントが受け付ける場合にレスポンスを gzip で圧縮します。
+// echo の Gzip は Accept-Encoding に "gzip" という文字列が含まれるかしか見ないため、
+// "identity" のみの指定や "gzip;q=0" による拒否を正しく扱えるよう、判定は acceptsGzip で行います。
+func gzipMiddleware() echo.MiddlewareFunc {
+	return middleware.GzipWithConfig(middleware.GzipConfig{
+		Skipper: func(c echo.Context) bool {
+			// ?compress=gzip のダンプは自分で圧縮するので二重に圧縮しない
+			if c.Path() == "/admin/dump" {
+				return true
+			}
+			req := c.Request()
+			if !acceptsGzip(req.Header.Get(echo.HeaderAcceptEncoding)) {
+				return true
+			}
+			// echo の Gzip は "gzip" の文字列を探すので、"*" や大文字の指定でも圧縮されるよう書き換える
+			req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+			return false
+		},
+	})
+}
+
+// acceptsGzip は Accept-Encoding ヘッダーが gzip を受け付けるかどうかを返します。
+// gzip が明示されていればその q 値で、なければ "*" の q 値で判断します。
+// "identity" だけが指定されている場合や、ヘッダーがない場合は圧縮しません。
+func acceptsGzip(header string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch coding {
+		case "gzip", "x-gzip":
+			return q > 0
+		case "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"identity", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0, identity", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"gzip;q=0, *", false},
+		{"br, identity;q=1", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGzipIdentity(t *testing.T) {
+	s := newTestServer(t, map[string]string{"GZIP": "true"})
+	insertUsers(t, s, 50)
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"identity", ""},
+		{"gzip;q=0", ""},
+		{"gzip", "gzip"},
+		{"*", "gzip"},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users", "", "Accept-Encoding", tt.header)
+		expectStatus(t, rec, http.StatusOK)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want %q", tt.header, got, tt.want)
+		}
+		if tt.want == "" {
+			var list []User
+			decode(t, rec, &list)
+			if len(list) != 50 {
+				t.Errorf("Accept-Encoding %q: %d users", tt.header, len(list))
+			}
+		}
+	}
+}
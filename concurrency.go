@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// concurrencyCap はサーバー全体で同時に処理するリクエストの数を制限します。
+// DBのセマフォ（DB_MAX_CONCURRENCY）とは別に、DBを使わない処理も含めた過負荷を防ぐためのものです。
+// 上限を超えたリクエストは到着順に待ち行列に並び、行列が満杯の場合や wait を過ぎても順番が来ない場合は503になります。
+type concurrencyCap struct {
+	sem  *prioritySemaphore
+	max  int
+	wait time.Duration
+	// rejected は503で断ったリクエストの累計です。
+	rejected atomic.Int64
+}
+
+func newConcurrencyCap(max, queue int, wait time.Duration) *concurrencyCap {
+	return &concurrencyCap{sem: newPrioritySemaphore(max, queue, 0), max: max, wait: wait}
+}
+
+// middleware は空きを確保してからハンドラを実行します。
+// 混雑していても状態を確認できるよう、/healthz と /metrics は数えません。
+func (cc *concurrencyCap) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if p := c.Path(); p == "/healthz" || p == "/metrics" {
+			return next(c)
+		}
+		ctx, cancel := context.WithTimeout(c.Request().Context(), cc.wait)
+		err := cc.sem.Acquire(ctx, true)
+		cancel()
+		if err != nil {
+			cc.rejected.Add(1)
+			setRetryAfter(c, 1)
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "server is overloaded").SetInternal(err)
+		}
+		defer cc.sem.Release()
+		return next(c)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// blockingRoute は release が閉じられるまで戻らないルートを登録し、同時に実行した数の最大値を返す関数を返します。
+func blockingRoute(s *server, release chan struct{}) (inFlight func() int32, peak func() int32) {
+	var now, max atomic.Int32
+	s.e.GET("/block", func(c echo.Context) error {
+		n := now.Add(1)
+		defer now.Add(-1)
+		for {
+			m := max.Load()
+			if n <= m || max.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+		return c.NoContent(http.StatusNoContent)
+	})
+	return now.Load, max.Load
+}
+
+// waitFor は cond がtrueになるまで待ちます。
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConcurrencyCap(t *testing.T) {
+	s := newTestServer(t, map[string]string{"MAX_CONCURRENT_REQUESTS": "2", "CONCURRENCY_QUEUE": "1", "CONCURRENCY_QUEUE_WAIT_MS": "5000"})
+	release := make(chan struct{})
+	inFlight, peak := blockingRoute(s, release)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 3)
+	send := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- request(s, http.MethodGet, "/block", "").Code
+		}()
+	}
+	metrics := func() string {
+		rec := request(s, http.MethodGet, "/metrics", "")
+		expectStatus(t, rec, http.StatusOK)
+		return rec.Body.String()
+	}
+	send()
+	send()
+	waitFor(t, "2 requests in flight", func() bool { return inFlight() == 2 })
+	// 上限を超えた分は待ち行列に並ぶ。状態の確認は混雑していても数えない
+	send()
+	waitFor(t, "a queued request", func() bool { return strings.Contains(metrics(), "\nhttp_queued_requests 1\n") })
+	expectStatus(t, request(s, http.MethodGet, "/healthz", ""), http.StatusOK)
+
+	// 待ち行列も満杯なら、すぐに Retry-After 付きの503を返す
+	rec := request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("503 without Retry-After")
+	}
+	for _, want := range []string{"\nhttp_inflight_requests 2\n", "\nhttp_overload_rejected_total 1\n", "\nhttp_max_concurrent_requests 2\n"} {
+		if m := metrics(); !strings.Contains(m, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, m)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusNoContent {
+			t.Errorf("admitted request: status = %d", code)
+		}
+	}
+	if n := peak(); n != 2 {
+		t.Errorf("peak concurrency = %d, want 2", n)
+	}
+}
+
+func TestConcurrencyCapSaturation(t *testing.T) {
+	s := newTestServer(t, map[string]string{"MAX_CONCURRENT_REQUESTS": "4", "CONCURRENCY_QUEUE": "4", "CONCURRENCY_QUEUE_WAIT_MS": "50"})
+	release := make(chan struct{})
+	_, peak := blockingRoute(s, release)
+
+	// 上限と待ち行列を大きく超えるリクエストを同時に送ると、上限を超えて処理せず、残りは503になる
+	var wg sync.WaitGroup
+	var ok, rejected atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/block", nil))
+			switch rec.Code {
+			case http.StatusNoContent:
+				ok.Add(1)
+			case http.StatusServiceUnavailable:
+				rejected.Add(1)
+			default:
+				t.Errorf("status = %d", rec.Code)
+			}
+		}()
+	}
+	// 待ち行列に並んだリクエストも、順番が来ないまま wait を過ぎて503になる
+	waitFor(t, "rejected requests", func() bool { return rejected.Load() == 16 })
+	close(release)
+	wg.Wait()
+	if ok.Load() != 4 || peak() != 4 {
+		t.Errorf("%d admitted, %d rejected, peak %d", ok.Load(), rejected.Load(), peak())
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config は環境変数から読み込むアプリケーションの設定です。
+type config struct {
+	// Development がtrueの場合（ENV=development）、500エラーのレスポンスに詳細を含めます。
+	Development bool
+	// LogLevel は echo のログの出力レベルです（debug, info, warn, error, off）。
+	LogLevel string
+	// ReadOnly がtrueの場合、GET/HEAD/OPTIONS 以外のリクエストに503を返します。
+	// LogLevel、ReadOnly とレート制限の設定は、CONFIG_FILE を書き換えて SIGHUP を送ると再起動せずに変更できます。
+	ReadOnly bool
+	// TrailingSlashRedirect がtrueの場合、末尾スラッシュ付きのURLを301でリダイレクトします。
+	// falseの場合はリダイレクトせずに内部で書き換えます。
+	TrailingSlashRedirect bool
+	// CaseInsensitivePaths がtrueの場合、パスの固定部分の大文字小文字を区別しません（/Users を /users として扱います）。
+	CaseInsensitivePaths bool
+	// StrictJSONCharset がtrueの場合、JSONリクエストのcharsetはutf-8以外を拒否します。
+	StrictJSONCharset bool
+	// StrictBodylessMethods がtrueの場合、ボディ付きの GET/HEAD/DELETE リクエスト（DELETE /users を除く）を400にします。
+	// falseの場合はボディを無視します。
+	StrictBodylessMethods bool
+	// StrictJSONBody がtrueの場合、POST/PUT のボディはJSONのみを受け付け、フォームは415で拒否します。
+	// 既定ではフォームも受け付けます。
+	StrictJSONBody bool
+	// RequestTimeout はリクエストごとのタイムアウトです。DBクエリもこの時間で打ち切られます。
+	RequestTimeout time.Duration
+	// APIKeys が空でない場合、X-API-Key ヘッダーによる認証を有効にします。
+	APIKeys []apiKey
+	// NonAdminFields は管理者以外のキーが変更できるフィールドの一覧です。
+	NonAdminFields map[string]bool
+	// MaskedFields は管理者以外のキーへのレスポンスで一部を伏せるフィールドです（name と email に対応）。
+	// 例えば email は "b***@example.com" のように返します。管理者のキーと、認証が無効な場合は伏せません。
+	MaskedFields map[string]bool
+	// LegacyCreateStatus がtrueの場合、POST /users と POST /users/bulk-upsert はユーザーを登録しても以前と同じく200を返します。
+	// falseの場合は201を返します（POST /users は Location も付けます）。
+	LegacyCreateStatus bool
+	// SchemaVersionInBody がtrueの場合、レスポンスの各ユーザーに _schema_version を含めます（X-Api-Version ヘッダーは常に付けます）。
+	SchemaVersionInBody bool
+	// StrictSort がtrueの場合、GET /users の ?sort= と ?order= に許可されていない値を指定すると400を返します。
+	// falseの場合は無視して既定の並び順（ID順）にします。
+	StrictSort bool
+	// RecentUsersMax は GET /users/recent で返す件数の上限です。
+	RecentUsersMax int
+	// ListConditional がtrueの場合、GET /users で Last-Modified を返し、If-Modified-Since による304に対応します。
+	ListConditional bool
+	// AgeNoDecrease がtrueの場合、更新で年齢を減らすことを禁止します。
+	// リクエストに ?allow_age_decrease=true を付けると上書きできます。
+	AgeNoDecrease bool
+	// MinAge は有効な年齢の下限です。0を未入力の代わりとみなす場合は1を指定します。
+	MinAge int
+	// SkipSchemaCheck がtrueの場合、起動時のスキーマ検査を行いません。
+	SkipSchemaCheck bool
+	// TxLock はトランザクションを BEGIN（deferred）、BEGIN IMMEDIATE、BEGIN EXCLUSIVE のどれで始めるかです。
+	// 既定の immediate は開始時に書き込みのロックを取り、読み取りから書き込みへロックを上げる際の SQLITE_BUSY を避けます（initDB を参照）。
+	TxLock string
+	// JournalMode はSQLiteのジャーナルモード（delete, truncate, persist, wal）です。POST /admin/wal-checkpoint は wal の場合にだけ使えます。
+	// 空文字（既定）の場合は設定せず、DBファイルのモードのままにします。WALモードはDBファイルに記録されるので、一度 wal で起動すると空文字に戻してもWALのままです。
+	JournalMode string
+	// ReadDBPath を指定すると、GET/HEAD のリクエストのクエリをこのデータベースで実行します（読み取り専用で開きます）。
+	// レプリカのパスのほか、同じファイル（example.db）を指定して書き込み用と読み取り用の接続を分けることもできます。
+	ReadDBPath string
+	// NetworkFSPolicy はDBファイルがネットワーク上のファイルシステム（NFSなど）にありそうな場合の動作です。
+	// "warn"（既定値）は警告を出して起動し、"refuse" は起動を中止し、"ignore" は確認しません。
+	// NetworkFSPaths にはネットワーク上とみなすディレクトリを指定します（マウントの種類からも判定します）。
+	NetworkFSPolicy string
+	NetworkFSPaths  map[string]bool
+	// NameIndex がtrueの場合、?name_prefix= による前方一致検索を速くするため name にインデックスを作成します。
+	NameIndex bool
+	// UniqueNames がtrueの場合、名前の重複（大文字小文字を区別しない）を禁止し、重複した登録・更新には409を返します。
+	// 名前をユーザー名として使う場合に有効にします。
+	UniqueNames bool
+	// DBMaxConcurrency はDBを使うリクエストの最大同時実行数です。
+	DBMaxConcurrency int
+	// SQLRequestIDComment がtrueの場合、リクエスト中のクエリの先頭に /* reqid:リクエストID */ を付けます。
+	SQLRequestIDComment bool
+	// MaxConcurrentRequests が0より大きい場合、サーバー全体で同時に処理するリクエストをこの数までに制限します。
+	// 超えたリクエストは ConcurrencyQueue 件まで最大 ConcurrencyQueueWait 待たせ、それ以上は503を返します。
+	MaxConcurrentRequests int
+	ConcurrencyQueue      int
+	ConcurrencyQueueWait  time.Duration
+	// QoSHighQueue と QoSLowQueue は、読み取り（高優先度）と書き込み（低優先度）の待ち行列の長さです。
+	QoSHighQueue int
+	QoSLowQueue  int
+	// RateLimit はクライアントごとに RateLimitWindow の間に許可するリクエスト数です。0の場合は無効です。
+	RateLimit       int
+	RateLimitWindow time.Duration
+	// RateLimitWarnPercent は上限に対してこの割合に達したら警告ヘッダーを付ける閾値（%）です。
+	RateLimitWarnPercent int
+	// RetryBudgetPercent はクライアントごとに RetryBudgetWindow の間に許可する再試行の、リクエスト数に対する割合（%）です。
+	// 0の場合は無効です。有効な場合は GET /metrics で予算の状態を確認できます。
+	RetryBudgetPercent int
+	// RetryBudgetMin は割合にかかわらず、ウィンドウごとに常に許可する再試行の数です。
+	RetryBudgetMin    int
+	RetryBudgetWindow time.Duration
+	// RequestLogSampleRate は書き込みのリクエストを requests_log に記録する割合（0〜1）です。0の場合は記録しません。
+	RequestLogSampleRate float64
+	// RequestLogReads がtrueの場合、読み取り（GET/HEAD/OPTIONS）も RequestLogReadSampleRate の割合で記録します。
+	// 読み取りは件数が多いため既定では記録しませんが、閲覧の記録が求められるデータではtrueにします。
+	RequestLogReads          bool
+	RequestLogReadSampleRate float64
+	// TLSCertFile と TLSKeyFile を両方指定するとHTTPSで起動します。
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSMinVersion はHTTPSで受け付ける最低のTLSバージョンです（既定値は1.2）。
+	// TLS 1.3 のみにする場合は TLS_MIN_VERSION=1.3 を指定します。TLSを使わない場合は無視されます。
+	TLSMinVersion string
+	// ChaosDelay を ChaosDelayRate の割合のリクエストに遅延として加え、ChaosErrorRate の割合のリクエストで500を返します。
+	// リトライ処理を試すための機能で、ENV=development の場合のみ有効です。
+	ChaosDelay     time.Duration
+	ChaosDelayRate float64
+	ChaosErrorRate float64
+	// EmailEncKey を指定すると、メールアドレスをAES-GCMで暗号化して保存します（base64の16・24・32バイトの鍵）。
+	// 未指定の場合は平文で保存します。
+	EmailEncKey string
+	// EmailNormalize がtrueの場合、メールアドレスを前後の空白を除いた小文字にそろえてから検証・保存します。
+	EmailNormalize bool
+	// SlowQueryThreshold を超えたクエリはログに記録し、GET /users では X-Slow-Query ヘッダーを付けます。0の場合は無効です。
+	SlowQueryThreshold time.Duration
+	// NotFoundSuggestions がtrueの場合、GET /users/:id の404で近いIDのユーザーを候補として示します。
+	// 存在するIDがわかってしまうため、既定では無効です。
+	NotFoundSuggestions bool
+	// AccessLogSampleRate は成功したリクエストをアクセスログに出力する割合（0〜1）です。
+	// 4xx/5xx のリクエストはこの値に関係なくすべて出力します。
+	AccessLogSampleRate float64
+	// AccessLogUserFields がtrueの場合、/users/:id へのリクエストのアクセスログにユーザーID（user_id）と
+	// 操作の種類（action: create/read/update/delete）を出力します。
+	AccessLogUserFields bool
+	// BodyLimit はリクエストボディの最大サイズです（例: "4M"）。超えた場合は413を返します。
+	BodyLimit string
+	// JSONMaxDepth と JSONMaxArray は、JSONのリクエストボディの入れ子の深さと、1つの配列の要素数の上限です。
+	// 超えた場合は400を返します。0の場合は制限しません。一括処理の件数は MaxBulkRecords でも制限されます。
+	JSONMaxDepth int
+	JSONMaxArray int
+	// MultipartMaxMemory は multipart/form-data の解析でメモリに置く最大バイト数です。超えた分は一時ファイルに書き出します。
+	MultipartMaxMemory int64
+	// CanonicalJSON がtrueの場合、レスポンスのJSONのキーを決まった順番で並べ、インデントなしで出力します。
+	CanonicalJSON bool
+	// MaintenanceStart と MaintenanceEnd（RFC 3339）を指定すると、その間は /healthz 以外に503を返します。
+	MaintenanceStart string
+	MaintenanceEnd   string
+	// WebhookURL を指定すると、ユーザーの登録・更新・削除のイベントをこのURLにPOSTします。
+	// WebhookSecret を指定すると、本文のHMAC-SHA256を X-Webhook-Signature ヘッダーに付けます。
+	WebhookURL    string
+	WebhookSecret string
+	// WebhookQueue は送信待ちのイベントを保持する数です。満杯の場合は新しいイベントを破棄します。
+	WebhookQueue int
+	// PanicReportURL を指定すると、ハンドラがパニックした場合にその内容（スタックトレース、リクエストID、パス）を
+	// Webhookと同じ形式（type は "panic"）でこのURLにPOSTします。PanicReportSecret は WebhookSecret と同じ署名用の鍵です。
+	PanicReportURL    string
+	PanicReportSecret string
+	// StreamThreshold は GET /users の件数がこれを超える場合に、配列をまとめて作らずストリーミングで返す閾値です。
+	// 閾値以下の場合はメモリ上で作ってから Content-Length を付けて返します。0の場合は常にまとめて返します。
+	StreamThreshold int
+	// ConsistentPageCounts がtrueの場合、?as=page の件数とページを1つの読み取りトランザクションで読み込みます。
+	// 同時に削除などがあっても食い違わなくなりますが、その間は書き込みを短時間待たせます。
+	ConsistentPageCounts bool
+	// ListCacheInterval が0より大きい場合、クエリパラメータのない GET /users をこの間隔で読み直すスナップショットから返します。
+	// 書き込みはすぐには反映されず、レスポンスは最大でこの時間だけ古くなります（Age ヘッダーで経過秒数を返します）。
+	ListCacheInterval time.Duration
+	// PurgeRetention が0より大きい場合、論理削除からこの期間が過ぎたユーザーを PurgeInterval ごとに物理削除します。
+	// 削除したユーザーの投稿も消え、元には戻せません。
+	PurgeRetention time.Duration
+	PurgeInterval  time.Duration
+	// EmptyDatabaseHint がtrueの場合、ユーザーが1人もいないときの GET /users に、データの入れ方を案内するヘッダーを付けます。
+	EmptyDatabaseHint bool
+	// ExportChunkSize はCSVの書き出しで1回のクエリで読み込む件数です。0の場合は1つのクエリで全件を読み込みます。
+	ExportChunkSize int
+	// Gzip がtrueの場合、Accept-Encoding で gzip を受け付けるクライアントにはレスポンスを圧縮して返します。
+	Gzip bool
+	// RootDescriptor がtrueの場合、GET / でサービスの名前（ServiceName）、バージョン（ServiceVersion）と
+	// 主なエンドポイントへのリンクを返します。falseの場合は404です。
+	RootDescriptor bool
+	ServiceName    string
+	ServiceVersion string
+	// IdempotencyStore は Idempotency-Key のレスポンスの保存先です。"db"（既定値）はSQLiteに保存して再起動後も残し、
+	// "memory" はメモリに保存します（速いですが再起動で消えます）。IdempotencyTTL の間だけ保存します。
+	IdempotencyStore string
+	IdempotencyTTL   time.Duration
+	// ShutdownTimeout は終了のシグナルを受け取ってから、処理中のリクエストとワーカーの終了を待つ時間です。
+	ShutdownTimeout time.Duration
+	// MaxBulkRecords は一括処理（bulk-upsert、age-adjust の ids）で1回に受け付ける件数の上限です。超えた場合は413を返します。
+	MaxBulkRecords int
+}
+
+func loadConfig() config {
+	return config{
+		Development:              os.Getenv("ENV") == "development",
+		LogLevel:                 envString("LOG_LEVEL", "error"),
+		ReadOnly:                 envBool("READ_ONLY", false),
+		TrailingSlashRedirect:    envBool("TRAILING_SLASH_REDIRECT", false),
+		CaseInsensitivePaths:     envBool("CASE_INSENSITIVE_PATHS", false),
+		StrictJSONCharset:        envBool("STRICT_JSON_CHARSET", true),
+		StrictBodylessMethods:    envBool("STRICT_BODYLESS_METHODS", false),
+		StrictJSONBody:           envBool("STRICT_JSON_BODY", false),
+		RequestTimeout:           time.Duration(envInt("REQUEST_TIMEOUT_MS", 5000)) * time.Millisecond,
+		APIKeys:                  parseAPIKeys(os.Getenv("API_KEYS")),
+		NonAdminFields:           envSet("NON_ADMIN_FIELDS", "name,age,email"),
+		MaskedFields:             envSet("MASKED_FIELDS", ""),
+		SchemaVersionInBody:      envBool("SCHEMA_VERSION_IN_BODY", false),
+		LegacyCreateStatus:       envBool("LEGACY_CREATE_STATUS", false),
+		StrictSort:               envBool("STRICT_SORT", false),
+		RecentUsersMax:           envInt("RECENT_USERS_MAX", 50),
+		ListConditional:          envBool("LIST_CONDITIONAL", true),
+		AgeNoDecrease:            envBool("AGE_NO_DECREASE", false),
+		MinAge:                   envInt("MIN_AGE", 0),
+		SkipSchemaCheck:          envBool("SKIP_SCHEMA_CHECK", false),
+		TxLock:                   envString("TX_LOCK", "immediate"),
+		JournalMode:              strings.ToLower(envString("JOURNAL_MODE", "")),
+		ReadDBPath:               os.Getenv("READ_DB_PATH"),
+		NetworkFSPolicy:          envString("NETWORK_FS_POLICY", "warn"),
+		NetworkFSPaths:           envSet("NETWORK_FS_PATHS", ""),
+		NameIndex:                envBool("NAME_INDEX", false),
+		UniqueNames:              envBool("UNIQUE_NAMES", false),
+		DBMaxConcurrency:         envInt("DB_MAX_CONCURRENCY", 8),
+		SQLRequestIDComment:      envBool("SQL_REQUEST_ID_COMMENT", false),
+		MaxConcurrentRequests:    envInt("MAX_CONCURRENT_REQUESTS", 0),
+		ConcurrencyQueue:         envInt("CONCURRENCY_QUEUE", 100),
+		ConcurrencyQueueWait:     time.Duration(envInt("CONCURRENCY_QUEUE_WAIT_MS", 1000)) * time.Millisecond,
+		QoSHighQueue:             envInt("QOS_HIGH_QUEUE", 64),
+		QoSLowQueue:              envInt("QOS_LOW_QUEUE", 16),
+		RateLimit:                envInt("RATE_LIMIT", 0),
+		RateLimitWindow:          time.Duration(envInt("RATE_LIMIT_WINDOW_S", 60)) * time.Second,
+		RateLimitWarnPercent:     envInt("RATE_LIMIT_WARN_PERCENT", 80),
+		RetryBudgetPercent:       envInt("RETRY_BUDGET_PERCENT", 0),
+		RetryBudgetMin:           envInt("RETRY_BUDGET_MIN", 10),
+		RetryBudgetWindow:        time.Duration(envInt("RETRY_BUDGET_WINDOW_S", 60)) * time.Second,
+		RequestLogSampleRate:     envFloat("REQUEST_LOG_SAMPLE_RATE", 0),
+		RequestLogReads:          envBool("REQUEST_LOG_READS", false),
+		RequestLogReadSampleRate: envFloat("REQUEST_LOG_READ_SAMPLE_RATE", 1),
+		TLSCertFile:              os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:               os.Getenv("TLS_KEY_FILE"),
+		TLSMinVersion:            envString("TLS_MIN_VERSION", "1.2"),
+		ChaosDelay:               time.Duration(envInt("CHAOS_DELAY_MS", 0)) * time.Millisecond,
+		ChaosDelayRate:           envFloat("CHAOS_DELAY_RATE", 1),
+		ChaosErrorRate:           envFloat("CHAOS_ERROR_RATE", 0),
+		EmailEncKey:              os.Getenv("EMAIL_ENC_KEY"),
+		EmailNormalize:           envBool("EMAIL_NORMALIZE", true),
+		SlowQueryThreshold:       time.Duration(envInt("SLOW_QUERY_MS", 500)) * time.Millisecond,
+		NotFoundSuggestions:      envBool("NOT_FOUND_SUGGESTIONS", false),
+		AccessLogSampleRate:      envFloat("ACCESS_LOG_SAMPLE_RATE", 1),
+		AccessLogUserFields:      envBool("ACCESS_LOG_USER_FIELDS", false),
+		BodyLimit:                envString("BODY_LIMIT", "4M"),
+		JSONMaxDepth:             envInt("JSON_MAX_DEPTH", 32),
+		JSONMaxArray:             envInt("JSON_MAX_ARRAY", 10000),
+		MultipartMaxMemory:       int64(envInt("MULTIPART_MAX_MEMORY_KB", 1024)) << 10,
+		CanonicalJSON:            envBool("CANONICAL_JSON", false),
+		MaintenanceStart:         os.Getenv("MAINTENANCE_START"),
+		MaintenanceEnd:           os.Getenv("MAINTENANCE_END"),
+		WebhookURL:               os.Getenv("WEBHOOK_URL"),
+		WebhookSecret:            os.Getenv("WEBHOOK_SECRET"),
+		WebhookQueue:             envInt("WEBHOOK_QUEUE", 100),
+		PanicReportURL:           os.Getenv("PANIC_REPORT_URL"),
+		PanicReportSecret:        os.Getenv("PANIC_REPORT_SECRET"),
+		StreamThreshold:          envInt("STREAM_THRESHOLD", 1000),
+		ConsistentPageCounts:     envBool("CONSISTENT_PAGE_COUNTS", false),
+		ListCacheInterval:        time.Duration(envInt("LIST_CACHE_INTERVAL_S", 0)) * time.Second,
+		PurgeRetention:           time.Duration(envInt("PURGE_RETENTION_DAYS", 0)) * 24 * time.Hour,
+		PurgeInterval:            time.Duration(envInt("PURGE_INTERVAL_S", 3600)) * time.Second,
+		EmptyDatabaseHint:        envBool("EMPTY_DATABASE_HINT", false),
+		ExportChunkSize:          envInt("EXPORT_CHUNK_SIZE", 1000),
+		Gzip:                     envBool("GZIP", false),
+		RootDescriptor:           envBool("ROOT_DESCRIPTOR", true),
+		ServiceName:              envString("SERVICE_NAME", "go-crash-course"),
+		ServiceVersion:           envString("SERVICE_VERSION", "dev"),
+		IdempotencyStore:         envString("IDEMPOTENCY_STORE", "db"),
+		IdempotencyTTL:           time.Duration(envInt("IDEMPOTENCY_TTL_S", 86400)) * time.Second,
+		ShutdownTimeout:          time.Duration(envInt("SHUTDOWN_TIMEOUT_S", 10)) * time.Second,
+		MaxBulkRecords:           envInt("MAX_BULK_RECORDS", 1000),
+	}
+}
+
+// envString は環境変数を読み込みます。未設定の場合は def を返します。
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envBool は環境変数を真偽値として読み込みます。未設定や不正な値の場合は def を返します。
+func envBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envInt は環境変数を整数として読み込みます。未設定や不正な値の場合は def を返します。
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envFloat は環境変数を小数として読み込みます。未設定や不正な値の場合は def を返します。
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envSet はカンマ区切りの環境変数を集合として読み込みます。未設定の場合は def を使います。
+func envSet(key, def string) map[string]bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		v = def
+	}
+	set := map[string]bool{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// routeInfo は登録されているルートの情報です。
+type routeInfo struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Handler string `json:"handler"`
+}
+
+// routesHandler は登録されているルートの一覧を返します。
+// 設定によって有効になるエンドポイントもあるため、起動時ではなくリクエストのたびにルーターから読み込みます。
+func routesHandler(c echo.Context) error {
+	routes := []routeInfo{}
+	for _, r := range c.Echo().Routes() {
+		// グループが内部で登録する404用のルートは除く
+		if r.Method == echo.RouteNotFound {
+			continue
+		}
+		routes = append(routes, routeInfo{Method: r.Method, Path: r.Path, Handler: r.Name})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return c.JSON(http.StatusOK, routes)
+}
+
+// startTime はプロセスの起動時刻です。稼働時間の計算に使います。
+var startTime = time.Now()
+
+// infoHandler はビルド情報と実行時の状態（goroutine数、メモリ使用量、稼働時間）を返します。
+// goroutineやメモリのリークを調べるときに使います。
+func infoHandler(c echo.Context) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	info := map[string]interface{}{
+		"go_version":     runtime.Version(),
+		"num_goroutine":  runtime.NumGoroutine(),
+		"num_cpu":        runtime.NumCPU(),
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+		"memory": map[string]uint64{
+			"alloc":        mem.Alloc,
+			"total_alloc":  mem.TotalAlloc,
+			"sys":          mem.Sys,
+			"heap_inuse":   mem.HeapInuse,
+			"heap_objects": mem.HeapObjects,
+			"num_gc":       uint64(mem.NumGC),
+		},
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		settings := map[string]string{}
+		for _, s := range bi.Settings {
+			settings[s.Key] = s.Value
+		}
+		info["build"] = map[string]interface{}{
+			"path":     bi.Path,
+			"main":     bi.Main.Version,
+			"settings": settings,
+		}
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// rootLinks は GET / の説明に載せるエンドポイントです。登録されていないものは載せません。
+var rootLinks = []struct{ Rel, Path string }{
+	{"users", "/users"},
+	{"healthz", "/healthz"},
+	{"metrics", "/metrics"},
+	{"swagger", "/swagger"},
+}
+
+// rootHandler はサービスの名前、バージョン、主なエンドポイントへのリンクを返します。
+// 初めて使う人がどこから見ればよいかわかるようにするためのものです。
+func rootHandler(name, version string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		registered := map[string]bool{}
+		for _, r := range c.Echo().Routes() {
+			if r.Method == http.MethodGet {
+				registered[r.Path] = true
+			}
+		}
+		links := map[string]string{}
+		for _, l := range rootLinks {
+			if registered[l.Path] {
+				links[l.Rel] = l.Path
+			}
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"name":    name,
+			"version": version,
+			"links":   links,
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestDebugRoutes(t *testing.T) {
+	routesOf := func(t *testing.T, s *server) map[string]bool {
+		t.Helper()
+		rec := request(s, http.MethodGet, "/debug/routes", "", "X-API-Key", "admin-secret")
+		expectStatus(t, rec, http.StatusOK)
+		var routes []routeInfo
+		decode(t, rec, &routes)
+		got := map[string]bool{}
+		for _, r := range routes {
+			if r.Handler == "" {
+				t.Errorf("%s %s has no handler name", r.Method, r.Path)
+			}
+			got[r.Method+" "+r.Path] = true
+		}
+		return got
+	}
+
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys})
+	expectStatus(t, request(s, http.MethodGet, "/debug/routes", "", "X-API-Key", "reader-secret"), http.StatusForbidden)
+	routes := routesOf(t, s)
+	for _, want := range []string{"GET /users", "POST /users", "GET /users/:id", "DELETE /users/:id", "GET /debug/routes", "GET /"} {
+		if !routes[want] {
+			t.Errorf("routes do not contain %s", want)
+		}
+	}
+	for route := range routes {
+		if strings.HasPrefix(route, echo.RouteNotFound) {
+			t.Errorf("routes contain %s", route)
+		}
+	}
+
+	// 設定で無効にしたエンドポイントは一覧に出ない
+	s = newTestServer(t, map[string]string{"API_KEYS": testAPIKeys, "ROOT_DESCRIPTOR": "false"})
+	if routesOf(t, s)["GET /"] {
+		t.Error("routes contain GET / with ROOT_DESCRIPTOR=false")
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys})
+	expectStatus(t, request(s, http.MethodGet, "/debug/info", "", "X-API-Key", "reader-secret"), http.StatusForbidden)
+
+	rec := request(s, http.MethodGet, "/debug/info", "", "X-API-Key", "admin-secret")
+	expectStatus(t, rec, http.StatusOK)
+	var info struct {
+		GoVersion     string            `json:"go_version"`
+		NumGoroutine  int               `json:"num_goroutine"`
+		NumCPU        int               `json:"num_cpu"`
+		UptimeSeconds *int64            `json:"uptime_seconds"`
+		Memory        map[string]uint64 `json:"memory"`
+	}
+	decode(t, rec, &info)
+	if info.GoVersion != runtime.Version() || info.NumGoroutine <= 0 || info.NumCPU <= 0 || info.UptimeSeconds == nil {
+		t.Errorf("info = %s", rec.Body.String())
+	}
+	for _, key := range []string{"alloc", "total_alloc", "sys", "heap_inuse", "heap_objects", "num_gc"} {
+		if _, ok := info.Memory[key]; !ok {
+			t.Errorf("memory does not contain %s", key)
+		}
+	}
+	if info.Memory["sys"] == 0 {
+		t.Errorf("memory.sys = 0")
+	}
+}
+
+func TestRootDescriptor(t *testing.T) {
+	s := newTestServer(t, map[string]string{"SERVICE_NAME": "users-api", "SERVICE_VERSION": "1.2.3"})
+	rec := request(s, http.MethodGet, "/", "")
+	expectStatus(t, rec, http.StatusOK)
+	var root struct {
+		Name    string            `json:"name"`
+		Version string            `json:"version"`
+		Links   map[string]string `json:"links"`
+	}
+	decode(t, rec, &root)
+	if root.Name != "users-api" || root.Version != "1.2.3" {
+		t.Errorf("root = %+v", root)
+	}
+	for _, rel := range []string{"users", "healthz"} {
+		if root.Links[rel] == "" {
+			t.Errorf("links do not contain %s: %v", rel, root.Links)
+		}
+	}
+	// 載せるのは登録されているエンドポイントだけ
+	for rel, path := range root.Links {
+		if rec := request(s, http.MethodGet, path, ""); rec.Code == http.StatusNotFound {
+			t.Errorf("link %s (%s) is not registered", rel, path)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// dumpHandler はデータベース全体をSQL文として出力します。
+// ?compress=gzip を指定すると gzip で圧縮して送ります。
+// 1行ずつ書き出すので、DBが大きくてもメモリ使用量は一定です。
+func dumpHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filename := "dump.sql"
+		compress := false
+		switch c.QueryParam("compress") {
+		case "":
+		case "gzip":
+			compress = true
+			filename += ".gz"
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "compress must be gzip")
+		}
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "application/sql; charset=utf-8")
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+		var w io.Writer = res
+		if compress {
+			res.Header().Set(echo.HeaderContentEncoding, "gzip")
+			gz := gzip.NewWriter(res)
+			defer gz.Close()
+			w = gz
+		}
+		res.WriteHeader(http.StatusOK)
+		markPartialBody(c)
+
+		bw := bufio.NewWriter(w)
+		if err := writeDump(c.Request().Context(), db, bw); err != nil {
+			// ヘッダーは送信済みのため、エラーハンドラが接続を切ります。
+			return err
+		}
+		return bw.Flush()
+	}
+}
+
+// writeDump はテーブル定義、データ、インデックスを w に書き出します。
+// 読み取り専用のトランザクション内で実行するので、出力内容は一貫しています。
+// db は _txlock=deferred で開いたDB（userRepository.snapshotDB）を渡してください。BEGIN IMMEDIATE で開いたDBでは、
+// 書き出している間ずっと書き込みのロックを取ってしまいます。deferred でも、WALモードでなければ他の書き込みのコミットを待たせます。
+func writeDump(ctx context.Context, db *sql.DB, w io.Writer) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fmt.Fprintln(w, "BEGIN TRANSACTION;")
+
+	type object struct{ name, sql string }
+	var tables, indexes []object
+	rows, err := tx.QueryContext(ctx,
+		"SELECT type, name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var typ string
+		var obj object
+		if err := rows.Scan(&typ, &obj.name, &obj.sql); err != nil {
+			rows.Close()
+			return err
+		}
+		if typ == "table" {
+			tables = append(tables, obj)
+		} else {
+			indexes = append(indexes, obj)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		fmt.Fprintf(w, "%s;\n", table.sql)
+		if err := dumpRows(ctx, tx, w, table.name); err != nil {
+			return err
+		}
+	}
+	// AUTOINCREMENTの採番状態も復元できるようにする
+	var hasSequence int
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM sqlite_master WHERE name = 'sqlite_sequence'").Scan(&hasSequence); err != nil {
+		return err
+	}
+	if hasSequence > 0 {
+		fmt.Fprintln(w, "DELETE FROM sqlite_sequence;")
+		if err := dumpRows(ctx, tx, w, "sqlite_sequence"); err != nil {
+			return err
+		}
+	}
+	for _, index := range indexes {
+		fmt.Fprintf(w, "%s;\n", index.sql)
+	}
+
+	_, err = fmt.Fprintln(w, "COMMIT;")
+	return err
+}
+
+// dumpRows はテーブルの全行をINSERT文として書き出します。
+func dumpRows(ctx context.Context, tx *sql.Tx, w io.Writer, table string) error {
+	name := quoteIdent(table)
+	rows, err := tx.QueryContext(ctx, "SELECT * FROM "+name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literals[i] = sqlLiteral(v)
+		}
+		if _, err := fmt.Fprintf(w, "INSERT INTO %s VALUES(%s);\n", name, strings.Join(literals, ",")); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// quoteIdent はテーブル名などの識別子をダブルクォートで囲みます。
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// sqlLiteral は値をSQLのリテラル表現に変換します。
+func sqlLiteral(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		return "X'" + hex.EncodeToString(v) + "'"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	default:
+		return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDump(t *testing.T) {
+	s := newAdminTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	rec := request(s, http.MethodGet, "/admin/dump", "")
+	expectStatus(t, rec, http.StatusOK)
+	plain := rec.Body.String()
+	for _, want := range []string{"BEGIN TRANSACTION;", "CREATE TABLE users", "'Taro'", "COMMIT;"} {
+		if !strings.Contains(plain, want) {
+			t.Errorf("dump does not contain %q", want)
+		}
+	}
+
+	rec = request(s, http.MethodGet, "/admin/dump?compress=gzip", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %q", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unzipped, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unzipped) != plain {
+		t.Errorf("gzip dump differs from the plain dump")
+	}
+
+	expectStatus(t, request(s, http.MethodGet, "/admin/dump?compress=zip", ""), http.StatusBadRequest)
+}
+
+// writeHook は書き込まれた内容に match が含まれたときに1回だけ fn を呼びます。
+type writeHook struct {
+	bytes.Buffer
+	match string
+	fn    func()
+}
+
+func (w *writeHook) Write(b []byte) (int, error) {
+	if w.fn != nil && bytes.Contains(b, []byte(w.match)) {
+		w.fn()
+		w.fn = nil
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestDumpDoesNotBlockWriters(t *testing.T) {
+	s := newTestServer(t, nil)
+	if _, err := s.db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		t.Fatal(err)
+	}
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	// ダンプがユーザーを読み込んでいる途中で、別のユーザーを登録する
+	w := &writeHook{match: "INSERT INTO", fn: func() {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			done <- request(s, http.MethodPost, "/users", `{"name":"Hanako","age":25,"email":"hanako@example.com"}`)
+		}()
+		select {
+		case rec := <-done:
+			expectStatus(t, rec, http.StatusCreated)
+		case <-time.After(2 * time.Second):
+			t.Fatal("write was blocked by the dump")
+		}
+	}}
+	if err := writeDump(context.Background(), s.snapshotDB, w); err != nil {
+		t.Fatal(err)
+	}
+	// ダンプは開始した時点の内容のまま
+	if strings.Contains(w.String(), "Hanako") {
+		t.Errorf("dump contains a user created after it started")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedEmailPrefix は暗号化されたメールアドレスの先頭に付ける印です。
+// これがない値は暗号化を有効にする前に保存された平文として扱います。
+const encryptedEmailPrefix = "enc:"
+
+// emailCipher はメールアドレスをAES-GCMで暗号化してDBに保存するためのものです。
+// nil の場合は暗号化せず、平文のまま保存します。
+//
+// メールアドレスで検索できるよう、nonce はランダムではなく平文のHMACから作ります。
+// 同じメールアドレスは同じ暗号文になるので、一致するかどうかだけは暗号文からわかります。
+// また、暗号化した値の検索は大文字小文字を区別します。
+type emailCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// parseEmailKey は base64 でエンコードされた16・24・32バイトの鍵（AES-128/192/256）から emailCipher を作ります。
+// 鍵が空の場合は nil を返し、暗号化を無効にします。
+func parseEmailKey(s string) (*emailCipher, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("EMAIL_ENC_KEY must be base64: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("EMAIL_ENC_KEY: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 暗号化の鍵をそのまま nonce の計算に使わないよう、用途ごとに鍵を分ける
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("email-nonce"))
+	return &emailCipher{aead: aead, nonceKey: mac.Sum(nil)}, nil
+}
+
+// encrypt はメールアドレスを暗号化します。暗号化が無効の場合や空文字はそのまま返します。
+func (ec *emailCipher) encrypt(email string) string {
+	if ec == nil || email == "" {
+		return email
+	}
+	mac := hmac.New(sha256.New, ec.nonceKey)
+	mac.Write([]byte(email))
+	nonce := mac.Sum(nil)[:ec.aead.NonceSize()]
+	sealed := ec.aead.Seal(nonce, nonce, []byte(email), nil)
+	// hex は大文字小文字を含まないので、COLLATE NOCASE で比較しても別の暗号文と一致しません
+	return encryptedEmailPrefix + hex.EncodeToString(sealed)
+}
+
+// decrypt はDBの値を平文に戻します。暗号化されていない値はそのまま返します。
+func (ec *emailCipher) decrypt(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedEmailPrefix) {
+		return stored, nil
+	}
+	if ec == nil {
+		return "", errors.New("email is encrypted but EMAIL_ENC_KEY is not set")
+	}
+	sealed, err := hex.DecodeString(strings.TrimPrefix(stored, encryptedEmailPrefix))
+	if err != nil || len(sealed) < ec.aead.NonceSize() {
+		return "", errors.New("malformed encrypted email")
+	}
+	n := ec.aead.NonceSize()
+	plain, err := ec.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", errors.New("cannot decrypt email (wrong key?)")
+	}
+	return string(plain), nil
+}
+
+// lookupValues はメールアドレスで検索するときに比較する値を返します。
+// 暗号化が有効な場合も、有効にする前に平文で保存された行に一致するよう平文を含めます。
+func (ec *emailCipher) lookupValues(email string) []interface{} {
+	if ec == nil {
+		return []interface{}{email}
+	}
+	return []interface{}{ec.encrypt(email), email}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var (
+	testEmailKey  = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	otherEmailKey = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+)
+
+func TestEmailCipherRoundTrip(t *testing.T) {
+	ec, err := parseEmailKey(testEmailKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"taro@example.com", "Taro@Example.com", ""} {
+		stored := ec.encrypt(email)
+		if email != "" && (stored == email || !strings.HasPrefix(stored, encryptedEmailPrefix)) {
+			t.Errorf("encrypt(%q) = %q", email, stored)
+		}
+		got, err := ec.decrypt(stored)
+		if err != nil || got != email {
+			t.Errorf("decrypt(encrypt(%q)) = %q, %v", email, got, err)
+		}
+	}
+	// 検索できるよう、同じメールアドレスは同じ暗号文になる
+	if ec.encrypt("taro@example.com") != ec.encrypt("taro@example.com") {
+		t.Error("encrypt is not deterministic")
+	}
+
+	// 暗号化する前の平文はそのまま読める
+	if got, err := ec.decrypt("plain@example.com"); err != nil || got != "plain@example.com" {
+		t.Errorf("decrypt(plaintext) = %q, %v", got, err)
+	}
+	other, err := parseEmailKey(otherEmailKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := ec.encrypt("taro@example.com")
+	for _, tt := range []struct {
+		ec     *emailCipher
+		stored string
+	}{
+		{other, stored},
+		{nil, stored},
+		{ec, encryptedEmailPrefix + "zz"},
+		{ec, encryptedEmailPrefix + "00"},
+	} {
+		if _, err := tt.ec.decrypt(tt.stored); err == nil {
+			t.Errorf("decrypt(%q) succeeded", tt.stored)
+		}
+	}
+
+	for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := parseEmailKey(key); err == nil {
+			t.Errorf("parseEmailKey(%q) succeeded", key)
+		}
+	}
+}
+
+func TestEmailEncryptedAtRest(t *testing.T) {
+	s := newTestServer(t, map[string]string{"EMAIL_ENC_KEY": testEmailKey})
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+
+	var stored string
+	if err := s.db.QueryRow("SELECT email FROM users WHERE id = ?", u.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, encryptedEmailPrefix) {
+		t.Errorf("stored email = %q, want encrypted", stored)
+	}
+	if u.Email != "taro@example.com" {
+		t.Errorf("response email = %q", u.Email)
+	}
+	rec := request(s, http.MethodGet, "/users/by-email/taro@example.com", "")
+	expectStatus(t, rec, http.StatusOK)
+
+	// 復号できない行があっても、一覧は失敗させずにメールアドレスを空にして返す
+	if _, err := s.db.Exec("INSERT INTO users (name, age, email, created_at, updated_at) VALUES ('Broken', 20, ?, '', '')",
+		encryptedEmailPrefix+"00"); err != nil {
+		t.Fatal(err)
+	}
+	rec = request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	var list []User
+	decode(t, rec, &list)
+	if len(list) != 2 || list[0].Email != "taro@example.com" || list[1].Email != "" {
+		t.Errorf("GET /users = %+v", list)
+	}
+}
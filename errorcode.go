@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// errorCode はエラーレスポンスの code に入れる、失敗の種類を表す固定の文字列です。
+// メッセージの文言は変わることがあるため、クライアントはステータスやメッセージではなくこの値で分岐できます。
+type errorCode string
+
+const (
+	codeBadRequest           errorCode = "BAD_REQUEST"
+	codeValidationFailed     errorCode = "VALIDATION_FAILED"
+	codeUnauthorized         errorCode = "UNAUTHORIZED"
+	codeForbidden            errorCode = "FORBIDDEN"
+	codeNotFound             errorCode = "NOT_FOUND"
+	codeUserNotFound         errorCode = "USER_NOT_FOUND"
+	codeMethodNotAllowed     errorCode = "METHOD_NOT_ALLOWED"
+	codeConflict             errorCode = "CONFLICT"
+	codeNameConflict         errorCode = "NAME_CONFLICT"
+	codeAgeMismatch          errorCode = "AGE_MISMATCH"
+	codePreconditionFailed   errorCode = "PRECONDITION_FAILED"
+	codePayloadTooLarge      errorCode = "PAYLOAD_TOO_LARGE"
+	codeUnsupportedMediaType errorCode = "UNSUPPORTED_MEDIA_TYPE"
+	codeRateLimited          errorCode = "RATE_LIMITED"
+	codeRetryBudgetExceeded  errorCode = "RETRY_BUDGET_EXCEEDED"
+	codeInternal             errorCode = "INTERNAL_ERROR"
+	codeServiceUnavailable   errorCode = "SERVICE_UNAVAILABLE"
+	codeReadOnly             errorCode = "READ_ONLY"
+	codeDBUnavailable        errorCode = "DB_UNAVAILABLE"
+)
+
+// statusErrorCodes は code を指定していないエラーに使う、ステータスごとの code です。
+var statusErrorCodes = map[int]errorCode{
+	http.StatusBadRequest:            codeBadRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusConflict:              codeConflict,
+	http.StatusPreconditionFailed:    codePreconditionFailed,
+	http.StatusRequestEntityTooLarge: codePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  codeUnsupportedMediaType,
+	http.StatusUnprocessableEntity:   codeValidationFailed,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusServiceUnavailable:    codeServiceUnavailable,
+}
+
+// codedError は HTTPError の Internal に code を持たせるためのエラーです。元の Internal は err に残します。
+type codedError struct {
+	code errorCode
+	err  error
+}
+
+func (e *codedError) Error() string {
+	if e.err == nil {
+		return string(e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error { return e.err }
+
+// withCode は he に code を設定して返します。
+func withCode(he *echo.HTTPError, code errorCode) *echo.HTTPError {
+	return he.SetInternal(&codedError{code: code, err: he.Internal})
+}
+
+// userNotFound は指定されたユーザーがいない場合の404です。
+func userNotFound() error {
+	return withCode(echo.NewHTTPError(http.StatusNotFound, "Not Found"), codeUserNotFound)
+}
+
+// nameConflict は UNIQUE_NAMES が有効で、同じ名前のユーザーが既にいる場合の409です。
+func nameConflict() error {
+	return withCode(echo.NewHTTPError(http.StatusConflict, "name already exists"), codeNameConflict)
+}
+
+// validationError は入力の検証に失敗した場合のエラーです。
+func validationError(status int, message string) error {
+	return withCode(echo.NewHTTPError(status, message), codeValidationFailed)
+}
+
+// errorCodeOf は he の code を返します。withCode で設定されていない場合はステータスから決めます。
+func errorCodeOf(he *echo.HTTPError) errorCode {
+	var ce *codedError
+	if errors.As(he.Internal, &ce) {
+		return ce.code
+	}
+	if code, ok := statusErrorCodes[he.Code]; ok {
+		return code
+	}
+	if he.Code >= http.StatusInternalServerError {
+		return codeInternal
+	}
+	return codeBadRequest
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/labstack/echo/v4"
+)
+
+// stackError は元のエラーと発生時のスタックトレースを保持します。
+// 開発環境ではエラーレスポンスにスタックトレースを含めるために使います。
+type stackError struct {
+	err   error
+	stack []byte
+}
+
+func (e *stackError) Error() string { return e.err.Error() }
+func (e *stackError) Unwrap() error { return e.err }
+
+// internalError は500エラーを作成します。元のエラーはレスポンスには含めず、Internalに保持します。
+func internalError(err error) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusInternalServerError, "internal server error").
+		SetInternal(&stackError{err: err, stack: debug.Stack()})
+}
+
+// dbError はデータベース操作のエラーをHTTPエラーに変換します。
+// リクエストのタイムアウトでクエリが中断された場合は、再試行を促すため
+// Retry-Afterヘッダー付きの503を返します。それ以外は500を返します。
+func dbError(c echo.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(c.Request().Context().Err(), context.DeadlineExceeded) {
+		setRetryAfter(c, 1)
+		return withCode(echo.NewHTTPError(http.StatusServiceUnavailable, "database timeout").SetInternal(err), codeDBUnavailable)
+	}
+	return internalError(err)
+}
+
+// errorResponse はエラー時に返すJSONです。
+type errorResponse struct {
+	// Code は失敗の種類を表す固定の文字列です（errorcode.go）。
+	Code      errorCode   `json:"code"`
+	Message   interface{} `json:"message"`
+	RequestID string      `json:"request_id,omitempty"`
+	// Error と Stack は開発環境の500エラーでのみ設定されます。
+	Error string `json:"error,omitempty"`
+	Stack string `json:"stack,omitempty"`
+}
+
+// partialBodyKey は、ボディの一部を送信済みであることを示すコンテキストのキーです。
+const partialBodyKey = "partial_body"
+
+// markPartialBody は、ストリーミングのハンドラがボディを書き始めたことを記録します。
+// これ以降のエラーは、newErrorHandler が接続を切って知らせます。
+func markPartialBody(c echo.Context) {
+	c.Set(partialBodyKey, true)
+}
+
+// newErrorHandler はエラーをJSONで返すハンドラを作成します。
+// development がfalse（本番）の場合、500エラーの詳細は隠し、相関用のリクエストIDのみ返します。
+//
+// ストリーミング（一覧やCSVの書き出し）の途中で失敗した場合は、ステータスとボディの一部を送信済みのため、
+// エラーのJSONを書き足すと壊れたレスポンスになります。そのままレスポンスを終えても、クライアントには
+// 途中までのボディが正常に終わったように見えてしまいます。そこでエラーをログに残し、
+// http.ErrAbortHandler で接続を切って、クライアントが不完全なレスポンスだと気付けるようにします。
+// それ以外で送信済みの場合（アクセスログのミドルウェアが c.Error を呼んだ後のエラーなど）は、
+// エラーのレスポンスは返してあるので何もしません。
+func newErrorHandler(development bool) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed {
+			if partial, _ := c.Get(partialBodyKey).(bool); partial {
+				log.Printf("error after response was committed, aborting: request_id=%s %v",
+					c.Response().Header().Get(echo.HeaderXRequestID), err)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+
+		he, ok := err.(*echo.HTTPError)
+		if !ok {
+			he = internalError(err)
+		}
+
+		// 405の場合は、ルーターが求めた利用可能なメソッドをAllowヘッダーで返す
+		if he.Code == http.StatusMethodNotAllowed {
+			if allow, ok := c.Get(echo.ContextKeyHeaderAllow).(string); ok {
+				c.Response().Header().Set(echo.HeaderAllow, allow)
+			}
+		}
+
+		res := errorResponse{
+			Code:      errorCodeOf(he),
+			Message:   he.Message,
+			RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+		}
+		if he.Code == http.StatusInternalServerError {
+			// 内部エラーの詳細はサーバーのログに残す
+			detail := fmt.Sprint(he.Message)
+			if he.Internal != nil {
+				detail = he.Internal.Error()
+			}
+			log.Printf("internal error: request_id=%s %s", res.RequestID, detail)
+
+			res.Message = "internal server error"
+			if development {
+				res.Error = detail
+				var se *stackError
+				if errors.As(he.Internal, &se) {
+					res.Stack = string(se.stack)
+				}
+			}
+		}
+
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(he.Code)
+		} else {
+			err = c.JSON(he.Code, res)
+		}
+		if err != nil {
+			log.Printf("failed to write error response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorResponseWithAccessLogSampling(t *testing.T) {
+	// ACCESS_LOG_SAMPLE_RATE が1未満の場合はアクセスログのミドルウェアがエラーハンドラを先に呼ぶ
+	s := newTestServer(t, map[string]string{"ACCESS_LOG_SAMPLE_RATE": "0.5"})
+
+	rec := request(s, http.MethodGet, "/users/abc", "")
+	expectStatus(t, rec, http.StatusBadRequest)
+	var res errorResponse
+	decode(t, rec, &res)
+	if res.Message != "id must be an integer" {
+		t.Errorf("message = %v", res.Message)
+	}
+	// エラーのJSONは1回だけ書く
+	if n := strings.Count(rec.Body.String(), `"message"`); n != 1 {
+		t.Errorf("body has %d error objects: %s", n, rec.Body.String())
+	}
+}
+
+// cancelOnWrite は最初に書き込まれたときにリクエストのコンテキストを取り消します。
+type cancelOnWrite struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *cancelOnWrite) Write(b []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestStreamingErrorAbortsConnection(t *testing.T) {
+	s := newTestServer(t, map[string]string{"STREAM_THRESHOLD": "1"})
+	insertUsers(t, s, 500)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/users", nil).WithContext(ctx)
+	w := &cancelOnWrite{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("recover() = %v, want http.ErrAbortHandler", p)
+		}
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "[") {
+			t.Errorf("status = %d, body = %.40q", w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), `"message"`) {
+			t.Errorf("error JSON was appended to the stream")
+		}
+	}()
+	s.e.ServeHTTP(w, req)
+	t.Fatal("ServeHTTP returned without aborting")
+}
+
+func TestDatabaseTimeout(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	// 期限の切れたリクエストでは、クエリが context.DeadlineExceeded で中断される
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	for _, path := range []string{"/users", "/users/1"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, req)
+		expectStatus(t, rec, http.StatusServiceUnavailable)
+		if got := rec.Header().Get("Retry-After"); got != "1" {
+			t.Errorf("GET %s: Retry-After = %q", path, got)
+		}
+		var res errorResponse
+		decode(t, rec, &res)
+		if res.Message != "database timeout" || res.Code != codeDBUnavailable {
+			t.Errorf("GET %s: response = %+v", path, res)
+		}
+	}
+
+	// それ以外のDBのエラーは500のまま
+	if _, err := s.db.Exec("DROP TABLE posts"); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/1/posts", ""), http.StatusInternalServerError)
+}
+
+func TestErrorCodes(t *testing.T) {
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys, "UNIQUE_NAMES": "true"})
+	admin := []string{"X-API-Key", "admin-secret"}
+	rec := request(s, http.MethodPost, "/users", `{"name":"Taro","age":30,"email":"taro@example.com"}`, admin...)
+	expectStatus(t, rec, http.StatusCreated)
+
+	tests := []struct {
+		method, path, body string
+		headers            []string
+		status             int
+		code               errorCode
+	}{
+		{http.MethodGet, "/users/99", "", admin, http.StatusNotFound, codeUserNotFound},
+		{http.MethodGet, "/users/abc", "", admin, http.StatusBadRequest, codeBadRequest},
+		{http.MethodGet, "/no-such-route", "", admin, http.StatusNotFound, codeNotFound},
+		{http.MethodPost, "/healthz", "", admin, http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.MethodPost, "/users", `{"name":"","age":30}`, admin, http.StatusBadRequest, codeValidationFailed},
+		{http.MethodPost, "/users", `{"name":"Jiro","age":500}`, admin, http.StatusBadRequest, codeValidationFailed},
+		{http.MethodPost, "/users", `{"name":"Jiro","age":20,"email":"jiro"}`, admin, http.StatusBadRequest, codeValidationFailed},
+		{http.MethodPost, "/users", `{"name":"taro","age":20}`, admin, http.StatusConflict, codeNameConflict},
+		{http.MethodPost, "/users/1/age/cas", `{"expected":31,"new":32}`, admin, http.StatusConflict, codeAgeMismatch},
+		{http.MethodPatch, "/users/1?if_age=31", `{"age":32}`, admin, http.StatusPreconditionFailed, codePreconditionFailed},
+		{http.MethodGet, "/users", "", nil, http.StatusUnauthorized, codeUnauthorized},
+		{http.MethodGet, "/users", "", []string{"X-API-Key", "wrong"}, http.StatusUnauthorized, codeUnauthorized},
+		{http.MethodGet, "/admin/dump", "", []string{"X-API-Key", "reader-secret"}, http.StatusForbidden, codeForbidden},
+		{http.MethodPost, "/users", "name=Jiro", append([]string{"Content-Type", "text/plain"}, admin...), http.StatusUnsupportedMediaType, codeUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		rec := request(s, tt.method, tt.path, tt.body, tt.headers...)
+		expectStatus(t, rec, tt.status)
+		var res errorResponse
+		decode(t, rec, &res)
+		if res.Code != tt.code {
+			t.Errorf("%s %s: code = %q, want %q (%s)", tt.method, tt.path, res.Code, tt.code, res.Message)
+		}
+	}
+}
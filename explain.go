@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// explainKey はコンテキストに explainState を保存するためのキーです。
+type explainKey struct{}
+
+// queryPlan は1つのクエリと、その EXPLAIN QUERY PLAN の結果です。
+type queryPlan struct {
+	Query string   `json:"query"`
+	Plan  []string `json:"plan"`
+	Error string   `json:"error,omitempty"`
+}
+
+// explainState はリクエスト中に実行されようとしたクエリの実行計画を集めます。
+type explainState struct {
+	plans []queryPlan
+}
+
+// explainQuerier はクエリの実行計画を記録する querier です。
+// 後続のクエリまでハンドラの処理が進むよう、読み取りのクエリはそのまま実行します。書き込みは拒否します。
+type explainQuerier struct {
+	q     querier
+	state *explainState
+}
+
+var errExplainWrite = errors.New("writes are not allowed with ?explain=true")
+
+func (e explainQuerier) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return nil, errExplainWrite
+}
+
+func (e explainQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	e.record(ctx, query, args)
+	return e.q.QueryContext(ctx, query, args...)
+}
+
+func (e explainQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	e.record(ctx, query, args)
+	return e.q.QueryRowContext(ctx, query, args...)
+}
+
+func (e explainQuerier) record(ctx context.Context, query string, args []interface{}) {
+	plan := queryPlan{Query: query, Plan: []string{}}
+	rows, err := e.q.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, args...)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var id, parent, notUsed int
+			var detail string
+			if err = rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+				break
+			}
+			plan.Plan = append(plan.Plan, detail)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	if err != nil {
+		plan.Error = err.Error()
+	}
+	e.state.plans = append(e.state.plans, plan)
+}
+
+// discardWriter はハンドラの出力を捨てるための http.ResponseWriter です。
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// explainMiddleware は GET リクエストに ?explain=true が付いている場合、
+// 通常のレスポンスの代わりに、ハンドラが実行したクエリの EXPLAIN QUERY PLAN の結果をJSONで返します。
+// インデックスが使われているかを確認するための開発用の機能です（ENV=development の場合のみ登録します）。
+func explainMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Request().Method != http.MethodGet || c.QueryParam("explain") != "true" {
+			return next(c)
+		}
+		state := &explainState{}
+		req := c.Request()
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), explainKey{}, state)))
+
+		// ハンドラの通常のレスポンスは捨て、集めた実行計画だけを返す
+		res := c.Response()
+		c.SetResponse(echo.NewResponse(&discardWriter{header: http.Header{}}, c.Echo()))
+		next(c)
+		c.SetResponse(res)
+		return c.JSON(http.StatusOK, map[string]interface{}{"queries": state.plans})
+	}
+}
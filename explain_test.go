@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// plansOf は ?explain=true のレスポンスから、users を読み込むクエリの実行計画を返します。
+func plansOf(t *testing.T, s *server, target string) []string {
+	t.Helper()
+	rec := request(s, http.MethodGet, target, "")
+	expectStatus(t, rec, http.StatusOK)
+	var res struct {
+		Queries []queryPlan `json:"queries"`
+	}
+	decode(t, rec, &res)
+	for _, q := range res.Queries {
+		if q.Error != "" {
+			t.Errorf("%s: %s", q.Query, q.Error)
+		}
+		if strings.HasPrefix(q.Query, "SELECT "+userColumns+" FROM users") {
+			return q.Plan
+		}
+	}
+	t.Fatalf("GET %s: no query reads users: %s", target, rec.Body.String())
+	return nil
+}
+
+func TestExplain(t *testing.T) {
+	s := newTestServer(t, map[string]string{"ENV": "development", "NAME_INDEX": "true"})
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"email=taro@example.com", "USING INDEX idx_users_email"},
+		{"name_prefix=Ta", "USING INDEX idx_users_name"},
+		// 部分一致はインデックスを使えない
+		{"name=ar", "SCAN users"},
+	}
+	for _, tt := range tests {
+		plan := strings.Join(plansOf(t, s, "/users?explain=true&"+tt.query), "\n")
+		if !strings.Contains(plan, tt.want) {
+			t.Errorf("plan for ?%s = %q, want %q", tt.query, plan, tt.want)
+		}
+	}
+
+	// GET 以外のリクエストには効かない
+	expectStatus(t, request(s, http.MethodPost, "/users?explain=true", `{"name":"Hanako","age":25,"email":"hanako@example.com"}`), http.StatusCreated)
+	rec := request(s, http.MethodGet, "/users", "")
+	var list []User
+	decode(t, rec, &list)
+	if len(list) != 2 {
+		t.Errorf("GET /users = %+v", list)
+	}
+}
+
+func TestExplainOnlyInDevelopment(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+	rec := request(s, http.MethodGet, "/users?explain=true", "")
+	expectStatus(t, rec, http.StatusOK)
+	var list []User
+	decode(t, rec, &list)
+	if len(list) != 1 {
+		t.Errorf("GET /users?explain=true = %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// csvColumns はCSVに出力できるカラムと、ユーザーから値を取り出す関数です。
+var csvColumns = map[string]func(User) string{
+	"id":         func(u User) string { return strconv.Itoa(u.ID) },
+	"name":       func(u User) string { return u.Name },
+	"age":        func(u User) string { return strconv.Itoa(u.Age) },
+	"email":      func(u User) string { return u.Email },
+	"created_at": func(u User) string { return formatTimestamp(u.CreatedAt) },
+	"updated_at": func(u User) string { return formatTimestamp(u.UpdatedAt) },
+}
+
+// defaultCSVColumns は ?columns= を省略したときに出力するカラムの順番です。
+var defaultCSVColumns = []string{"id", "name", "age", "email", "created_at", "updated_at"}
+
+// csvDelimiters は ?delimiter= に指定できる区切り文字です。
+var csvDelimiters = map[rune]bool{',': true, ';': true, '\t': true, '|': true}
+
+// csvFlushEvery は何行ごとにクライアントへ送信するかです。
+const csvFlushEvery = 100
+
+// exportCSVHandler はユーザー一覧をCSV形式でストリーミングします。
+// ?columns=name,age で出力するカラムとその順番を、?delimiter=; で区切り文字を指定できます。
+// GET /users と同じ条件（?min_age=18 など）で、書き出すユーザーを絞り込めます。
+// DBからは chunkSize 件ずつ読み込みますが、クライアントには1つの続いたCSVとして送ります。
+// masked（MASKED_FIELDS）のフィールドは、JSONのレスポンスと同じように管理者以外には伏せて出力します。
+func exportCSVHandler(repo *userRepository, chunkSize int, masked map[string]bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter, err := parseUserFilter(c)
+		if err != nil {
+			return err
+		}
+		columns := defaultCSVColumns
+		if v := c.QueryParam("columns"); v != "" {
+			columns = strings.Split(v, ",")
+			for _, col := range columns {
+				if _, ok := csvColumns[col]; !ok {
+					return echo.NewHTTPError(http.StatusBadRequest, "unknown column: "+col)
+				}
+			}
+		}
+
+		delimiter := ','
+		if v := c.QueryParam("delimiter"); v != "" {
+			r, size := utf8.DecodeRuneInString(v)
+			if size != len(v) || !csvDelimiters[r] {
+				return echo.NewHTTPError(http.StatusBadRequest, "delimiter must be one of , ; | or tab")
+			}
+			delimiter = r
+		}
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="users.csv"`)
+
+		// 最初の行を読み込めた時点でヘッダーを送信する（クエリ自体の失敗はJSONのエラーで返せる）
+		var w *csv.Writer
+		start := func() error {
+			res.WriteHeader(http.StatusOK)
+			markPartialBody(c)
+			w = csv.NewWriter(res)
+			w.Comma = delimiter
+			return w.Write(columns)
+		}
+
+		masked := maskedFor(c, masked)
+		record := make([]string, len(columns))
+		n := 0
+		err = repo.ForEachChunked(c.Request().Context(), filter, chunkSize, func(user User) error {
+			if w == nil {
+				if err := start(); err != nil {
+					return err
+				}
+			}
+			user = maskUser(user, masked)
+			for i, col := range columns {
+				record[i] = csvColumns[col](user)
+			}
+			if err := w.Write(record); err != nil {
+				return err
+			}
+			// 一定行数ごとに送信して、メモリに溜め込まないようにする
+			n++
+			if n%csvFlushEvery == 0 {
+				w.Flush()
+				res.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			if !res.Committed {
+				return dbError(c, err)
+			}
+			return err
+		}
+		// ユーザーが0件の場合はヘッダー行だけを返す
+		if w == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	}
+}
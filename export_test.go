@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportColumnsAndDelimiter(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+	createUser(t, s, "Hanako", 25, "hanako@example.com")
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"?columns=age,name", "age,name\n30,Taro\n25,Hanako\n"},
+		{"?columns=name&delimiter=%3B", "name\nTaro\nHanako\n"},
+		{"?columns=name,age&delimiter=%3B", "name;age\nTaro;30\nHanako;25\n"},
+		{"?columns=name,age&delimiter=%09", "name\tage\nTaro\t30\nHanako\t25\n"},
+		{"?columns=name,age&delimiter=%7C&min_age=26", "name|age\nTaro|30\n"},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users/export.csv"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("export.csv%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"?columns=name,password", "?columns=name,", "?delimiter=%3B%3B", "?delimiter=x"} {
+		expectStatus(t, request(s, http.MethodGet, "/users/export.csv"+query, ""), http.StatusBadRequest)
+	}
+}
+
+func TestExportChunked(t *testing.T) {
+	// チャンクに分けて読み込んでも、1つの続いたCSVになる
+	s := newTestServer(t, map[string]string{"EXPORT_CHUNK_SIZE": "2"})
+	insertUsers(t, s, 5)
+	rec := request(s, http.MethodGet, "/users/export.csv?columns=name", "")
+	expectStatus(t, rec, http.StatusOK)
+	if want := "name\nuser0\nuser1\nuser2\nuser3\nuser4\n"; rec.Body.String() != want {
+		t.Errorf("export.csv = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+// hookRecorder は最初にボディが書き込まれたときに1回だけ fn を呼ぶ ResponseRecorder です。
+type hookRecorder struct {
+	*httptest.ResponseRecorder
+	fn func()
+}
+
+func (w *hookRecorder) Write(b []byte) (int, error) {
+	if w.fn != nil {
+		w.fn()
+		w.fn = nil
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestExportChunksDoNotBlockWriters(t *testing.T) {
+	s := newTestServer(t, map[string]string{"EXPORT_CHUNK_SIZE": "50"})
+	insertUsers(t, s, 250)
+
+	// 書き出しの途中（最初の送信の時点）で、別のユーザーを登録する
+	w := &hookRecorder{ResponseRecorder: httptest.NewRecorder(), fn: func() {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			done <- request(s, http.MethodPost, "/users", `{"name":"Late","age":30,"email":"late@example.com"}`)
+		}()
+		select {
+		case rec := <-done:
+			expectStatus(t, rec, http.StatusCreated)
+		case <-time.After(2 * time.Second):
+			t.Fatal("write was blocked by the export")
+		}
+	}}
+	s.e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/export.csv?columns=name", nil))
+	expectStatus(t, w.ResponseRecorder, http.StatusOK)
+
+	// まだ読んでいない範囲に追加されたユーザーは、書き出しに含まれる
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 252 || lines[1] != "user0" || lines[251] != "Late" {
+		t.Errorf("export has %d lines, first %q, last %q", len(lines), lines[1], lines[len(lines)-1])
+	}
+}
+
+func TestExportFilteredSubset(t *testing.T) {
+	s := newTestServer(t, nil)
+	for i, age := range []int{15, 18, 30, 17, 65} {
+		createUser(t, s, fmt.Sprintf("user%d", i), age, "")
+	}
+	expectStatus(t, request(s, http.MethodDelete, "/users/3", ""), http.StatusNoContent)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// 成人だけ（削除済みのユーザーは含めない）
+		{"&min_age=18", "name,age\nuser1,18\nuser4,65\n"},
+		{"&max_age=17", "name,age\nuser0,15\nuser3,17\n"},
+		{"&min_age=18&name_prefix=user4", "name,age\nuser4,65\n"},
+		{"&status=deleted", "name,age\nuser2,30\n"},
+		{"&min_age=100", "name,age\n"},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users/export.csv?columns=name,age"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("export.csv%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/export.csv?min_age=abc", ""), http.StatusBadRequest)
+}
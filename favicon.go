@@ -0,0 +1,19 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// favicon はブラウザが自動的にリクエストする /favicon.ico 用のアイコンです。
+// これを返さないと、ブラウザからアクセスするたびに404がログに残ります。
+//
+//go:embed static/favicon.ico
+var favicon []byte
+
+func faviconHandler(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "public, max-age=86400")
+	return c.Blob(http.StatusOK, "image/x-icon", favicon)
+}
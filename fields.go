@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// userFieldNames はレスポンスのユーザーのフィールドです。?fields= と ?exclude= で指定でき、この順番で出力します。
+var userFieldNames = []string{"id", "name", "age", "email", "status", "created_at", "updated_at", "deleted_at", "anonymized_at"}
+
+// fieldSelection はレスポンスに含めるユーザーのフィールドです。
+type fieldSelection struct {
+	// names が nil の場合はすべてのフィールドを含めます。
+	names map[string]bool
+	// birthYear がtrueの場合は、年齢と現在の年から計算した birth_year を追加します（?include=birth_year）。
+	// 誕生日は保存していないため、今年の誕生日を迎えていない人は実際より1年後の年になります（概算です）。
+	birthYear bool
+	now       func() time.Time
+	// attribution がtrueの場合は created_by と updated_by を追加します。管理者のキーで認証したリクエストだけです。
+	attribution bool
+	// masked は一部を伏せて出力するフィールドです（MASKED_FIELDS）。管理者のキーの場合は nil です。
+	masked map[string]bool
+	// schemaVersion がtrueの場合は、各ユーザーに _schema_version（userSchemaVersion）を追加します（SCHEMA_VERSION_IN_BODY）。
+	schemaVersion bool
+}
+
+// responseSelection はクエリパラメータによらない、設定とキーだけで決まるフィールドの選択です。
+// 登録・更新のレスポンスなど、?fields= を受け付けないレスポンスで使います。ユーザーを返すレスポンスは、
+// すべてこれか parseFieldSelection を通すので、伏せるフィールドや追加のフィールドがレスポンスによって変わりません。
+func responseSelection(c echo.Context, cfg config) fieldSelection {
+	s := fieldSelection{masked: maskedFor(c, cfg.MaskedFields), schemaVersion: cfg.SchemaVersionInBody}
+	if key := currentKey(c); key != nil && key.Admin {
+		s.attribution = true
+	}
+	return s
+}
+
+// parseFieldSelection は ?fields=id,name（含めるフィールド）と ?exclude=email（除くフィールド）、
+// ?include=birth_year（計算して追加するフィールド）を読み込みます。fields と exclude の両方に指定されたフィールドは除きます。
+// now は birth_year の計算に使う現在時刻です。
+func parseFieldSelection(c echo.Context, now func() time.Time, cfg config) (fieldSelection, error) {
+	s := responseSelection(c, cfg)
+	s.now = now
+	switch include := c.QueryParam("include"); include {
+	case "":
+	case "birth_year":
+		s.birthYear = true
+	default:
+		return fieldSelection{}, echo.NewHTTPError(http.StatusBadRequest, "unknown include: "+include+" (allowed: birth_year)")
+	}
+	include, err := parseFieldList(c.QueryParam("fields"))
+	if err != nil {
+		return fieldSelection{}, err
+	}
+	exclude, err := parseFieldList(c.QueryParam("exclude"))
+	if err != nil {
+		return fieldSelection{}, err
+	}
+	if include == nil && exclude == nil {
+		return s, nil
+	}
+	s.names = map[string]bool{}
+	for _, name := range userFieldNames {
+		if (include == nil || include[name]) && !exclude[name] {
+			s.names[name] = true
+		}
+	}
+	return s, nil
+}
+
+// maskedFor はリクエストのキーに対して伏せるフィールドを返します。管理者のキーと、認証が無効な場合は nil です。
+func maskedFor(c echo.Context, masked map[string]bool) map[string]bool {
+	if len(masked) == 0 || authDisabled(c) || isAdmin(c) {
+		return nil
+	}
+	return masked
+}
+
+// parseFieldList はカンマ区切りのフィールド名を読み込みます。空文字の場合は nil を返します。
+func parseFieldList(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	known := map[string]bool{}
+	for _, name := range userFieldNames {
+		known[name] = true
+	}
+	set := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				"unknown field: "+name+" (allowed: "+strings.Join(userFieldNames, ", ")+")")
+		}
+		set[name] = true
+	}
+	return set, nil
+}
+
+// user はユーザーを選択されたフィールドだけのJSONにします。何も選択されていない場合はそのまま返します。
+func (s fieldSelection) user(u User) interface{} {
+	u = maskUser(u, s.masked)
+	if s.plain() {
+		return u
+	}
+	p := projectedUser{user: u, fields: s.names, attribution: s.attribution, schemaVersion: s.schemaVersion}
+	if s.birthYear {
+		year := s.now().Year() - u.Age
+		p.birthYear = &year
+	}
+	return p
+}
+
+// plain はフィールドの選択も追加もなく、ユーザーをそのまま出力できるかどうかを返します。
+func (s fieldSelection) plain() bool {
+	return s.names == nil && !s.birthYear && !s.attribution && !s.schemaVersion
+}
+
+// users はユーザーの一覧を選択されたフィールドだけのJSONにします。
+func (s fieldSelection) users(users []User) interface{} {
+	if s.plain() && s.masked == nil {
+		return users
+	}
+	projected := make([]interface{}, len(users))
+	for i, u := range users {
+		projected[i] = s.user(u)
+	}
+	return projected
+}
+
+// maskUser は masked に含まれるフィールド（name、email）を伏せたユーザーを返します。
+// JSON以外の出力（/users.html、CSV）でも、JSONと同じように伏せるために使います。
+func maskUser(u User, masked map[string]bool) User {
+	if masked["name"] {
+		u.Name = maskValue(u.Name)
+	}
+	if masked["email"] {
+		u.Email = maskEmail(u.Email)
+	}
+	return u
+}
+
+// maskValue は先頭の1文字だけを残して "T***" のようにします。空文字はそのまま返します。
+func maskValue(v string) string {
+	for _, r := range v {
+		return string(r) + "***"
+	}
+	return ""
+}
+
+// maskEmail はメールアドレスのローカル部を "b***@example.com" のように伏せます。ドメインはそのまま残します。
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return maskValue(email)
+	}
+	return maskValue(email[:at]) + email[at:]
+}
+
+// projectedUser はユーザーの一部のフィールドを userFieldNames の順番で出力します。fields が nil の場合はすべて出力します。
+// attribution がtrueの場合は created_by と updated_by を、birthYear が nil でない場合は birth_year を、
+// schemaVersion がtrueの場合は最後に _schema_version を追加します。
+type projectedUser struct {
+	user          User
+	fields        map[string]bool
+	attribution   bool
+	birthYear     *int
+	schemaVersion bool
+}
+
+func (p projectedUser) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(p.user)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range userFieldNames {
+		v, ok := values[name]
+		if !ok || (p.fields != nil && !p.fields[name]) {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	if p.attribution {
+		for _, f := range [][2]string{{"created_by", p.user.CreatedBy}, {"updated_by", p.user.UpdatedBy}} {
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(f[0])
+			value, _ := json.Marshal(f[1])
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+	}
+	if p.birthYear != nil {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"birth_year":` + strconv.Itoa(*p.birthYear))
+	}
+	if p.schemaVersion {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"_schema_version":` + strconv.Itoa(userSchemaVersion))
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// testAPIKeys は認証を有効にするテストで使うAPIキーです。
+const testAPIKeys = "reader:reader-secret,ops:admin-secret:admin"
+
+func TestMaskedFields(t *testing.T) {
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys, "MASKED_FIELDS": "name,email"})
+	rec := request(s, http.MethodPost, "/users", `{"name":"Taro","age":30,"email":"taro@example.com"}`, "X-API-Key", "admin-secret")
+	expectStatus(t, rec, http.StatusCreated)
+	var u User
+	decode(t, rec, &u)
+	path := fmt.Sprintf("/users/%d", u.ID)
+
+	tests := []struct {
+		key       string
+		wantName  string
+		wantEmail string
+	}{
+		{"reader-secret", "T***", "t***@example.com"},
+		{"admin-secret", "Taro", "taro@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			rec := request(s, http.MethodGet, path, "", "X-API-Key", tt.key)
+			expectStatus(t, rec, http.StatusOK)
+			var got User
+			decode(t, rec, &got)
+			if got.Name != tt.wantName || got.Email != tt.wantEmail {
+				t.Errorf("GET %s = %q %q", path, got.Name, got.Email)
+			}
+
+			rec = request(s, http.MethodGet, "/users", "", "X-API-Key", tt.key)
+			expectStatus(t, rec, http.StatusOK)
+			var list []User
+			decode(t, rec, &list)
+			if len(list) != 1 || list[0].Name != tt.wantName || list[0].Email != tt.wantEmail {
+				t.Errorf("GET /users = %+v", list)
+			}
+
+			// HTMLとCSVでもJSONと同じように伏せる
+			rec = request(s, http.MethodGet, "/users.html", "", "X-API-Key", tt.key)
+			expectStatus(t, rec, http.StatusOK)
+			row := fmt.Sprintf("<td>%s</td><td>30</td><td>%s</td>", tt.wantName, tt.wantEmail)
+			if !strings.Contains(rec.Body.String(), row) {
+				t.Errorf("users.html does not contain %q:\n%s", row, rec.Body.String())
+			}
+
+			rec = request(s, http.MethodGet, "/users/export.csv?columns=name,email", "", "X-API-Key", tt.key)
+			expectStatus(t, rec, http.StatusOK)
+			if want := "name,email\n" + tt.wantName + "," + tt.wantEmail + "\n"; rec.Body.String() != want {
+				t.Errorf("export.csv = %q, want %q", rec.Body.String(), want)
+			}
+		})
+	}
+}
+
+func TestAttributionFields(t *testing.T) {
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys})
+	type attributed struct {
+		CreatedBy *string `json:"created_by"`
+		UpdatedBy *string `json:"updated_by"`
+	}
+	check := func(t *testing.T, method, path, body, key, wantCreated, wantUpdated string) int {
+		t.Helper()
+		rec := request(s, method, path, body, "X-API-Key", key)
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: status = %d: %s", method, path, rec.Code, rec.Body.String())
+		}
+		var got attributed
+		decode(t, rec, &got)
+		if wantCreated == "" {
+			if got.CreatedBy != nil || got.UpdatedBy != nil {
+				t.Errorf("%s %s with %s: attribution shown to non-admin: %s", method, path, key, rec.Body.String())
+			}
+		} else if got.CreatedBy == nil || *got.CreatedBy != wantCreated || got.UpdatedBy == nil || *got.UpdatedBy != wantUpdated {
+			t.Errorf("%s %s with %s = %s, want created_by %q updated_by %q", method, path, key, rec.Body.String(), wantCreated, wantUpdated)
+		}
+		var u User
+		decode(t, rec, &u)
+		return u.ID
+	}
+
+	// 登録・更新のレスポンスにも、管理者には記録したキーのラベルを含める
+	id := check(t, http.MethodPost, "/users", `{"name":"Taro","age":30,"email":"taro@example.com"}`, "admin-secret", "ops", "ops")
+	path := fmt.Sprintf("/users/%d", id)
+	check(t, http.MethodPut, path, `{"name":"Taro","age":31,"email":"taro@example.com"}`, "reader-secret", "", "")
+	check(t, http.MethodGet, path, "", "admin-secret", "ops", "reader")
+	check(t, http.MethodPatch, path, `{"age":32}`, "admin-secret", "ops", "ops")
+	check(t, http.MethodPost, "/users", `{"name":"Hanako","age":25,"email":"hanako@example.com"}`, "reader-secret", "", "")
+}
+
+func TestFieldsAndExclude(t *testing.T) {
+	s := newTestServer(t, nil)
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+	path := fmt.Sprintf("/users/%d", u.ID)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"?fields=id,name", []string{"id", "name"}},
+		{"?exclude=email,created_at,updated_at", []string{"age", "id", "name", "status"}},
+		// 両方に指定されたフィールドは除く
+		{"?fields=id,name,email&exclude=email", []string{"id", "name"}},
+		{"?fields=name&exclude=name", []string{}},
+		{"?fields=name&include=birth_year", []string{"birth_year", "name"}},
+	}
+	keysOf := func(t *testing.T, raw json.RawMessage) string {
+		t.Helper()
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			t.Fatalf("invalid user JSON %s: %v", raw, err)
+		}
+		keys := []string{}
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return fmt.Sprint(keys)
+	}
+	for _, tt := range tests {
+		want := fmt.Sprint(tt.want)
+		rec := request(s, http.MethodGet, path+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := keysOf(t, rec.Body.Bytes()); got != want {
+			t.Errorf("GET %s%s: keys = %v, want %v", path, tt.query, got, want)
+		}
+
+		// 一覧の各ユーザーにも同じ選択を適用する
+		rec = request(s, http.MethodGet, "/users"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		var list []json.RawMessage
+		decode(t, rec, &list)
+		if len(list) != 1 || keysOf(t, list[0]) != want {
+			t.Errorf("GET /users%s = %s, want keys %v", tt.query, rec.Body.String(), want)
+		}
+	}
+
+	for _, query := range []string{"?fields=password", "?exclude=id,secret", "?include=everything"} {
+		expectStatus(t, request(s, http.MethodGet, path+query, ""), http.StatusBadRequest)
+	}
+}
+
+func TestBirthYear(t *testing.T) {
+	e := echo.New()
+	tests := []struct {
+		now  time.Time
+		age  int
+		want string
+	}{
+		{time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC), 30, `"birth_year":2000`},
+		{time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC), 0, `"birth_year":2030`},
+		// 年が変わると、同じ年齢でも1つ後の年になる
+		{time.Date(2030, 12, 31, 23, 59, 59, 0, time.UTC), 30, `"birth_year":2000`},
+		{time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC), 30, `"birth_year":2001`},
+	}
+	for _, tt := range tests {
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/users/1?include=birth_year", nil), httptest.NewRecorder())
+		fields, err := parseFieldSelection(c, func() time.Time { return tt.now }, config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := User{ID: 1, Name: "Taro", Age: tt.age}
+		for _, v := range []interface{}{fields.user(u), fields.users([]User{u})} {
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), tt.want) {
+				t.Errorf("now %v, age %d: %s does not contain %s", tt.now, tt.age, b, tt.want)
+			}
+		}
+	}
+
+	// 指定しない場合は birth_year を含めない
+	s := newTestServer(t, nil)
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+	rec := request(s, http.MethodGet, fmt.Sprintf("/users/%d", u.ID), "")
+	expectStatus(t, rec, http.StatusOK)
+	if strings.Contains(rec.Body.String(), "birth_year") {
+		t.Errorf("GET without include = %s", rec.Body.String())
+	}
+}
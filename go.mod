@@ -11,7 +11,7 @@ require (
 
 require (
 	github.com/labstack/echo/v4 v4.11.3
-	github.com/labstack/gommon v0.4.1 // indirect
+	github.com/labstack/gommon v0.4.1
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
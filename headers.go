@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// コンテキストに保存する、レスポンスヘッダーの値のキーです。
+const (
+	rateLimitHeadersKey = "rate_limit_headers"
+	retryAfterKey       = "retry_after"
+)
+
+// rateLimitHeaders はレスポンスに付けるレート制限の情報です。
+type rateLimitHeaders struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	// Warning が空でない場合、X-RateLimit-Warning として付けます。
+	Warning string
+}
+
+// setRateLimitHeaders はレート制限の情報を記録します。ヘッダーは standardHeaders がまとめて付けます。
+func setRateLimitHeaders(c echo.Context, h rateLimitHeaders) {
+	c.Set(rateLimitHeadersKey, h)
+}
+
+// setRetryAfter は、エラーのレスポンスで再試行までの秒数として Retry-After に付ける値を記録します。
+func setRetryAfter(c echo.Context, seconds int) {
+	c.Set(retryAfterKey, seconds)
+}
+
+// standardHeaders はすべてのレスポンスに共通のヘッダーを付けるミドルウェアです。
+//   - X-Request-Id: リクエストID
+//   - X-Server-Time: レスポンスを返した時刻（UTC）
+//   - X-Api-Version: レスポンスのユーザーの形のバージョン（userSchemaVersion）
+//   - X-RateLimit-Limit / -Remaining / -Reset（/ -Warning）: レート制限が有効な場合
+//   - Retry-After: 4xx/5xx のうち、再試行までの時間がわかる場合
+//
+// ヘッダーはレスポンスの書き込み直前に付けるので、エラーハンドラが返すレスポンスにも付きます。
+func standardHeaders(now func() time.Time) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			res.Before(func() {
+				h := res.Header()
+				if h.Get(echo.HeaderXRequestID) == "" {
+					if id := c.Request().Header.Get(echo.HeaderXRequestID); id != "" {
+						h.Set(echo.HeaderXRequestID, id)
+					}
+				}
+				h.Set("X-Server-Time", formatTimestamp(now()))
+				h.Set("X-Api-Version", strconv.Itoa(userSchemaVersion))
+				if rl, ok := c.Get(rateLimitHeadersKey).(rateLimitHeaders); ok {
+					h.Set("X-RateLimit-Limit", strconv.Itoa(rl.Limit))
+					h.Set("X-RateLimit-Remaining", strconv.Itoa(rl.Remaining))
+					h.Set("X-RateLimit-Reset", strconv.FormatInt(rl.Reset.Unix(), 10))
+					if rl.Warning != "" {
+						h.Set("X-RateLimit-Warning", rl.Warning)
+					}
+				}
+				if seconds, ok := c.Get(retryAfterKey).(int); ok && res.Status >= http.StatusBadRequest {
+					h.Set("Retry-After", strconv.Itoa(seconds))
+				}
+			})
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAPIVersionHeader(t *testing.T) {
+	s := newTestServer(t, nil)
+	want := strconv.Itoa(userSchemaVersion)
+	for _, path := range []string{"/users", "/users/1", "/users/abc", "/healthz"} {
+		rec := request(s, http.MethodGet, path, "")
+		if got := rec.Header().Get("X-Api-Version"); got != want {
+			t.Errorf("GET %s: X-Api-Version = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// schemaVersionOf はユーザーのJSONの _schema_version を返します。ない場合は0です。
+func schemaVersionOf(t *testing.T, raw json.RawMessage) int {
+	t.Helper()
+	var v struct {
+		SchemaVersion int `json:"_schema_version"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		t.Fatalf("invalid user JSON %s: %v", raw, err)
+	}
+	return v.SchemaVersion
+}
+
+func TestSchemaVersionInBody(t *testing.T) {
+	s := newTestServer(t, map[string]string{"SCHEMA_VERSION_IN_BODY": "true"})
+	a := createUser(t, s, "Taro", 30, "taro@example.com")
+	b := createUser(t, s, "Hanako", 25, "hanako@example.com")
+	pathA := fmt.Sprintf("/users/%d", a.ID)
+
+	// ユーザーを1件返すレスポンスは、読み取りでも書き込みでも同じ形にする
+	single := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/users", `{"name":"Jiro","age":20,"email":"jiro@example.com"}`},
+		{http.MethodGet, pathA, ""},
+		{http.MethodPut, pathA, `{"name":"Taro","age":31,"email":"taro@example.com"}`},
+		{http.MethodPatch, pathA, `{"age":32}`},
+		{http.MethodPost, pathA + "/age/cas", `{"expected":32,"new":33}`},
+		{http.MethodPost, pathA + "/status", `{"status":"suspended"}`},
+		{http.MethodPost, "/users/merge", fmt.Sprintf(`{"keep":%d,"remove":%d}`, a.ID, b.ID)},
+	}
+	for _, tt := range single {
+		rec := request(s, tt.method, tt.path, tt.body)
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: status = %d: %s", tt.method, tt.path, rec.Code, rec.Body.String())
+		}
+		if v := schemaVersionOf(t, rec.Body.Bytes()); v != userSchemaVersion {
+			t.Errorf("%s %s: _schema_version = %d: %s", tt.method, tt.path, v, rec.Body.String())
+		}
+	}
+
+	rec := request(s, http.MethodGet, fmt.Sprintf("/users/batch?ids=%d", a.ID), "")
+	expectStatus(t, rec, http.StatusOK)
+	var batch struct {
+		Found []json.RawMessage `json:"found"`
+	}
+	decode(t, rec, &batch)
+	if len(batch.Found) != 1 || schemaVersionOf(t, batch.Found[0]) != userSchemaVersion {
+		t.Errorf("GET /users/batch = %s", rec.Body.String())
+	}
+
+	rec = request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	var list []json.RawMessage
+	decode(t, rec, &list)
+	for _, raw := range list {
+		if schemaVersionOf(t, raw) != userSchemaVersion {
+			t.Errorf("GET /users = %s", rec.Body.String())
+		}
+	}
+}
+
+func TestListIfModifiedSince(t *testing.T) {
+	s := newTestServer(t, nil)
+	updated := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := s.db.Exec("INSERT INTO users (name, age, email, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		"Taro", 30, "taro@example.com", updated.Format(timestampFormat), updated.Format(timestampFormat)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	lastModified := rec.Header().Get("Last-Modified")
+	if want := updated.Format(http.TimeFormat); lastModified != want {
+		t.Fatalf("Last-Modified = %q, want %q", lastModified, want)
+	}
+
+	tests := []struct {
+		since time.Time
+		want  int
+	}{
+		{updated, http.StatusNotModified},
+		{updated.Add(time.Hour), http.StatusNotModified},
+		{updated.Add(-time.Second), http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users", "", "If-Modified-Since", tt.since.Format(http.TimeFormat))
+		expectStatus(t, rec, tt.want)
+		if tt.want == http.StatusNotModified && rec.Body.Len() != 0 {
+			t.Errorf("304 has a body: %q", rec.Body.String())
+		}
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users", "", "If-Modified-Since", "yesterday"), http.StatusOK)
+
+	// 削除も一覧の変更として扱う
+	expectStatus(t, request(s, http.MethodDelete, "/users/1", ""), http.StatusNoContent)
+	rec = request(s, http.MethodGet, "/users", "", "If-Modified-Since", lastModified)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("Last-Modified") == lastModified {
+		t.Errorf("Last-Modified did not change after a delete")
+	}
+
+	// 絞り込みに一致するユーザーがいない場合は Last-Modified を返さない
+	rec = request(s, http.MethodGet, "/users?min_age=100", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("Last-Modified"); got != "" {
+		t.Errorf("Last-Modified for an empty result = %q", got)
+	}
+}
+
+func TestStandardHeaders(t *testing.T) {
+	s := newTestServer(t, map[string]string{"RATE_LIMIT": "100"})
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/users", http.StatusOK},
+		{http.MethodGet, "/users/abc", http.StatusBadRequest},
+		{http.MethodGet, "/no-such-route", http.StatusNotFound},
+		{http.MethodPost, "/healthz", http.StatusMethodNotAllowed},
+		{http.MethodOptions, "/users", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		rec := request(s, tt.method, tt.path, "")
+		expectStatus(t, rec, tt.want)
+		h := rec.Header()
+		for _, name := range []string{"X-Request-Id", "X-Api-Version", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"} {
+			if h.Get(name) == "" {
+				t.Errorf("%s %s: %s is missing", tt.method, tt.path, name)
+			}
+		}
+		if _, err := time.Parse(timestampFormat, h.Get("X-Server-Time")); err != nil {
+			t.Errorf("%s %s: X-Server-Time = %q", tt.method, tt.path, h.Get("X-Server-Time"))
+		}
+		// 再試行までの時間がわからないエラーには Retry-After を付けない
+		if got := h.Get("Retry-After"); got != "" {
+			t.Errorf("%s %s: Retry-After = %q", tt.method, tt.path, got)
+		}
+	}
+
+	// クライアントが送ったリクエストIDはそのまま返す
+	rec := request(s, http.MethodGet, "/users", "", "X-Request-Id", "client-id-1")
+	if got := rec.Header().Get("X-Request-Id"); got != "client-id-1" {
+		t.Errorf("X-Request-Id = %q", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+//go:embed templates/users.html
+var templateFS embed.FS
+
+// usersTemplate はユーザー一覧のHTMLテンプレートです。
+// html/template が値を自動でエスケープするので、名前にHTMLが含まれていても表示されるだけで実行されません。
+var usersTemplate = template.Must(template.ParseFS(templateFS, "templates/users.html"))
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// parsePage は ?limit= と ?offset= を読み込みます。limit は maxPageLimit が上限です。
+func parsePage(c echo.Context) (limit, offset int, err error) {
+	limit, offset = defaultPageLimit, 0
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return 0, 0, echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+	if v := c.QueryParam("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, echo.NewHTTPError(http.StatusBadRequest, "offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// pageURL は limit と offset を指定したページのURLを返します。
+func pageURL(path string, limit, offset int) string {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("offset", strconv.Itoa(offset))
+	return path + "?" + q.Encode()
+}
+
+// usersHTMLHandler はユーザー一覧の現在のページをHTMLの表で返します。JavaScriptなしで閲覧できます。
+// masked（MASKED_FIELDS）のフィールドは、JSONのレスポンスと同じように管理者以外には伏せて表示します。
+func usersHTMLHandler(repo *userRepository, masked map[string]bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit, offset, err := parsePage(c)
+		if err != nil {
+			return err
+		}
+
+		// 次のページがあるか判定するため、1件多く取得する
+		users, err := repo.List(c.Request().Context(), userFilter{}, userSort{}, limit+1, offset)
+		if err != nil {
+			return dbError(c, err)
+		}
+		masked := maskedFor(c, masked)
+		for i := range users {
+			users[i] = maskUser(users[i], masked)
+		}
+
+		data := struct {
+			Users            []User
+			PrevURL, NextURL string
+		}{Users: users}
+		if len(users) > limit {
+			data.Users = users[:limit]
+			data.NextURL = pageURL(c.Path(), limit, offset+limit)
+		}
+		if offset > 0 {
+			prev := offset - limit
+			if prev < 0 {
+				prev = 0
+			}
+			data.PrevURL = pageURL(c.Path(), limit, prev)
+		}
+
+		// テンプレートの実行に失敗した場合に途中までのHTMLを返さないよう、先にバッファに書き出す
+		var buf bytes.Buffer
+		if err := usersTemplate.Execute(&buf, data); err != nil {
+			return err
+		}
+		return c.HTMLBlob(http.StatusOK, buf.Bytes())
+	}
+}
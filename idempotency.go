@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// idempotencyKeyHeader はクライアントが再送しても二重に処理されないようにするためのヘッダーです。
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentResponse は Idempotency-Key 付きのリクエストに対して保存したレスポンスです。
+type idempotentResponse struct {
+	// Fingerprint はリクエスト（メソッド、パス、ボディ）のハッシュです。同じキーで別のリクエストが来たことの検出に使います。
+	Fingerprint string
+	Status      int
+	ContentType string
+	// Location は作成したリソースのURLです（Location ヘッダー）。再送されたリクエストにも同じヘッダーを返します。
+	Location  string
+	Body      []byte
+	ExpiresAt time.Time
+}
+
+// idempotencyStore は保存したレスポンスの置き場所です。
+// IDEMPOTENCY_STORE=db（既定値）はSQLiteに保存して再起動後も残し、memory はメモリに保存します（再起動で消えます）。
+type idempotencyStore interface {
+	// Get は期限内のレスポンスを返します。ない場合は nil を返します。
+	Get(ctx context.Context, key string) (*idempotentResponse, error)
+	Put(ctx context.Context, key string, res idempotentResponse) error
+	// Sweep は期限切れのレスポンスを削除します。
+	Sweep(ctx context.Context, now time.Time) error
+}
+
+// newIdempotencyStore は kind に応じた保存先を作成し、期限切れのレスポンスを定期的に削除するワーカーを起動します。
+func newIdempotencyStore(kind string, db *sql.DB, workers *workerGroup) (idempotencyStore, error) {
+	var store idempotencyStore
+	switch kind {
+	case "db":
+		store = &dbIdempotencyStore{db: db, now: time.Now}
+	case "memory":
+		store = &memoryIdempotencyStore{entries: map[string]idempotentResponse{}, now: time.Now}
+	default:
+		return nil, fmt.Errorf("IDEMPOTENCY_STORE must be db or memory: %q", kind)
+	}
+	workers.Go("idempotency sweep", func(ctx context.Context) {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.Sweep(ctx, time.Now()); err != nil {
+					log.Printf("idempotency: failed to sweep expired keys: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	return store, nil
+}
+
+// memoryIdempotencyStore はレスポンスをメモリに保存します。
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]idempotentResponse
+	now     func() time.Time
+}
+
+func (s *memoryIdempotencyStore) Get(ctx context.Context, key string) (*idempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.entries[key]
+	// 削除される前でも、期限切れのものは使わない
+	if !ok || !s.now().Before(res.ExpiresAt) {
+		return nil, nil
+	}
+	return &res, nil
+}
+
+func (s *memoryIdempotencyStore) Put(ctx context.Context, key string, res idempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = res
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Sweep(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, res := range s.entries {
+		if !now.Before(res.ExpiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+// dbIdempotencyStore はレスポンスを idempotency_keys テーブルに保存します。
+type dbIdempotencyStore struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func (s *dbIdempotencyStore) Get(ctx context.Context, key string) (*idempotentResponse, error) {
+	var res idempotentResponse
+	var expiresAt string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT fingerprint, status, content_type, location, body, expires_at FROM idempotency_keys WHERE key = ? AND expires_at > ?",
+		key, formatTimestamp(s.now())).Scan(&res.Fingerprint, &res.Status, &res.ContentType, &res.Location, &res.Body, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.ExpiresAt, _ = time.Parse(timestampFormat, expiresAt)
+	return &res, nil
+}
+
+func (s *dbIdempotencyStore) Put(ctx context.Context, key string, res idempotentResponse) error {
+	// 期限切れで残っている同じキーは上書きする
+	_, err := s.db.ExecContext(ctx,
+		"INSERT OR REPLACE INTO idempotency_keys(key, fingerprint, status, content_type, location, body, expires_at) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		key, res.Fingerprint, res.Status, res.ContentType, res.Location, res.Body, formatTimestamp(res.ExpiresAt))
+	return err
+}
+
+func (s *dbIdempotencyStore) Sweep(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= ?", formatTimestamp(now))
+	return err
+}
+
+// capturingWriter はクライアントに送るレスポンスのボディを記録します。
+type capturingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *capturingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idempotencyMiddleware は Idempotency-Key ヘッダー付きの POST/PATCH リクエストのレスポンスを ttl の間保存し、
+// 同じキーで再送されたリクエストには処理をせずに保存したレスポンスを返します（Idempotent-Replayed: true）。
+//   - キーはクライアント（APIキーまたはIPアドレス）ごとに区別します。
+//   - 同じキーで別の内容のリクエストが来た場合は422を返します。
+//   - 同じキーのリクエストがまだ処理中の場合は409を返します。
+//   - 5xx のレスポンスは保存しないので、再送すると改めて処理します。
+func idempotencyMiddleware(store idempotencyStore, ttl time.Duration) echo.MiddlewareFunc {
+	var mu sync.Mutex
+	inFlight := map[string]bool{}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			idemKey := req.Header.Get(idempotencyKeyHeader)
+			if idemKey == "" || (req.Method != http.MethodPost && req.Method != http.MethodPatch) {
+				return next(c)
+			}
+			key := rateLimitClient(c) + " " + idemKey
+
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return err
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256([]byte(req.Method + " " + req.URL.RequestURI() + "\n" + string(body)))
+			fingerprint := hex.EncodeToString(sum[:])
+
+			mu.Lock()
+			if inFlight[key] {
+				mu.Unlock()
+				return echo.NewHTTPError(http.StatusConflict, "a request with this Idempotency-Key is in progress")
+			}
+			inFlight[key] = true
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				delete(inFlight, key)
+				mu.Unlock()
+			}()
+
+			saved, err := store.Get(req.Context(), key)
+			if err != nil {
+				return dbError(c, err)
+			}
+			if saved != nil {
+				if saved.Fingerprint != fingerprint {
+					return echo.NewHTTPError(http.StatusUnprocessableEntity,
+						"Idempotency-Key was already used for a different request")
+				}
+				c.Response().Header().Set("Idempotent-Replayed", "true")
+				if saved.Location != "" {
+					c.Response().Header().Set(echo.HeaderLocation, saved.Location)
+				}
+				return c.Blob(saved.Status, saved.ContentType, saved.Body)
+			}
+
+			res := c.Response()
+			cw := &capturingWriter{ResponseWriter: res.Writer}
+			res.Writer = cw
+			err = next(c)
+			// エラーはここでレスポンスにして、その内容も保存する
+			if err != nil {
+				c.Error(err)
+			}
+			res.Writer = cw.ResponseWriter
+			if res.Committed && res.Status < http.StatusInternalServerError {
+				saved := idempotentResponse{
+					Fingerprint: fingerprint,
+					Status:      res.Status,
+					ContentType: res.Header().Get(echo.HeaderContentType),
+					Location:    res.Header().Get(echo.HeaderLocation),
+					Body:        cw.body.Bytes(),
+					ExpiresAt:   time.Now().Add(ttl),
+				}
+				// リクエストがタイムアウトしていても保存できるよう、リクエストのコンテキストは使わない
+				if err := store.Put(context.Background(), key, saved); err != nil {
+					log.Printf("idempotency: failed to save response: %v", err)
+				}
+			}
+			return nil
+		}
+	}
+}
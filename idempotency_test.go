@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStoreTTL(t *testing.T) {
+	for _, kind := range []string{"db", "memory"} {
+		t.Run(kind, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			store, err := newIdempotencyStore(kind, s.db, s.workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			switch st := store.(type) {
+			case *dbIdempotencyStore:
+				st.now = func() time.Time { return now }
+			case *memoryIdempotencyStore:
+				st.now = func() time.Time { return now }
+			}
+			ctx := context.Background()
+			if err := store.Put(ctx, "k1", idempotentResponse{Fingerprint: "f", Status: 201, ContentType: "application/json",
+				Body: []byte(`{"id":1}`), ExpiresAt: now.Add(time.Minute)}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.Get(ctx, "k1")
+			if err != nil || got == nil || got.Status != 201 || string(got.Body) != `{"id":1}` || got.Fingerprint != "f" {
+				t.Fatalf("Get before expiry = %+v, %v", got, err)
+			}
+			if got, err := store.Get(ctx, "k2"); got != nil || err != nil {
+				t.Errorf("Get unknown key = %+v, %v", got, err)
+			}
+
+			// 削除される前でも、期限切れのものは返さない
+			now = now.Add(time.Minute)
+			if got, err := store.Get(ctx, "k1"); got != nil || err != nil {
+				t.Errorf("Get after expiry = %+v, %v", got, err)
+			}
+			if err := store.Sweep(ctx, now); err != nil {
+				t.Fatal(err)
+			}
+			switch st := store.(type) {
+			case *dbIdempotencyStore:
+				var n int
+				if err := s.db.QueryRow("SELECT COUNT(*) FROM idempotency_keys").Scan(&n); err != nil {
+					t.Fatal(err)
+				}
+				if n != 0 {
+					t.Errorf("%d keys left after sweep", n)
+				}
+			case *memoryIdempotencyStore:
+				if len(st.entries) != 0 {
+					t.Errorf("%d keys left after sweep", len(st.entries))
+				}
+			}
+		})
+	}
+	if _, err := newIdempotencyStore("redis", nil, nil); err == nil {
+		t.Error("unknown store kind was accepted")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	for _, kind := range []string{"db", "memory"} {
+		t.Run(kind, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"IDEMPOTENCY_STORE": kind})
+			body := `{"name":"Taro","age":30,"email":"taro@example.com"}`
+			first := request(s, http.MethodPost, "/users", body, "Idempotency-Key", "abc")
+			expectStatus(t, first, http.StatusCreated)
+
+			// 再送には処理をせずに同じレスポンスを返す
+			again := request(s, http.MethodPost, "/users", body, "Idempotency-Key", "abc")
+			expectStatus(t, again, http.StatusCreated)
+			if again.Header().Get("Idempotent-Replayed") != "true" || again.Body.String() != first.Body.String() {
+				t.Errorf("replay = %s %v", again.Body.String(), again.Header())
+			}
+			rec := request(s, http.MethodGet, "/users", "")
+			var list []User
+			decode(t, rec, &list)
+			if len(list) != 1 {
+				t.Errorf("%d users after a replay", len(list))
+			}
+
+			expectStatus(t, request(s, http.MethodPost, "/users", `{"name":"Hanako","age":25}`, "Idempotency-Key", "abc"),
+				http.StatusUnprocessableEntity)
+		})
+	}
+}
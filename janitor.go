@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// startJanitor は retention より前に論理削除されたユーザーを、interval ごとに物理削除するワーカーを起動します。
+// 論理削除から retention の間は行が残るので、その間ならDBから復元できます。
+// 削除中にシャットダウンが始まった場合は、ctx のキャンセルでクエリを打ち切って終了します。
+func startJanitor(repo *userRepository, retention, interval time.Duration, workers *workerGroup) {
+	workers.Go("janitor", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			before := repo.now().Add(-retention)
+			purged, err := repo.PurgeDeleted(ctx, before)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				log.Printf("janitor: failed to purge deleted users: %v", err)
+			default:
+				log.Printf("janitor: purged %d users deleted before %s", purged, formatTimestamp(before))
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ageDeletedAt はユーザーの deleted_at を、現在時刻から age だけ前に書き換えます。
+func ageDeletedAt(t *testing.T, s *server, id int, age time.Duration) {
+	t.Helper()
+	if _, err := s.db.Exec("UPDATE users SET deleted_at = ? WHERE id = ?", formatTimestamp(time.Now().Add(-age)), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	s := newTestServer(t, nil)
+	for i := 1; i <= 3; i++ {
+		createUser(t, s, fmt.Sprintf("user%d", i), 20, "")
+	}
+	createPost(t, s, 1, "first")
+	for _, id := range []int{1, 2} {
+		expectStatus(t, request(s, http.MethodDelete, fmt.Sprintf("/users/%d", id), ""), http.StatusNoContent)
+	}
+	ageDeletedAt(t, s, 1, 40*24*time.Hour)
+	ageDeletedAt(t, s, 2, 10*24*time.Hour)
+
+	// 保持期間を過ぎた論理削除だけを物理削除し、まだ期間内のものと削除していないものは残す
+	repo := newUserRepository(s.db)
+	purged, err := repo.PurgeDeleted(context.Background(), time.Now().Add(-30*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("purged = %d, want 1", purged)
+	}
+	for id, want := range map[int]bool{1: false, 2: true, 3: true} {
+		_, err := repo.GetIncludingDeleted(context.Background(), id)
+		if exists := !errors.Is(err, sql.ErrNoRows); exists != want {
+			t.Errorf("user %d exists = %v, want %v (err %v)", id, exists, want, err)
+		}
+	}
+	var posts int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = 1").Scan(&posts); err != nil {
+		t.Fatal(err)
+	}
+	if posts != 0 {
+		t.Errorf("%d posts of the purged user remain", posts)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "")
+	expectStatus(t, request(s, http.MethodDelete, "/users/1", ""), http.StatusNoContent)
+	ageDeletedAt(t, s, 1, 40*24*time.Hour)
+
+	workers := newWorkerGroup()
+	startJanitor(newUserRepository(s.db), 30*24*time.Hour, 10*time.Millisecond, workers)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var n int
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor did not purge the aged user")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// シャットダウンが始まったら、次の実行を待たずに終了する
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := workers.Shutdown(ctx); err != nil {
+		t.Errorf("janitor did not stop: %v", err)
+	}
+
+	t.Setenv("PURGE_RETENTION_DAYS", "30")
+	t.Setenv("PURGE_INTERVAL_S", "0")
+	if _, err := newServer(loadConfig(), filepath.Join(t.TempDir(), "test.db")); err == nil {
+		t.Error("newServer accepted PURGE_INTERVAL_S=0")
+	}
+}
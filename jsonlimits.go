@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// errJSONLimit はJSONの入れ子が深すぎるか、配列の要素が多すぎる場合のエラーです。
+var errJSONLimit = errors.New("json limit exceeded")
+
+// checkJSONLimits はJSONをトークンごとに読み、入れ子の深さが maxDepth を、
+// 1つの配列の要素数が maxArray を超えたら400を返します。0の場合はその制限をしません。
+// 値を組み立てずに数えるだけなので、深く入れ子になったボディでも再帰やメモリの消費はありません。
+// JSONとして正しくない場合はここではエラーにせず、ハンドラのデコードにエラーメッセージを任せます。
+func checkJSONLimits(r io.Reader, maxDepth, maxArray int) error {
+	dec := json.NewDecoder(r)
+	// 開いている配列ごとの要素数。オブジェクトの場合は -1
+	var counts []int
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				// BodyLimit を超えた場合の413
+				return he
+			}
+			return nil
+		}
+		// 配列の直下の要素を1つ数える（閉じ括弧は要素ではない）
+		if n := len(counts); n > 0 && counts[n-1] >= 0 && tok != json.Delim(']') {
+			counts[n-1]++
+			if maxArray > 0 && counts[n-1] > maxArray {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					fmt.Sprintf("JSON array has more than %d elements", maxArray)).SetInternal(errJSONLimit)
+			}
+		}
+		switch tok {
+		case json.Delim('['), json.Delim('{'):
+			if maxDepth > 0 && len(counts) >= maxDepth {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					fmt.Sprintf("JSON is nested more than %d levels deep", maxDepth)).SetInternal(errJSONLimit)
+			}
+			if tok == json.Delim('[') {
+				counts = append(counts, 0)
+			} else {
+				counts = append(counts, -1)
+			}
+		case json.Delim(']'), json.Delim('}'):
+			counts = counts[:len(counts)-1]
+		}
+	}
+}
+
+// jsonLimitsMiddleware はJSONのリクエストボディを checkJSONLimits で検査してから、ハンドラに渡します。
+// 検査のために読んだボディは、ハンドラがもう一度読めるように戻しておきます（大きさは BodyLimit までです）。
+func jsonLimitsMiddleware(maxDepth, maxArray int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			mediaType, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+			if !hasBody(c) || mediaType != echo.MIMEApplicationJSON || (maxDepth <= 0 && maxArray <= 0) {
+				return next(c)
+			}
+			var buf bytes.Buffer
+			err := checkJSONLimits(io.TeeReader(req.Body, &buf), maxDepth, maxArray)
+			if err != nil {
+				return err
+			}
+			// 構文エラーで途中まで読んだ場合に備えて、残りもつなげて戻す
+			req.Body = io.NopCloser(io.MultiReader(&buf, req.Body))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJSONLimits(t *testing.T) {
+	s := newAdminTestServer(t, map[string]string{"JSON_MAX_DEPTH": "4", "JSON_MAX_ARRAY": "3"})
+	createUser(t, s, "Taro", 30, "taro@example.com")
+	deep := `{"name":"Taro","extra":` + strings.Repeat("[", 10) + strings.Repeat("]", 10) + `}`
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/users", `{"name":"Jiro","age":20,"email":"jiro@example.com","extra":[[1]]}`, http.StatusCreated},
+		{http.MethodPost, "/users", deep, http.StatusBadRequest},
+		{http.MethodPost, "/users", `{"name":"Jiro","extra":[1,2,3,4]}`, http.StatusBadRequest},
+		{http.MethodPut, "/users/1", deep, http.StatusBadRequest},
+		{http.MethodPatch, "/users/1", deep, http.StatusBadRequest},
+		// DELETE /users もボディで条件を受け取るので同じ制限をかける
+		{http.MethodDelete, "/users?confirm=true", deep, http.StatusBadRequest},
+		{http.MethodDelete, "/users?confirm=true", `{"name":"Taro","extra":[1,2,3,4]}`, http.StatusBadRequest},
+		{http.MethodDelete, "/users?confirm=true", `{"name":"Taro"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := request(s, tt.method, tt.path, tt.body)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s %.30s: status = %d, want %d: %s", tt.method, tt.path, tt.body, rec.Code, tt.want, rec.Body.String())
+		}
+	}
+}
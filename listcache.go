@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// listCache は GET /users（クエリパラメータなし）の結果を一定間隔で読み直して、メモリに置いておくスナップショットです。
+// 書き込みがあってもすぐには読み直さないため、レスポンスは最大で interval だけ古い内容になります。
+// 読み取りが非常に多いダッシュボードなどで、新しさと引き換えにDBへのクエリを減らすためのものです。
+type listCache struct {
+	repo *userRepository
+	now  func() time.Time
+
+	mu          sync.RWMutex
+	users       []User
+	refreshedAt time.Time
+}
+
+// newListCache はスナップショットを作成し、interval ごとに読み直すワーカーを起動します。
+func newListCache(repo *userRepository, interval time.Duration, workers *workerGroup) *listCache {
+	lc := &listCache{repo: repo, now: time.Now}
+	workers.Go("list cache", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			lc.refresh(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	return lc
+}
+
+// refresh は一覧を読み直します。失敗した場合は前回のスナップショットをそのまま使い続けます。
+func (lc *listCache) refresh(ctx context.Context) {
+	users := []User{}
+	err := lc.repo.ForEach(ctx, userFilter{}, userSort{}, func(user User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		log.Printf("list cache: failed to refresh: %v", err)
+		return
+	}
+	lc.mu.Lock()
+	lc.users, lc.refreshedAt = users, lc.now()
+	lc.mu.Unlock()
+}
+
+// serve はスナップショットを返します。X-Cache: HIT と、読み込んでからの秒数を Age ヘッダーに付けます。
+// fields で伏せるフィールドがあれば、スナップショットは変えずにレスポンスだけ伏せます。
+// まだ一度も読み込めていない場合はfalseを返すので、呼び出し側は通常通りDBから読み込みます。
+func (lc *listCache) serve(c echo.Context, fields fieldSelection) (bool, error) {
+	lc.mu.RLock()
+	users, refreshedAt := lc.users, lc.refreshedAt
+	lc.mu.RUnlock()
+	if users == nil {
+		return false, nil
+	}
+	h := c.Response().Header()
+	h.Set("X-Cache", "HIT")
+	h.Set("Age", strconv.Itoa(int(lc.now().Sub(refreshedAt)/time.Second)))
+	return true, bufferedJSON(c, http.StatusOK, fields.users(users))
+}
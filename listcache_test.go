@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestListCacheAge(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+	now := time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)
+	lc := &listCache{repo: newUserRepository(s.db), now: func() time.Time { return now }}
+
+	serve := func() (*httptest.ResponseRecorder, bool) {
+		rec := httptest.NewRecorder()
+		ok, err := lc.serve(s.e.NewContext(httptest.NewRequest(http.MethodGet, "/users", nil), rec), fieldSelection{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec, ok
+	}
+	// まだ読み込んでいない場合は、DBから読み込ませる
+	if _, ok := serve(); ok {
+		t.Fatal("served before the first refresh")
+	}
+
+	lc.refresh(context.Background())
+	now = now.Add(42 * time.Second)
+	// 書き込みがあっても、次に読み直すまでは古い一覧を返す
+	createUser(t, s, "Hanako", 25, "hanako@example.com")
+	rec, ok := serve()
+	if !ok {
+		t.Fatal("not served after refresh")
+	}
+	var users []User
+	decode(t, rec, &users)
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Age") != "42" || len(users) != 1 {
+		t.Errorf("X-Cache %q, Age %q, %d users", rec.Header().Get("X-Cache"), rec.Header().Get("Age"), len(users))
+	}
+
+	lc.refresh(context.Background())
+	rec, _ = serve()
+	decode(t, rec, &users)
+	if rec.Header().Get("Age") != "0" || len(users) != 2 {
+		t.Errorf("after refresh: Age %q, %d users", rec.Header().Get("Age"), len(users))
+	}
+}
+
+func TestListCacheServer(t *testing.T) {
+	s := newTestServer(t, map[string]string{"LIST_CACHE_INTERVAL_S": "3600"})
+	// 起動時の読み込みはワーカーで行うので、スナップショットから返すようになるまで待つ
+	deadline := time.Now().Add(2 * time.Second)
+	for request(s, http.MethodGet, "/users", "").Header().Get("X-Cache") != "HIT" {
+		if time.Now().After(deadline) {
+			t.Fatal("GET /users was never served from the snapshot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	rec := request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	var users []User
+	decode(t, rec, &users)
+	if len(users) != 0 {
+		t.Errorf("snapshot = %+v, want the stale empty list", users)
+	}
+	// クエリパラメータのある一覧は、スナップショットを使わない
+	rec = request(s, http.MethodGet, "/users?limit=10", "")
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &users)
+	if rec.Header().Get("X-Cache") != "" || len(users) != 1 {
+		t.Errorf("?limit=10: X-Cache %q, %d users", rec.Header().Get("X-Cache"), len(users))
+	}
+}
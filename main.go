@@ -1,212 +1,1507 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// userSchemaVersion はレスポンスのユーザーの形のバージョンです。X-Api-Version ヘッダーで返します。
+// User のJSONにフィールドを追加したり、名前や型を変えたりしたときは1つ増やしてください。
+const userSchemaVersion = 1
+
 type User struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-	Age  int    `json:"age"`
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Age   int    `json:"age"`
+	Email string `json:"email"`
+	// Status は active、suspended、deleted（論理削除済み）のいずれかです。POST /users/:id/status で変更します。
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt は論理削除された日時です。削除されていない場合はnilです。
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// AnonymizedAt は POST /admin/anonymize で名前とメールアドレスを消した日時です。
+	AnonymizedAt *time.Time `json:"anonymized_at,omitempty"`
+	// CreatedBy と UpdatedBy は登録・最後に更新したAPIキーのラベルです（認証が無効な場合は空文字）。
+	// 管理者のキーで取得した場合にだけ、fieldSelection がレスポンスに含めます。
+	CreatedBy string `json:"-"`
+	UpdatedBy string `json:"-"`
 }
 
-func initDB(filepath string) *sql.DB {
-	db, err := sql.Open("sqlite3", filepath)
+// initDB はデータベースを開きます。txLock はトランザクションの開始方法（deferred, immediate, exclusive）です。
+//   - deferred: BEGIN。最初に書き込むときに書き込みのロックを取ります。読み取りのロックを持った2つのトランザクションが
+//     同時に書き込もうとすると、どちらもロックを上げられず、片方が busy_timeout を待たずに SQLITE_BUSY で失敗します。
+//   - immediate: BEGIN IMMEDIATE。開始時に書き込みのロックを取るので、書き込むトランザクション同士は開始時に順番待ちになり、
+//     上のような失敗は起きません。その代わり、読み取りだけのトランザクションも他の書き込みを待たせます。
+//   - exclusive: BEGIN EXCLUSIVE。WALモード以外では読み取りも待たせます。
+//
+// journalMode はジャーナルモード（JOURNAL_MODE）で、すべての接続で PRAGMA journal_mode に設定します。
+// 空文字の場合は設定せず、DBファイルのモード（新しいファイルでは delete）のままにします。
+func initDB(filepath, txLock, journalMode string) (*sql.DB, error) {
+	switch txLock {
+	case "deferred", "immediate", "exclusive":
+	default:
+		return nil, fmt.Errorf("TX_LOCK must be deferred, immediate or exclusive: %q", txLock)
+	}
+	// 外部キー制約（ON DELETE CASCADE など）を有効にして開く
+	dsn := filepath + "?_foreign_keys=on&_txlock=" + txLock
+	switch journalMode {
+	case "":
+	case "delete", "truncate", "persist", "wal":
+		dsn += "&_journal_mode=" + journalMode
+	default:
+		return nil, fmt.Errorf("JOURNAL_MODE must be delete, truncate, persist or wal: %q", journalMode)
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return db
+	// sql.Open は接続しないので、ここで実際に開けるか確認する
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// maxAge は年齢の上限です（この値は含みません）。
+const maxAge = 200
+
+// userInput はPOST/PUTで受け取るユーザー情報です。JSONとフォームのどちらでも受け付けます。
+type userInput struct {
+	Name  string `json:"name" form:"name"`
+	Age   int    `json:"age" form:"age"`
+	Email string `json:"email" form:"email"`
 }
 
-func validateUser(name string, age int) error {
+// bindUserInput はリクエストボディからユーザー情報を読み込みます。
+// strictJSON がtrueの場合はJSONのみを受け付け、フォームなど他の形式は415で拒否します。
+func bindUserInput(c echo.Context, strictJSON bool) (userInput, error) {
+	var in userInput
+	if strictJSON {
+		mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+		if mediaType != echo.MIMEApplicationJSON {
+			return in, echo.NewHTTPError(http.StatusUnsupportedMediaType, "request body must be application/json")
+		}
+	}
+	if err := c.Bind(&in); err != nil {
+		return in, err
+	}
+	return in, nil
+}
+
+// validateUser は名前と年齢を検証します。年齢は minAge 以上 maxAge 未満（既定では0〜199）を有効とします。
+// 年齢0を未入力の代わりとみなす環境では、MIN_AGE=1 を指定して0を拒否できます。
+func validateUser(name string, age int, minAge int) error {
 	if name == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "name is empty")
+		return validationError(http.StatusBadRequest, "name is empty")
 	}
 	if len(name) > 100 {
-		return echo.NewHTTPError(http.StatusBadRequest, "name is too long")
+		return validationError(http.StatusBadRequest, "name is too long")
 	}
-	if age < 0 || age >= 200 {
-		return echo.NewHTTPError(http.StatusBadRequest, "age must be between 0 and 200")
+	if age < minAge || age >= maxAge {
+		return ageRangeError(minAge)
+	}
+	return nil
+}
+
+// notModified は Last-Modified ヘッダーを設定し、If-Modified-Since の日時以降に
+// 変更がない場合にtrueを返します。HTTPの日時は秒単位のため、比較も秒単位で行います。
+func notModified(c echo.Context, lastModified time.Time) bool {
+	if lastModified.IsZero() {
+		return false
+	}
+	lastModified = lastModified.UTC().Truncate(time.Second)
+	c.Response().Header().Set(echo.HeaderLastModified, lastModified.Format(http.TimeFormat))
+
+	since, err := http.ParseTime(c.Request().Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(since)
+}
+
+// notFoundWithSuggestions は、近いIDのユーザーを候補として含めた404エラーを返します。
+// 例: "user 5 not found, did you mean 4 or 6?"
+func notFoundWithSuggestions(c echo.Context, repo *userRepository, id int) error {
+	prev, next, err := repo.NeighborIDs(c.Request().Context(), id)
+	if err != nil {
+		return dbError(c, err)
+	}
+	var ids []string
+	for _, n := range []int{prev, next} {
+		if n > 0 {
+			ids = append(ids, strconv.Itoa(n))
+		}
+	}
+	msg := fmt.Sprintf("user %d not found", id)
+	if len(ids) > 0 {
+		msg += ", did you mean " + strings.Join(ids, " or ") + "?"
+	}
+	return withCode(echo.NewHTTPError(http.StatusNotFound, msg), codeUserNotFound)
+}
+
+// decodeBulkRecords はJSONの配列を1件ずつ読み込みます。max 件を超えた時点で、ボディの残りを読まずに413を返します。
+func decodeBulkRecords(body io.Reader, max int) ([]userInput, error) {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "body must be a JSON array")
+	}
+	records := []userInput{}
+	for dec.More() {
+		if len(records) == max {
+			return nil, tooManyRecords(max)
+		}
+		var in userInput
+		if err := dec.Decode(&in); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("record %d: invalid JSON", len(records))).SetInternal(err)
+		}
+		records = append(records, in)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "body must be a JSON array").SetInternal(err)
+	}
+	return records, nil
+}
+
+// tooManyRecords は一括処理の件数が上限を超えた場合のエラーです。
+func tooManyRecords(max int) error {
+	return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("too many records: at most %d per request, split the batch", max))
+}
+
+// bulkFailure は ?partial=true の一括処理で失敗したレコードの番号（0始まり）とエラーです。
+type bulkFailure struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// validateBulkRecord は一括登録・更新の1件を検証します。照合に使うため、メールアドレスは必須です。
+func validateBulkRecord(in userInput, minAge int, custom func(User) error) error {
+	if in.Email == "" {
+		return validationError(http.StatusBadRequest, "email is required")
+	}
+	if err := validateUser(in.Name, in.Age, minAge); err != nil {
+		return err
+	}
+	if err := validateEmail(in.Email); err != nil {
+		return err
+	}
+	return custom(User{Name: in.Name, Age: in.Age, Email: in.Email})
+}
+
+// bulkValidationError は一括処理の検証エラーに、何番目（0始まり）のレコードかを付け加えます。
+func bulkValidationError(index int, err error) error {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return echo.NewHTTPError(he.Code, fmt.Sprintf("record %d: %v", index, he.Message))
+	}
+	return err
+}
+
+// parseID はパスパラメータ :id を正の整数として読み込みます。
+// 0や負の値は決して行に一致しないため、紛らわしい404にせず400を返します。
+func parseID(c echo.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "id must be an integer")
+	}
+	if id <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "id must be positive")
+	}
+	return id, nil
+}
+
+// maxBatchIDs は一度に指定できるIDの上限です。
+const maxBatchIDs = 100
+
+// parseIDList はカンマ区切りのIDリストを解析します。重複したIDは1つにまとめます。
+func parseIDList(s string) ([]int, error) {
+	if s == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "ids is empty")
+	}
+	var ids []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "ids must be comma-separated integers")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxBatchIDs {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "too many ids")
+	}
+	return ids, nil
+}
+
+// maxAgesPerQuery は ?ages= で一度に指定できる年齢の数の上限です。
+const maxAgesPerQuery = 50
+
+// parseAgeList はカンマ区切りの年齢のリストを解析します。数値でない項目は無視し、重複した年齢は1つにまとめます。
+func parseAgeList(s string) ([]int, error) {
+	var ages []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		age, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || seen[age] {
+			continue
+		}
+		seen[age] = true
+		ages = append(ages, age)
+	}
+	if len(ages) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "ages must contain at least one integer")
+	}
+	if len(ages) > maxAgesPerQuery {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "too many ages: at most "+strconv.Itoa(maxAgesPerQuery))
+	}
+	return ages, nil
+}
+
+// parseUserFilter は一覧と書き出しで共通の絞り込みの条件を読み込みます。
+// ?email= はメールアドレス、?name= は名前の部分一致、?name_prefix= は名前の前方一致、
+// ?min_age= と ?max_age= は年齢の範囲（両端を含む）、?status= は状態です（既定では削除済みを含めません）。
+func parseUserFilter(c echo.Context) (userFilter, error) {
+	filter := userFilter{
+		Email:      c.QueryParam("email"),
+		Name:       c.QueryParam("name"),
+		NamePrefix: c.QueryParam("name_prefix"),
+		Status:     c.QueryParam("status"),
+	}
+	if filter.Status != "" && !userStatuses[filter.Status] {
+		return userFilter{}, echo.NewHTTPError(http.StatusBadRequest, "status must be active, suspended or deleted")
+	}
+	var err error
+	if filter.MinAge, err = optionalIntParam(c, "min_age"); err != nil {
+		return userFilter{}, err
+	}
+	if filter.MaxAge, err = optionalIntParam(c, "max_age"); err != nil {
+		return userFilter{}, err
+	}
+	return filter, nil
+}
+
+// optionalIntParam はクエリパラメータを整数として読み込みます。指定されていない場合は nil を返します。
+func optionalIntParam(c echo.Context, name string) (*int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, name+" must be an integer")
+	}
+	return &n, nil
+}
+
+// parseSort は ?sort= と ?order=（asc/desc）を読み込みます。
+// strict がtrueの場合、許可されていない値には使える値を示した400を返します。
+// falseの場合は許可されていない値を無視し、既定の並び順（ID順、昇順）にします。
+func parseSort(c echo.Context, strict bool) (userSort, error) {
+	var s userSort
+	if field := c.QueryParam("sort"); field != "" {
+		allowed := false
+		for _, f := range sortFields {
+			allowed = allowed || f == field
+		}
+		if allowed {
+			s.Field = field
+		} else if strict {
+			return userSort{}, echo.NewHTTPError(http.StatusBadRequest,
+				"invalid sort field: allowed values are "+strings.Join(sortFields, ", "))
+		}
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		s.Desc = true
+	default:
+		if strict {
+			return userSort{}, echo.NewHTTPError(http.StatusBadRequest, "invalid order: allowed values are asc, desc")
+		}
+	}
+	return s, nil
+}
+
+// ageRangeError は年齢が有効範囲外のときのエラーです。範囲は両端を含めて表示します。
+func ageRangeError(minAge int) error {
+	return validationError(http.StatusBadRequest, fmt.Sprintf("age must be between %d and %d", minAge, maxAge-1))
+}
+
+// validateAgeChange は更新で年齢が減っていないか検証します。同じ値への更新は許可します。
+func validateAgeChange(current, updated int) error {
+	if updated < current {
+		return validationError(http.StatusBadRequest, "age cannot decrease")
+	}
+	return nil
+}
+
+// validateEmail はメールアドレスの形式を検証します。空文字は未設定として許可します。
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	if len(email) > 254 {
+		return validationError(http.StatusBadRequest, "email is too long")
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return validationError(http.StatusBadRequest, "email is invalid")
 	}
 	return nil
 }
 
 func main() {
-	db := initDB("example.db")
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+
+	// db, err := sql.Open("sqlite3", "./example.db")
+	// if err != nil {
+	// 	log.Fatal(err)
+	// }
+	// defer db.Close()
+
+	// createTableSQL := `CREATE TABLE IF NOT EXISTS users (
+	// 	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	// 	name TEXT NOT NULL,
+	// 	age INTEGER NOT NULL
+	// );
+	// `
+
+	// _, err = db.Exec(createTableSQL)
+	// if err != nil {
+	// 	log.Fatal(err)
+	// }
+
+	// log.Println("Table created")
+}
+
+// startupPhase は起動の1つの段階を実行します。段階の名前をログに出し、失敗した場合はどの段階で失敗したかを含むエラーを返します。
+func startupPhase(name string, fn func() error) error {
+	log.Printf("startup: %s", name)
+	if err := fn(); err != nil {
+		return fmt.Errorf("startup: %s: %w", name, err)
+	}
+	return nil
+}
+
+// run はサーバーを起動します。設定を読み込んでから newServer でサーバーを準備し、
+// SIGINT か SIGTERM を受け取るまで動かしてから終了します。
+func run() error {
+	// CONFIG_FILE が指定されていれば、その KEY=VALUE を環境変数より優先する
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := applyConfigFile(path, false); err != nil {
+			return fmt.Errorf("startup: load config: %w", err)
+		}
+	}
+	s, err := newServer(loadConfig(), "example.db")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("startup: start server")
+	serverErr := make(chan error, 1)
+	go func() {
+		if s.tlsConfig != nil {
+			serverErr <- s.e.StartServer(&http.Server{Addr: ":8080", TLSConfig: s.tlsConfig})
+		} else {
+			serverErr <- s.e.Start(":8080")
+		}
+	}()
+
+	// SIGINT（Ctrl+C）か SIGTERM を受け取ったら終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// 新しいリクエストの受け付けを止めて処理中のリクエストを終えてから、ワーカーのバッファを片付ける。
+	// すべてを SHUTDOWN_TIMEOUT_S の間に終える
+	log.Printf("shutdown: stopping server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := s.e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if err := s.close(shutdownCtx); err != nil {
+		return err
+	}
+	log.Printf("shutdown: done")
+	return nil
+}
+
+// server は newServer で準備した、リクエストを受け付けられる状態のサーバーです。
+type server struct {
+	// ValidatorFunc は組み込みの検証の後に実行する独自の検証ルールです。nil の場合は独自の検証を行いません。
+	// ハンドラはリクエストごとにこのフィールドを読むので、newServer の後に設定できます（ValidatorFunc を参照）。
+	ValidatorFunc ValidatorFunc
+
+	cfg    config
+	e      *echo.Echo
+	db     *sql.DB
+	readDB *sql.DB
+	// snapshotDB は読み取りだけのトランザクション用のDBです（userRepository.snapshotDB）。TX_LOCK=deferred の場合は db と同じです。
+	snapshotDB *sql.DB
+	workers    *workerGroup
+	tlsConfig  *tls.Config
+}
+
+// close はワーカーを止めてから、DBを閉じます。ワーカーは ctx の期限までに止める必要があります。
+// 期限までに止まらなかった場合もDBは閉じ、ワーカーのエラーを返します。起動の途中で開いていないDBは飛ばします。
+func (s *server) close(ctx context.Context) error {
+	log.Printf("shutdown: stopping workers")
+	err := s.workers.Shutdown(ctx)
+	if s.readDB != nil {
+		s.readDB.Close()
+	}
+	if s.snapshotDB != nil && s.snapshotDB != s.db {
+		s.snapshotDB.Close()
+	}
+	if s.db != nil {
+		if cerr := s.db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// newServer は cfg の設定でサーバーを準備します。設定の確認、DBの接続、マイグレーション、リポジトリの準備、
+// ルートの登録、ウォームアップの順に進み、失敗した段階で止めてエラーを返します。dbPath はSQLiteのファイルです。
+func newServer(cfg config, dbPath string) (_ *server, err error) {
+	var (
+		emails      *emailCipher
+		maintenance *maintenanceWindow
+		db          *sql.DB
+		readDB      *sql.DB
+		snapshotDB  *sql.DB
+		repo        *userRepository
+		webhooks    *webhookNotifier
+		panics      *webhookNotifier
+		idempotency idempotencyStore
+		listCached  *listCache
+		tlsConfig   *tls.Config
+	)
+	// バックグラウンドのワーカー。終了時にまとめて止める
+	workers := newWorkerGroup()
+	s := &server{cfg: cfg, workers: workers}
+	// 途中の段階で失敗した場合は、それまでに起動したワーカーを止めて、開いたDBを閉じる
+	defer func() {
+		if err == nil {
+			return
+		}
+		s.db, s.readDB, s.snapshotDB = db, readDB, snapshotDB
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if cerr := s.close(ctx); cerr != nil {
+			log.Printf("startup: cleanup after failure: %v", cerr)
+		}
+	}()
+
+	err = startupPhase("load config", func() error {
+		var err error
+		// EMAIL_ENC_KEY が設定されていればメールアドレスを暗号化して保存する
+		if emails, err = parseEmailKey(cfg.EmailEncKey); err != nil {
+			return err
+		}
+		// 予定されたメンテナンスの時間帯
+		if maintenance, err = parseMaintenanceWindow(cfg.MaintenanceStart, cfg.MaintenanceEnd); err != nil {
+			return err
+		}
+		// 証明書が設定されている場合はHTTPSで起動する
+		if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+			if tlsConfig, err = newTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSMinVersion); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = startupPhase("open database", func() error {
+		// NFSなどの上ではSQLiteのロックが正しく働かないため、警告するか起動を中止する
+		if err := checkNetworkFS(dbPath, cfg.NetworkFSPaths, cfg.NetworkFSPolicy); err != nil {
+			return err
+		}
+		var err error
+		if db, err = initDB(dbPath, cfg.TxLock, cfg.JournalMode); err != nil {
+			return err
+		}
+		// 読み取りだけのトランザクション（一貫したページ、ダンプ）は、書き込みのロックを取らない BEGIN で開始する
+		snapshotDB = db
+		if cfg.TxLock != "deferred" {
+			if snapshotDB, err = initDB(dbPath, "deferred", cfg.JournalMode); err != nil {
+				return err
+			}
+		}
+		// READ_DB_PATH が設定されていれば、GET/HEAD のクエリ用に読み取り専用で開く
+		if cfg.ReadDBPath != "" {
+			readDB, err = initReadDB(cfg.ReadDBPath)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = startupPhase("migrate", func() error {
+		if err := migrate(db); err != nil {
+			return err
+		}
+		if err := applyNameIndex(db, cfg.NameIndex); err != nil {
+			return err
+		}
+		if err := applyUniqueNames(db, cfg.UniqueNames); err != nil {
+			return err
+		}
+		// 実際のテーブルがコードの前提と一致しているか確認
+		if !cfg.SkipSchemaCheck {
+			return checkSchema(db)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = startupPhase("prepare repository", func() error {
+		repo = newUserRepository(db)
+		repo.readDB = readDB
+		repo.snapshotDB = snapshotDB
+		repo.emails = emails
+		repo.normalizeEmails = cfg.EmailNormalize
+		// WEBHOOK_URL が設定されていれば、ユーザーの登録・更新・削除を通知する
+		if cfg.WebhookURL != "" {
+			webhooks = newWebhookNotifier(cfg.WebhookURL, cfg.WebhookSecret, cfg.WebhookQueue, workers)
+		}
+		// PANIC_REPORT_URL が設定されていれば、ハンドラのパニックの内容を送る
+		if cfg.PanicReportURL != "" {
+			panics = newWebhookNotifier(cfg.PanicReportURL, cfg.PanicReportSecret, cfg.WebhookQueue, workers)
+		}
+		// LIST_CACHE_INTERVAL_S が設定されていれば、GET /users をその間隔で読み直すスナップショットから返す
+		if cfg.ListCacheInterval > 0 {
+			listCached = newListCache(repo, cfg.ListCacheInterval, workers)
+		}
+		// PURGE_RETENTION_DAYS が設定されていれば、期間を過ぎた論理削除済みのユーザーを定期的に物理削除する
+		if cfg.PurgeRetention > 0 {
+			if cfg.PurgeInterval <= 0 {
+				return fmt.Errorf("PURGE_INTERVAL_S must be positive: %s", cfg.PurgeInterval)
+			}
+			startJanitor(repo, cfg.PurgeRetention, cfg.PurgeInterval, workers)
+		}
+		// Idempotency-Key 付きのリクエストのレスポンスの保存先
+		var err error
+		idempotency, err = newIdempotencyStore(cfg.IdempotencyStore, db, workers)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("startup: register routes")
+	// 複数の書き込みを行うハンドラ用の、リクエスト単位のトランザクション
+	txm := repo.txMiddleware()
 	e := echo.New()
-	e.Use(middleware.Logger())
+	e.HTTPErrorHandler = newErrorHandler(cfg.Development)
+	// ログレベル、レート制限、読み取り専用モードは SIGHUP で再読み込みできる
+	settings := runtimeSettings{e: e, limiter: newRateLimiter(0, 0, 0), readOnly: new(atomic.Bool)}
+	if err := settings.apply(cfg); err != nil {
+		return nil, fmt.Errorf("startup: register routes: %w", err)
+	}
+	workers.Go("config reload", reloadOnSIGHUP(os.Getenv("CONFIG_FILE"), settings))
+	// CANONICAL_JSON=true の場合、レスポンスのJSONを常に同じ並び・書式で出力する
+	if cfg.CanonicalJSON {
+		e.JSONSerializer = canonicalJSONSerializer{}
+	}
+	// 登録したルートへのOPTIONSリクエストには、echoのルーターが自動で
+	// 204 No Content と利用可能なメソッドを示すAllowヘッダーを返します（CORSの設定とは無関係）。
+
+	// URLの正規形は末尾スラッシュなし（/users）とします。
+	// /users/ のようなリクエストもルーティング前に /users として扱い、404にならないようにします。
+	// /users//5 のような連続したスラッシュも1つにまとめます。
+	if cfg.TrailingSlashRedirect {
+		e.Pre(collapseSlashes(http.StatusMovedPermanently))
+		e.Pre(middleware.RemoveTrailingSlashWithConfig(middleware.TrailingSlashConfig{
+			RedirectCode: http.StatusMovedPermanently,
+		}))
+	} else {
+		e.Pre(collapseSlashes(0))
+		e.Pre(middleware.RemoveTrailingSlash())
+	}
+	// CASE_INSENSITIVE_PATHS=true の場合、/Users のようなパスも /users のルートに一致させる
+	if cfg.CaseInsensitivePaths {
+		e.Pre(caseInsensitivePaths(e))
+	}
+	e.Use(middleware.RequestID())
+	// ハンドラのパニックは500にする（PANIC_REPORT_URL があればその内容を送る）
+	e.Use(recoverMiddleware(panics))
+	// X-Server-Time、レート制限、Retry-After などの共通のヘッダーはここでまとめて付ける
+	// （同時実行数の上限などで先に断ったレスポンスにも付くよう、それらより前に置く）
+	e.Use(standardHeaders(time.Now))
+	// MAX_CONCURRENT_REQUESTS が設定されていれば、同時に処理するリクエストの数を制限する（超えた分は待たせるか503）
+	var concurrency *concurrencyCap
+	if cfg.MaxConcurrentRequests > 0 {
+		concurrency = newConcurrencyCap(cfg.MaxConcurrentRequests, cfg.ConcurrencyQueue, cfg.ConcurrencyQueueWait)
+		e.Use(concurrency.middleware)
+	}
+	// /users/5/extra のように、どのルートの形にも一致しないユーザーのパスは400にする
+	e.Use(malformedUserPaths(e))
+	// READ_DB_PATH が設定されていれば、GET/HEAD のクエリを読み取り用のDBで実行する
+	if readDB != nil {
+		e.Use(readRouting)
+	}
+	// 成功したリクエストのアクセスログは ACCESS_LOG_SAMPLE_RATE の割合だけ出力する（エラーはすべて出力する）。
+	// ACCESS_LOG_USER_FIELDS=true の場合はユーザーIDと操作の種類も出力する
+	if cfg.AccessLogSampleRate < 1 || cfg.AccessLogUserFields {
+		e.Use(accessLogger(cfg.AccessLogSampleRate, cfg.AccessLogUserFields))
+	} else {
+		e.Use(middleware.Logger())
+	}
+	// リクエストの一部をDBに記録する（読み取りは REQUEST_LOG_READS=true の場合のみ）
+	readSampleRate := 0.0
+	if cfg.RequestLogReads {
+		readSampleRate = cfg.RequestLogReadSampleRate
+	}
+	if cfg.RequestLogSampleRate > 0 || readSampleRate > 0 {
+		e.Use(newRequestLogger(db, cfg.RequestLogSampleRate, readSampleRate, workers).middleware())
+	}
+	// パーセントエンコーディングが壊れたクエリ文字列は400にする
+	e.Use(queryStringMiddleware())
+	// READ_ONLY=true の間は書き込みのリクエストを503にする
+	e.Use(readOnlyMiddleware(settings.readOnly))
+	// 予定されたメンテナンスの時間帯は503を返す
+	if maintenance != nil {
+		e.Use(maintenance.middleware())
+	}
+	// 開発モードでのみ、遅延やエラーをわざと注入する
+	useChaos(e, cfg)
+	// GZIP=true の場合、クライアントが受け付けるならレスポンスを圧縮する
+	if cfg.Gzip {
+		e.Use(gzipMiddleware())
+	}
+	e.Use(middleware.BodyLimit(cfg.BodyLimit))
+	e.Use(bodylessMethodMiddleware(cfg.StrictBodylessMethods))
+	e.Use(contentTypeMiddleware(cfg.StrictJSONCharset))
+	// 深すぎる入れ子や大きすぎる配列のJSONは、デコードする前に400にする
+	e.Use(jsonLimitsMiddleware(cfg.JSONMaxDepth, cfg.JSONMaxArray))
+	e.Use(multipartMiddleware(cfg.MultipartMaxMemory))
+	if cfg.RequestTimeout > 0 {
+		e.Use(middleware.ContextTimeoutWithConfig(middleware.ContextTimeoutConfig{
+			Timeout: cfg.RequestTimeout,
+			// 既定のままだと、dbError が返した "database timeout" の503も中身のない503に置き換えられてしまう
+			ErrorHandler: func(err error, c echo.Context) error {
+				if _, ok := err.(*echo.HTTPError); ok {
+					return err
+				}
+				if errors.Is(err, context.DeadlineExceeded) {
+					return echo.ErrServiceUnavailable.WithInternal(err)
+				}
+				return err
+			},
+		}))
+	}
+	// APIキーが設定されている場合のみ認証を有効にする。無効な場合は管理者用のルートを使えない
+	if len(cfg.APIKeys) > 0 {
+		e.Use(apiKeyAuth(cfg.APIKeys))
+	} else {
+		e.Use(withoutAuth)
+	}
+	// クライアントごとのリクエスト数を制限する（RATE_LIMIT=0 の場合は制限しない）
+	e.Use(rateLimitMiddleware(settings.limiter))
+	// RETRY_BUDGET_PERCENT が設定されていれば、予算を超えた再試行を429で断る
+	var retries *retryBudget
+	if cfg.RetryBudgetPercent > 0 {
+		retries = newRetryBudget(cfg.RetryBudgetPercent, cfg.RetryBudgetMin, cfg.RetryBudgetWindow)
+		e.Use(retryBudgetMiddleware(retries))
+	}
+	// Idempotency-Key 付きで再送された POST/PATCH には、保存したレスポンスを返す
+	e.Use(idempotencyMiddleware(idempotency, cfg.IdempotencyTTL))
+	// 開発モードでは、GET に ?explain=true を付けるとクエリの実行計画を返す
+	if cfg.Development {
+		e.Use(explainMiddleware)
+	}
+	// SQL_REQUEST_ID_COMMENT=true の場合は、クエリに /* reqid:... */ を付けてDB側のログとリクエストを結び付ける
+	if cfg.SQLRequestIDComment {
+		e.Use(sqlCommentMiddleware)
+	}
+	// DBへの同時アクセス数を制限する。読み取りは書き込みより優先される
+	e.Use(qosMiddleware(newPrioritySemaphore(cfg.DBMaxConcurrency, cfg.QoSHighQueue, cfg.QoSLowQueue)))
+
+	// サービスの説明と主なエンドポイントへのリンクを返します。
+	if cfg.RootDescriptor {
+		e.GET("/", rootHandler(cfg.ServiceName, cfg.ServiceVersion))
+	}
+
+	// ブラウザが要求するファビコンを返します。
+	e.GET("/favicon.ico", faviconHandler)
+
+	// 再試行の予算か同時実行数の上限が有効な場合は、その状態を Prometheus のテキスト形式で返します。
+	if retries != nil || concurrency != nil {
+		e.GET("/metrics", metricsHandler(retries, concurrency))
+	}
+
+	// ヘルスチェック：データベースに接続できるかを確認します。
+	e.GET("/healthz", func(c echo.Context) error {
+		if err := db.PingContext(c.Request().Context()); err != nil {
+			return withCode(echo.NewHTTPError(http.StatusServiceUnavailable, "database unavailable").SetInternal(err), codeDBUnavailable)
+		}
+		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	// 管理用のエンドポイント（管理者のキーが必要。API_KEYS が空の場合は常に403）
+	admin := e.Group("/admin", requireAdmin)
+	// データベース全体をSQL文としてダウンロードします。
+	admin.GET("/dump", dumpHandler(snapshotDB))
+	// 記録されたリクエストを検索します。
+	admin.GET("/requests", requestLogHandler(db))
+	// WALファイルの内容をDBファイルに書き戻して小さくします（?mode= で PRAGMA wal_checkpoint のモードを指定）。
+	// DBがWALモードでない場合は409を返すので、JOURNAL_MODE=wal で起動してください。
+	admin.POST("/wal-checkpoint", walCheckpointHandler(db))
+	// テスト用：usersテーブルが空の場合に、IDの採番を1からやり直します。
+	// テストのデータを毎回同じIDで作れるようにするためのもので、本番では使わないでください。
+	admin.POST("/reset-sequence", func(c echo.Context) error {
+		err := repo.ResetSequence(c.Request().Context())
+		if errors.Is(err, errTableNotEmpty) {
+			return echo.NewHTTPError(http.StatusConflict, "users table must be empty")
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	// 学習用：削除で空いたIDを詰めて、ユーザーのIDを1からの連番に振り直します（投稿の user_id も書き換えます）。
+	// 外部に保存されたIDやURL、Webhookの送信先が持っているIDはすべて別のユーザーを指すようになるため、
+	// 本番では使わないでください。誤って実行しないよう ?confirm=true が必要です。旧→新のIDの対応を返します。
+	admin.POST("/compact-ids", func(c echo.Context) error {
+		if c.QueryParam("confirm") != "true" {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				"confirm=true is required: compacting ids breaks every existing reference to a user id")
+		}
+		mapping, err := repo.CompactIDs(c.Request().Context())
+		if err != nil {
+			return dbError(c, err)
+		}
+		log.Printf("WARNING: compact ids: request_id=%s renumbered %d users; existing user id references are now invalid",
+			c.Response().Header().Get(echo.HeaderXRequestID), len(mapping))
+		return c.JSON(http.StatusOK, map[string]interface{}{"mapping": mapping})
+	})
+
+	// 個人情報の削除依頼などのために、ボディ（JSON）の ids か条件に一致するユーザーを匿名化します。
+	// 名前を "Anonymous" に、メールアドレスを空にして anonymized_at を記録します。投稿からの参照を保つため行は削除しません。
+	// 元には戻せないので、DELETE /users と同じく少なくとも1つの条件を必須にしています。匿名化した件数を返します。
+	admin.POST("/anonymize", func(c echo.Context) error {
+		var req struct {
+			IDs        []int  `json:"ids"`
+			MinAge     *int   `json:"min_age"`
+			MaxAge     *int   `json:"max_age"`
+			Name       string `json:"name"`
+			NamePrefix string `json:"name_prefix"`
+			Email      string `json:"email"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if len(req.IDs) > cfg.MaxBulkRecords {
+			return tooManyRecords(cfg.MaxBulkRecords)
+		}
+		filter := userFilter{IDs: req.IDs, MinAge: req.MinAge, MaxAge: req.MaxAge, Name: req.Name, NamePrefix: req.NamePrefix, Email: req.Email}
+		if filter.empty() {
+			return echo.NewHTTPError(http.StatusBadRequest, "ids or at least one filter is required")
+		}
+
+		anonymized, err := repo.Anonymize(c.Request().Context(), filter, cfg.UniqueNames)
+		if errors.Is(err, errDuplicateName) {
+			return nameConflict()
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		logged, _ := json.Marshal(req)
+		log.Printf("anonymize: request_id=%s request=%s anonymized=%d",
+			c.Response().Header().Get(echo.HeaderXRequestID), logged, anonymized)
+		return c.JSON(http.StatusOK, map[string]int64{"anonymized": anonymized})
+	})
+
+	// デバッグ用のエンドポイント（管理者のキーが必要。API_KEYS が空の場合は常に403）
+	debug := e.Group("/debug", requireAdmin)
+	// 登録されているルートの一覧を返します。
+	debug.GET("/routes", routesHandler)
+	// ビルド情報と実行時の状態を返します。
+	debug.GET("/info", infoHandler)
+
+	// PATCHメソッドハンドラ：指定されたフィールドだけを更新します。?if_age= などで条件付きの更新ができます。
+	e.PATCH("/users/:id", patchUserHandler(repo, cfg, webhooks, s.runUserValidator))
+
+	// DELETEメソッドハンドラ：ボディ（JSON）の条件に一致するユーザーをまとめて削除します（管理者のみ）。
+	// 誤って実行しないよう ?confirm=true が必要です。削除した件数を返します。
+	e.DELETE("/users", func(c echo.Context) error {
+		if c.QueryParam("confirm") != "true" {
+			return echo.NewHTTPError(http.StatusBadRequest, "confirm=true is required for bulk delete")
+		}
+		var req struct {
+			MinAge     *int   `json:"min_age"`
+			MaxAge     *int   `json:"max_age"`
+			Name       string `json:"name"`
+			NamePrefix string `json:"name_prefix"`
+			Email      string `json:"email"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		filter := userFilter{MinAge: req.MinAge, MaxAge: req.MaxAge, Name: req.Name, NamePrefix: req.NamePrefix, Email: req.Email}
+		// 条件なしで全件を削除してしまわないよう、少なくとも1つの条件を必須にする
+		if filter.empty() {
+			return echo.NewHTTPError(http.StatusBadRequest, "at least one filter is required")
+		}
+
+		deleted, err := repo.DeleteMatching(c.Request().Context(), filter)
+		if err != nil {
+			return dbError(c, err)
+		}
+		logged, _ := json.Marshal(req)
+		log.Printf("bulk delete: request_id=%s filter=%s deleted=%d",
+			c.Response().Header().Get(echo.HeaderXRequestID), logged, deleted)
+		return c.JSON(http.StatusOK, map[string]int64{"deleted": deleted})
+	}, requireAdmin)
 
 	// DELETEメソッドハンドラ：指定されたIDのユーザーを削除します。
 	e.DELETE("/users/:id", func(c echo.Context) error {
 		// リクエストパラメータからユーザーIDを取得します。
-		id, err := strconv.Atoi(c.Param("id"))
+		id, err := parseID(c)
 		if err != nil {
-			// IDを整数に変換できない場合、内部サーバーエラーを返します。
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			// IDが正の整数でない場合、Bad Requestを返します。
+			return err
 		}
 
-		// 指定されたIDのユーザーをデータベースから削除するDELETEクエリを実行します。
-		result, err := db.Exec("DELETE FROM users WHERE id = ?", id)
+		// 指定されたIDのユーザーを論理削除します（行は残り、一覧などからは除外されます）。
+		deleted, err := repo.Delete(c.Request().Context(), id)
 		if err != nil {
 			// データベース操作中にエラーが発生した場合、内部サーバーエラーを返します。
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			return dbError(c, err)
 		}
 
-		// データベースで影響を受けた行の数を確認します。
-		rowsAffected, _ := result.RowsAffected()
-		if rowsAffected == 0 {
+		// 削除されたユーザーがいるか確認します。
+		if !deleted {
 			// 影響を受けた行がない場合、指定されたIDのユーザーが見つかりませんでした。
-			return echo.NewHTTPError(http.StatusNotFound, "Not Found")
+			return userNotFound()
 		}
+		webhooks.notify("user.deleted", map[string]int{"id": id})
 
 		// 操作が成功し、少なくとも1行が影響を受けた場合、成功応答とコンテンツなしを返します。
 		return c.NoContent(http.StatusNoContent)
 	})
 
+	// 作成できるエンドポイントのステータスは次の通りです（LEGACY_CREATE_STATUS=true の場合、ユーザーの作成も200のままです）。
+	//   - POST /users: 201 と Location: /users/:id
+	//   - POST /users/bulk-upsert: 1件でも登録した場合は201、すべて既存のユーザーの更新だった場合は200
+	//     （?partial=true で失敗したレコードがあれば207）。複数のユーザーになるので Location は付けません。
+	//   - POST /users/:id/posts: 201（投稿を1件ずつ取得するURLはないので Location は付けません）
+	// Idempotency-Key で再送されたリクエストには、保存した最初のレスポンスと同じステータスを返します。
+
 	// "/users"へのPOSTリクエストに対するハンドラ
 	e.POST("/users", func(c echo.Context) error {
-		// フォームからユーザーの名前を取得
-		name := c.FormValue("name")
+		// リクエストボディ（JSONまたはフォーム）からユーザーの名前、年齢、メールアドレスを取得
+		in, err := bindUserInput(c, cfg.StrictJSONBody)
+		if err != nil {
+			return err
+		}
+		name, age, email := in.Name, in.Age, repo.normalizeEmail(in.Email)
 
-		// フォームからユーザーの年齢を取得し、整数に変換
-		age, _ := strconv.Atoi(c.FormValue("age"))
+		// バリデーションの実行（名前と年齢の範囲）
+		if err := validateUser(name, age, cfg.MinAge); err != nil {
+			return err
+		}
+		// メールアドレスの形式を検証
+		if err := validateEmail(email); err != nil {
+			return err
+		}
+		// デプロイ先ごとの独自の検証
+		if err := s.runUserValidator(User{Name: name, Age: age, Email: email}); err != nil {
+			return err
+		}
 
-		// データベースに新しいユーザー情報を挿入するクエリを実行
-		result, err := db.Exec("INSERT INTO users(name, age) VALUES(?, ?)", name, age)
+		// データベースに新しいユーザー情報を挿入
+		user, err := repo.Create(c.Request().Context(), User{Name: name, Age: age, Email: email})
+		// UNIQUE_NAMES が有効で、同じ名前のユーザーが既にいる場合はConflictを返す
+		if errors.Is(err, errDuplicateName) {
+			return nameConflict()
+		}
 		if err != nil {
 			// エラーが発生した場合はInternal Server Errorを返す
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			return dbError(c, err)
 		}
 
-		// 挿入された行のIDを取得
-		id, _ := result.LastInsertId()
+		webhooks.notify("user.created", user)
 
-		// 挿入されたユーザー情報をJSON形式でクライアントに返す
-		return c.JSON(http.StatusOK, &User{ID: int(id), Name: name, Age: age})
+		// 挿入されたユーザー情報をJSON形式でクライアントに返す（201と、作成したユーザーのURLを Location に付ける）
+		if cfg.LegacyCreateStatus {
+			return c.JSON(http.StatusOK, responseSelection(c, cfg).user(user))
+		}
+		c.Response().Header().Set(echo.HeaderLocation, "/users/"+strconv.Itoa(user.ID))
+		return c.JSON(http.StatusCreated, responseSelection(c, cfg).user(user))
 	})
 
+	// "/users/bulk-upsert"へのPOSTリクエストに対するハンドラ：ユーザーの配列（JSON）をメールアドレスで照合し、
+	// 既存のユーザーは更新、いなければ登録します（管理者のみ）。外部のデータと同期するためのものです。
+	// 1件でも不正なレコードがあれば何も変更せず、その番号を含むエラーを返します。
+	// ?partial=true の場合は正しいレコードだけを反映し、失敗したレコードを番号とエラーで報告します
+	// （失敗があれば 207 Multi-Status、なければ201か200）。
+	e.POST("/users/bulk-upsert", func(c echo.Context) error {
+		partial := c.QueryParam("partial") == "true"
+		records, err := decodeBulkRecords(c.Request().Body, cfg.MaxBulkRecords)
+		if err != nil {
+			return err
+		}
+		valid := make([]bulkRecord, 0, len(records))
+		failed := []bulkFailure{}
+		for i, in := range records {
+			in.Email = repo.normalizeEmail(in.Email)
+			if err := validateBulkRecord(in, cfg.MinAge, s.runUserValidator); err != nil {
+				if !partial {
+					return bulkValidationError(i, err)
+				}
+				msg := err.Error()
+				var he *echo.HTTPError
+				if errors.As(err, &he) {
+					msg = fmt.Sprint(he.Message)
+				}
+				failed = append(failed, bulkFailure{Index: i, Error: msg})
+				continue
+			}
+			valid = append(valid, bulkRecord{Index: i, User: User{Name: in.Name, Age: in.Age, Email: in.Email}})
+		}
+
+		results, recordErrs, err := repo.UpsertByEmail(c.Request().Context(), valid, partial)
+		var re bulkRecordError
+		if errors.As(err, &re) && errors.Is(err, errDuplicateName) {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("record %d: name already exists", re.Index))
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		created := false
+		for _, r := range results {
+			webhooks.notify("user."+r.Outcome, r.User)
+			created = created || r.Outcome == "created"
+		}
+		// 1件でも登録した場合は201、すべて既存のユーザーの更新だった場合は200
+		status := http.StatusOK
+		if created && !cfg.LegacyCreateStatus {
+			status = http.StatusCreated
+		}
+		if !partial {
+			return c.JSON(status, map[string]interface{}{"results": results})
+		}
+
+		for _, re := range recordErrs {
+			msg := "internal server error"
+			if errors.Is(re, errDuplicateName) {
+				msg = errDuplicateName.Error()
+			} else {
+				log.Printf("bulk upsert: %v", re)
+			}
+			failed = append(failed, bulkFailure{Index: re.Index, Error: msg})
+		}
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Index < failed[j].Index })
+		if len(failed) > 0 {
+			status = http.StatusMultiStatus
+		}
+		return c.JSON(status, map[string]interface{}{"results": results, "errors": failed})
+	}, requireAdmin)
+
+	// "/users/:id/age/cas"へのPOSTリクエストに対するハンドラ：年齢が expected の場合にだけ new に変更します。
+	// 現在の年齢を読んでから更新するクライアント同士が、互いの更新を上書きしないようにするためのものです。
+	// 年齢が expected でない場合は409を返すので、クライアントは読み直してからやり直します。
+	e.POST("/users/:id/age/cas", func(c echo.Context) error {
+		id, err := parseID(c)
+		if err != nil {
+			return err
+		}
+		var req struct {
+			Expected *int `json:"expected"`
+			New      *int `json:"new"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if req.Expected == nil || req.New == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "expected and new are required")
+		}
+		if *req.New < cfg.MinAge || *req.New >= maxAge {
+			return ageRangeError(cfg.MinAge)
+		}
+		if err := checkFieldPermissions(c, []string{"age"}, cfg.NonAdminFields); err != nil {
+			return err
+		}
+
+		ctx := c.Request().Context()
+		swapped, err := repo.CompareAndSwapAge(ctx, id, *req.Expected, *req.New)
+		if err != nil {
+			return dbError(c, err)
+		}
+		if !swapped {
+			// 変更されなかった理由が、ユーザーがいないのか年齢が違うのかを区別する
+			if ok, err := repo.Exists(ctx, id); err != nil {
+				return dbError(c, err)
+			} else if !ok {
+				return userNotFound()
+			}
+			return withCode(echo.NewHTTPError(http.StatusConflict, "age does not match expected"), codeAgeMismatch)
+		}
+		user, err := repo.Get(ctx, id)
+		if err != nil {
+			return dbError(c, err)
+		}
+		webhooks.notify("user.updated", user)
+		return c.JSON(http.StatusOK, responseSelection(c, cfg).user(user))
+	})
+
+	// "/users/:id/status"へのPOSTリクエストに対するハンドラ：ユーザーの状態（active/suspended/deleted）を変更します。
+	e.POST("/users/:id/status", statusHandler(repo, cfg, webhooks))
+
+	// "/users/age-adjust"へのPOSTリクエストに対するハンドラ：複数ユーザーの年齢をまとめて増減します。
+	e.POST("/users/age-adjust", func(c echo.Context) error {
+		// リクエストボディ（JSON）を読み込む。idsを省略した場合は全ユーザーが対象
+		var req struct {
+			Delta int   `json:"delta"`
+			IDs   []int `json:"ids"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if len(req.IDs) > cfg.MaxBulkRecords {
+			return tooManyRecords(cfg.MaxBulkRecords)
+		}
+		if req.Delta != 0 {
+			if err := checkFieldPermissions(c, []string{"age"}, cfg.NonAdminFields); err != nil {
+				return err
+			}
+		}
+
+		updated, err := repo.AdjustAges(c.Request().Context(), req.Delta, req.IDs, cfg.MinAge)
+		if errors.Is(err, errAgeOutOfRange) {
+			// 範囲外になるユーザーがいる場合は何も更新せずBad Requestを返す
+			return ageRangeError(cfg.MinAge)
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+
+		// 更新した件数をJSON形式でクライアントに返す
+		return c.JSON(http.StatusOK, map[string]int64{"updated": updated})
+	}, txm)
+
+	// "/users/merge"へのPOSTリクエストに対するハンドラ：2人のユーザーを1人にまとめます。
+	// remove のユーザーの投稿は keep のユーザーに付け替えられ、remove のユーザーは論理削除されます。
+	e.POST("/users/merge", func(c echo.Context) error {
+		var req struct {
+			Keep   int `json:"keep"`
+			Remove int `json:"remove"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if req.Keep == req.Remove {
+			return echo.NewHTTPError(http.StatusBadRequest, "keep and remove must be different users")
+		}
+
+		user, err := repo.Merge(c.Request().Context(), req.Keep, req.Remove)
+		var notFound errUserNotFound
+		if errors.As(err, &notFound) {
+			return withCode(echo.NewHTTPError(http.StatusNotFound, notFound.Error()), codeUserNotFound)
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		return c.JSON(http.StatusOK, responseSelection(c, cfg).user(user))
+	}, txm)
+
+	// ユーザーの投稿の一覧取得と登録
+	e.GET("/users/:id/posts", listPostsHandler(repo))
+	e.POST("/users/:id/posts", createPostHandler(repo))
+
+	// 削除の前に、影響を受ける投稿の件数を確認する（読み取りのみ）
+	e.GET("/users/:id/delete-preview", deletePreviewHandler(repo))
+
 	// "/users/:id"へのPUTリクエストに対するハンドラ
 	e.PUT("/users/:id", func(c echo.Context) error {
 		// パスパラメータからユーザーIDを取得し、整数に変換
-		id, err := strconv.Atoi(c.Param("id"))
+		id, err := parseID(c)
 		if err != nil {
-			// エラーが発生した場合はInternal Server Errorを返す
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			// IDが正の整数でない場合はBad Requestを返す
+			return err
 		}
 
-		// フォームからユーザーの名前を取得
-		name := c.FormValue("name")
-
-		// フォームからユーザーの年齢を取得し、整数に変換
-		age, err := strconv.Atoi(c.FormValue("age"))
+		// リクエストボディ（JSONまたはフォーム）からユーザーの名前、年齢、メールアドレスを取得
+		in, err := bindUserInput(c, cfg.StrictJSONBody)
 		if err != nil {
-			// エラーが発生した場合はInternal Server Errorを返す
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			return err
 		}
+		name, age, email := in.Name, in.Age, repo.normalizeEmail(in.Email)
 
 		// バリデーションの実行
-		if err := validateUser(name, age); err != nil {
+		if err := validateUser(name, age, cfg.MinAge); err != nil {
+			return err
+		}
+		if err := validateEmail(email); err != nil {
+			return err
+		}
+		if err := s.runUserValidator(User{ID: id, Name: name, Age: age, Email: email}); err != nil {
 			return err
 		}
 
-		// データベースで指定されたユーザーIDの情報を更新するクエリを実行
-		result, err := db.Exec("UPDATE users SET name = ?, age = ? WHERE id = ?", name, age, id)
+		// 現在の値と比較するチェックが必要な場合は、更新前のユーザーを取得
+		checkAge := cfg.AgeNoDecrease && c.QueryParam("allow_age_decrease") != "true"
+		if !isAdmin(c) || checkAge {
+			current, err := repo.Get(c.Request().Context(), id)
+			if errors.Is(err, sql.ErrNoRows) {
+				return userNotFound()
+			}
+			if err != nil {
+				return dbError(c, err)
+			}
+			// 管理者以外のキーの場合、変更されるフィールドが許可されているか確認
+			changed := changedFields(current, User{ID: id, Name: name, Age: age, Email: email})
+			if err := checkFieldPermissions(c, changed, cfg.NonAdminFields); err != nil {
+				return err
+			}
+			// 年齢は減らせない（allow_age_decrease=true で上書き可能）
+			if checkAge {
+				if err := validateAgeChange(current.Age, age); err != nil {
+					return err
+				}
+			}
+		}
+
+		// データベースで指定されたユーザーIDの情報を更新
+		user, err := repo.Update(c.Request().Context(), User{ID: id, Name: name, Age: age, Email: email})
+		// 該当するユーザーがいない場合はNot Foundを返す
+		if errors.Is(err, sql.ErrNoRows) {
+			return userNotFound()
+		}
+		if errors.Is(err, errDuplicateName) {
+			return nameConflict()
+		}
 		if err != nil {
 			// エラーが発生した場合はInternal Server Errorを返す
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			return dbError(c, err)
 		}
 
-		// 更新された行数を取得
-		rows, _ := result.RowsAffected()
-		// 更新された行数が0の場合はNot Foundを返す
-		if rows == 0 {
-			return echo.NewHTTPError(http.StatusNotFound, "Not Found")
-		}
+		webhooks.notify("user.updated", user)
 
 		// 更新されたユーザー情報をJSON形式でクライアントに返す
-		return c.JSON(http.StatusOK, &User{ID: id, Name: name, Age: age})
+		return c.JSON(http.StatusOK, responseSelection(c, cfg).user(user))
 	})
 
 	// "/users"へのGETリクエストに対するハンドラ
 	e.GET("/users", func(c echo.Context) error {
-		// データベースからユーザー情報を取得するクエリ
-		rows, err := db.Query("SELECT id, name, age FROM users")
+		// クエリパラメータのない一覧は、有効であればスナップショットから返す（最大 LIST_CACHE_INTERVAL_S 秒古い）
+		if listCached != nil && len(c.QueryParams()) == 0 {
+			if ok, err := listCached.serve(c, responseSelection(c, cfg)); ok {
+				return err
+			}
+			c.Response().Header().Set("X-Cache", "MISS")
+		}
+		// ?email=、?name=、?name_prefix=、?min_age=、?max_age= で絞り込む
+		filter, err := parseUserFilter(c)
 		if err != nil {
-			// エラーが発生した場合はInternal Server Errorを返す
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			return err
+		}
+		// ?sort=name&order=desc のように並び順を指定できる
+		order, err := parseSort(c, cfg.StrictSort)
+		if err != nil {
+			return err
+		}
+		// ?fields=id,name で含めるフィールドを、?exclude=email で除くフィールドを指定できる
+		// ?include=birth_year で年齢から計算したおおよその生まれ年を追加できる
+		fields, err := parseFieldSelection(c, repo.now, cfg)
+		if err != nil {
+			return err
+		}
+
+		// 一覧の最終更新日時をLast-Modifiedとして返し、
+		// クライアントのIf-Modified-Since以降に変更がなければ304 Not Modifiedを返す
+		if cfg.ListConditional {
+			lastModified, err := repo.LastModified(c.Request().Context(), filter)
+			if err != nil {
+				return dbError(c, err)
+			}
+			if notModified(c, lastModified) {
+				return c.NoContent(http.StatusNotModified)
+			}
+		}
+
+		// ?as=page の場合は ?limit= と ?offset= のページを、全体と絞り込み後の件数と一緒に返す
+		if c.QueryParam("as") == "page" {
+			return listUserPage(c, repo, filter, order, fields, cfg.ConsistentPageCounts)
+		}
+		// 件数が STREAM_THRESHOLD を超える配列は、メモリに溜めずにストリーミングで返す
+		if as := c.QueryParam("as"); cfg.StreamThreshold > 0 && (as == "" || as == "array") {
+			n, err := repo.Count(c.Request().Context(), filter)
+			if err != nil {
+				return dbError(c, err)
+			}
+			if n > cfg.StreamThreshold {
+				return streamUsers(c, repo, filter, order, fields, cfg.CanonicalJSON)
+			}
 		}
-		// 関数が終了する際に行をクローズする
-		defer rows.Close()
 
 		// ユーザー情報を格納するスライス
 		users := []User{}
-		// 取得した行を1行ずつ処理
-		for rows.Next() {
-			// User構造体の変数を宣言
-			var user User
-			// 行からデータをスキャンしてUser構造体に格納
-			if err := rows.Scan(&user.ID, &user.Name, &user.Age); err != nil {
-				// エラーが発生した場合はInternal Server Errorを返す
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		// 取得した行を1行ずつ処理し、ユーザーをスライスに追加
+		slow, err := measureQuery("list users", cfg.SlowQueryThreshold, func() error {
+			return repo.ForEach(c.Request().Context(), filter, order, func(user User) error {
+				users = append(users, user)
+				return nil
+			})
+		})
+		if err != nil {
+			// エラーが発生した場合はInternal Server Errorを返す
+			return dbError(c, err)
+		}
+		// 失敗にはせず、クエリが遅くなっていることをクライアントに知らせる
+		if slow {
+			c.Response().Header().Set("X-Slow-Query", "true")
+		}
+
+		// ?empty_is_404=true の場合、絞り込んだ結果が0件なら404を返す。
+		// 既定の200と空配列の方がREST的には正しい（一覧自体は存在する）が、
+		// 「該当なし」を空配列の判定ではなくステータスで区別したいクライアントのための選択肢。
+		// 絞り込みなしの一覧は0件でも200のまま返す。
+		if len(users) == 0 && !filter.empty() && c.QueryParam("empty_is_404") == "true" {
+			return echo.NewHTTPError(http.StatusNotFound, "no users match the filter")
+		}
+
+		// EMPTY_DATABASE_HINT=true の場合、まだ1人も登録されていなければデータの入れ方をヘッダーで案内する。
+		// ボディは互換性のため空配列のまま変えない
+		if cfg.EmptyDatabaseHint && len(users) == 0 && filter.empty() {
+			c.Response().Header().Set("X-Empty-Database", "true")
+			c.Response().Header().Set("X-Empty-Database-Hint",
+				"no users yet: create one with POST /users or load many with POST /users/bulk-upsert")
+		}
+
+		// ?as=map が指定された場合は、IDをキーにしたオブジェクト {"1": {...}, "2": {...}} で返す
+		switch c.QueryParam("as") {
+		case "", "array":
+		case "map":
+			byID := make(map[int]interface{}, len(users))
+			for _, user := range users {
+				byID[user.ID] = fields.user(user)
 			}
-			// ユーザーをスライスに追加
-			users = append(users, user)
+			return c.JSON(http.StatusOK, byID)
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "as must be array, map or page")
 		}
-		// 取得したユーザー情報をJSON形式でクライアントに返す
-		return c.JSON(http.StatusOK, users)
+
+		// 取得したユーザー情報をJSON形式でクライアントに返す（件数が少ないのでまとめて Content-Length 付きで送る）
+		return bufferedJSON(c, http.StatusOK, fields.users(users))
 	})
 
-	// GETメソッドハンドラ：指定されたIDのユーザー情報を取得します。
-	e.GET("/users/:id", func(c echo.Context) error {
-		// リクエストパラメータからユーザーIDを取得します。
-		id, err := strconv.Atoi(c.Param("id"))
+	// GETメソッドハンドラ：?ids=1,2,3 で指定された複数のユーザーをまとめて取得します。
+	// found は指定されたIDの順番に並べます。見つからなかったIDは missing として返すので、クライアントは欠けているIDを判別できます。
+	e.GET("/users/batch", func(c echo.Context) error {
+		ids, err := parseIDList(c.QueryParam("ids"))
 		if err != nil {
-			// IDを整数に変換できない場合、内部サーバーエラーを返します。
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			return err
 		}
 
-		// 指定されたIDのユーザー情報をデータベースから取得するSELECTクエリを実行します。
-		row := db.QueryRow("SELECT id, name, age FROM users WHERE id = ?", id)
+		found, err := repo.GetByIDsInOrder(c.Request().Context(), ids)
+		if err != nil {
+			return dbError(c, err)
+		}
 
-		// ユーザー情報を格納するための構造体を宣言します。
-		var user User
+		// 取得できたIDを記録し、それ以外を missing とする
+		exists := make(map[int]bool, len(found))
+		for _, user := range found {
+			exists[user.ID] = true
+		}
+		missing := []int{}
+		for _, id := range ids {
+			if !exists[id] {
+				missing = append(missing, id)
+			}
+		}
 
-		// クエリの結果をユーザー構造体にスキャンします。
-		if err := row.Scan(&user.ID, &user.Name, &user.Age); err != nil {
-			// エラーが発生した場合はInternal Server Errorを返します。
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return c.JSON(http.StatusOK, map[string]interface{}{"found": responseSelection(c, cfg).users(found), "missing": missing})
+	})
+
+	// GETメソッドハンドラ：?ages=25,30,35 のいずれかの年齢のユーザーを取得します（?limit= と ?offset= でページ送り）。
+	// 同じ年齢層のユーザーをまとめて調べるためのもので、?as=page と同じ形式で件数も返します。
+	e.GET("/users/by-ages", func(c echo.Context) error {
+		ages, err := parseAgeList(c.QueryParam("ages"))
+		if err != nil {
+			return err
 		}
+		return listUserPage(c, repo, userFilter{Ages: ages}, userSort{}, responseSelection(c, cfg), cfg.ConsistentPageCounts)
+	})
 
-		// 取得したユーザー情報をJSON形式でクライアントに返します。
-		return c.JSON(http.StatusOK, user)
+	// GETメソッドハンドラ：ユーザー一覧をHTMLの表で表示します（?limit= と ?offset= でページ送り）。
+	e.GET("/users.html", usersHTMLHandler(repo, cfg.MaskedFields))
+
+	// GETメソッドハンドラ：ユーザー一覧をCSV形式でダウンロードします。
+	e.GET("/users/export.csv", exportCSVHandler(repo, cfg.ExportChunkSize, cfg.MaskedFields))
+
+	// GETメソッドハンドラ：メールアドレスの形式を、登録・更新と同じ規則で検証します（ユーザーは作成しません）。
+	// 入力中のフォームでリアルタイムに確認するためのものです。空のメールアドレスは登録時と同じく有効とします。
+	e.GET("/users/validate-email", func(c echo.Context) error {
+		res := struct {
+			Valid  bool   `json:"valid"`
+			Reason string `json:"reason,omitempty"`
+		}{Valid: true}
+		if err := validateEmail(repo.normalizeEmail(c.QueryParam("email"))); err != nil {
+			var he *echo.HTTPError
+			if !errors.As(err, &he) {
+				return err
+			}
+			res.Valid, res.Reason = false, fmt.Sprint(he.Message)
+		}
+		return c.JSON(http.StatusOK, res)
+	})
+
+	// GETメソッドハンドラ：?by= で指定したカラム（age または name）の値ごとのユーザー数を取得します。
+	// 既定では {"30": 5, ...} のオブジェクトで、?format=array の場合は値の順に並べた
+	// [{"value": 30, "count": 5}, ...] で返します（オブジェクトのキーの順番に頼れないクライアント向け）。
+	e.GET("/users/group-count", func(c echo.Context) error {
+		format := c.QueryParam("format")
+		if format != "" && format != "map" && format != "array" {
+			return echo.NewHTTPError(http.StatusBadRequest, "format must be map or array")
+		}
+		counts, err := repo.CountGroupedBy(c.Request().Context(), c.QueryParam("by"))
+		if errors.Is(err, errInvalidGroupColumn) {
+			return echo.NewHTTPError(http.StatusBadRequest, "by must be age or name")
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		if format == "array" {
+			return c.JSON(http.StatusOK, counts)
+		}
+		byValue := make(map[string]int64, len(counts))
+		for _, g := range counts {
+			byValue[fmt.Sprint(g.Value)] = g.Count
+		}
+		return c.JSON(http.StatusOK, byValue)
 	})
 
-	e.Start(":8080")
+	// GETメソッドハンドラ：最近作成されたユーザーを新しい順に取得します。
+	e.GET("/users/recent", func(c echo.Context) error {
+		// 取得件数nを取得（省略時は5件、上限は設定値）
+		n := 5
+		if v := c.QueryParam("n"); v != "" {
+			var err error
+			n, err = strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "n must be a positive integer")
+			}
+		}
+		if n > cfg.RecentUsersMax {
+			n = cfg.RecentUsersMax
+		}
 
-	// db, err := sql.Open("sqlite3", "./example.db")
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// defer db.Close()
+		users, err := repo.Recent(c.Request().Context(), n)
+		if err != nil {
+			return dbError(c, err)
+		}
+		return c.JSON(http.StatusOK, responseSelection(c, cfg).users(users))
+	})
 
-	// createTableSQL := `CREATE TABLE IF NOT EXISTS users (
-	// 	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	// 	name TEXT NOT NULL,
-	// 	age INTEGER NOT NULL
-	// );
-	// `
+	// GETメソッドハンドラ：指定されたメールアドレスのユーザー情報を取得します。
+	e.GET("/users/by-email/:email", func(c echo.Context) error {
+		fields, err := parseFieldSelection(c, repo.now, cfg)
+		if err != nil {
+			return err
+		}
+		// %2F（/）などを含むパス（RawPath があるもの）では、ルーターはエスケープされたままの値を渡す
+		email := c.Param("email")
+		if c.Request().URL.RawPath != "" {
+			if email, err = url.PathUnescape(email); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "email is not correctly escaped")
+			}
+		}
+		user, err := repo.GetByEmail(c.Request().Context(), email)
+		if errors.Is(err, sql.ErrNoRows) {
+			// 一致するユーザーがいない場合はNot Foundを返します。
+			return userNotFound()
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		return c.JSON(http.StatusOK, fields.user(user))
+	})
 
-	// _, err = db.Exec(createTableSQL)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+	// GETメソッドハンドラ：指定されたIDのユーザー情報を取得します。
+	e.GET("/users/:id", func(c echo.Context) error {
+		// リクエストパラメータからユーザーIDを取得します。
+		id, err := parseID(c)
+		if err != nil {
+			// IDが正の整数でない場合、Bad Requestを返します。
+			return err
+		}
+		// ?fields= と ?exclude= でレスポンスに含めるフィールドを選べます。
+		fields, err := parseFieldSelection(c, repo.now, cfg)
+		if err != nil {
+			return err
+		}
 
-	// log.Println("Table created")
+		// 指定されたIDのユーザー情報をデータベースから取得します。
+		user, err := repo.Get(c.Request().Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			// 該当するユーザーがいない場合はNot Foundを返します。
+			if cfg.NotFoundSuggestions {
+				return notFoundWithSuggestions(c, repo, id)
+			}
+			return userNotFound()
+		}
+		if err != nil {
+			// エラーが発生した場合はInternal Server Errorを返します。
+			return dbError(c, err)
+		}
+
+		// 取得したユーザー情報をJSON形式でクライアントに返します。
+		return c.JSON(http.StatusOK, fields.user(user))
+	})
+
+	// 最初のリクエストが遅くならないよう、接続とusersテーブルのページを読み込んでおく
+	err = startupPhase("warm up", func() error {
+		var n int
+		return db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.e, s.db, s.readDB, s.snapshotDB, s.tlsConfig = e, db, readDB, snapshotDB, tlsConfig
+	return s, nil
 }
@@ -0,0 +1,973 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TestMain は -v を付けない場合、サーバーのログを出さないようにします。
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer は一時ディレクトリのDBでサーバーを準備します。env は設定を読み込む前に設定する環境変数です。
+// 環境変数はテストが終わるまで残るので、同じテストで後から作るサーバーにも引き継がれます。
+// サーバーはテストの終了時に止めます。
+func newTestServer(t *testing.T, env map[string]string) *server {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	s, err := newServer(loadConfig(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	})
+	return s
+}
+
+// newAdminTestServer は API_KEYS=testAPIKeys でサーバーを準備し、X-API-Key のないリクエストを管理者のキーで送ります。
+// 管理者用のルートと一般のルートを同じテストで使うためのものです。別のキーのリクエストは headers で指定してください。
+func newAdminTestServer(t *testing.T, env map[string]string) *server {
+	t.Helper()
+	t.Setenv("API_KEYS", testAPIKeys)
+	s := newTestServer(t, env)
+	s.e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if h := c.Request().Header; h.Get("X-API-Key") == "" {
+				h.Set("X-API-Key", "admin-secret")
+			}
+			return next(c)
+		}
+	})
+	return s
+}
+
+// request はリクエストを送ってレスポンスを返します。body が空でなければJSONとして送ります。
+// headers にはヘッダーの名前と値を交互に並べます。
+func request(s *server, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	return rec
+}
+
+// expectStatus はレスポンスのステータスが want でなければテストを止めます。
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, want, rec.Body.String())
+	}
+}
+
+// decode はレスポンスのJSONを v に読み込みます。
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+}
+
+// createUser は POST /users でユーザーを登録します。
+func createUser(t *testing.T, s *server, name string, age int, email string) User {
+	t.Helper()
+	rec := request(s, http.MethodPost, "/users", fmt.Sprintf(`{"name":%q,"age":%d,"email":%q}`, name, age, email))
+	expectStatus(t, rec, http.StatusCreated)
+	var u User
+	decode(t, rec, &u)
+	return u
+}
+
+// insertUsers は n 件のユーザー（user0, user1, ...）をDBに直接登録します。件数の多いテスト用です。
+func insertUsers(t *testing.T, s *server, n int) {
+	t.Helper()
+	now := time.Now().UTC().Format(timestampFormat)
+	for i := 0; i < n; i++ {
+		if _, err := s.db.Exec("INSERT INTO users (name, age, email, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+			fmt.Sprintf("user%d", i), 20, fmt.Sprintf("user%d@example.com", i), now, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUserCRUD(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+	if u.ID == 0 || u.Name != "Taro" || u.Age != 30 || u.Email != "taro@example.com" {
+		t.Fatalf("created user = %+v", u)
+	}
+
+	rec := request(s, http.MethodGet, fmt.Sprintf("/users/%d", u.ID), "")
+	expectStatus(t, rec, http.StatusOK)
+	var got User
+	decode(t, rec, &got)
+	if got.ID != u.ID || got.Name != "Taro" {
+		t.Fatalf("GET = %+v, want %+v", got, u)
+	}
+
+	rec = request(s, http.MethodPut, fmt.Sprintf("/users/%d", u.ID), `{"name":"Jiro","age":31,"email":"jiro@example.com"}`)
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &got)
+	if got.Name != "Jiro" || got.Age != 31 {
+		t.Fatalf("PUT = %+v", got)
+	}
+
+	rec = request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	var list []User
+	decode(t, rec, &list)
+	if len(list) != 1 || list[0].Name != "Jiro" {
+		t.Fatalf("GET /users = %+v", list)
+	}
+
+	rec = request(s, http.MethodDelete, fmt.Sprintf("/users/%d", u.ID), "")
+	if rec.Code != http.StatusOK && rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d: %s", rec.Code, rec.Body.String())
+	}
+	expectStatus(t, request(s, http.MethodGet, fmt.Sprintf("/users/%d", u.ID), ""), http.StatusNotFound)
+}
+
+func TestAgeBoundaries(t *testing.T) {
+	tests := []struct {
+		minAge string
+		age    int
+		want   int
+	}{
+		{"", -3, http.StatusBadRequest},
+		{"", 0, http.StatusCreated},
+		{"", 1, http.StatusCreated},
+		{"", 199, http.StatusCreated},
+		{"", 200, http.StatusBadRequest},
+		{"1", 0, http.StatusBadRequest},
+		{"1", 1, http.StatusCreated},
+		{"1", 199, http.StatusCreated},
+		{"1", 200, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("MIN_AGE=%s/age=%d", tt.minAge, tt.age), func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"MIN_AGE": tt.minAge})
+			body := fmt.Sprintf(`{"name":"Taro","age":%d,"email":"taro@example.com"}`, tt.age)
+			expectStatus(t, request(s, http.MethodPost, "/users", body), tt.want)
+
+			// PUT と PATCH も同じ範囲を使う
+			u := createUser(t, s, "Hanako", 20, "hanako@example.com")
+			want := tt.want
+			if want == http.StatusCreated {
+				want = http.StatusOK
+			}
+			path := fmt.Sprintf("/users/%d", u.ID)
+			expectStatus(t, request(s, http.MethodPut, path, fmt.Sprintf(`{"name":"Hanako","age":%d,"email":"hanako@example.com"}`, tt.age)), want)
+			expectStatus(t, request(s, http.MethodPatch, path, fmt.Sprintf(`{"age":%d}`, tt.age)), want)
+		})
+	}
+}
+
+func TestAgeNoDecrease(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		query   string
+		age     int
+		want    int
+	}{
+		{true, "", 30, http.StatusOK},
+		{true, "", 29, http.StatusBadRequest},
+		{true, "", 31, http.StatusOK},
+		{true, "?allow_age_decrease=true", 29, http.StatusOK},
+		{true, "?allow_age_decrease=false", 29, http.StatusBadRequest},
+		{false, "", 29, http.StatusOK},
+	}
+	update := map[string]func(age int) string{
+		http.MethodPut:   func(age int) string { return fmt.Sprintf(`{"name":"Taro","age":%d,"email":"taro@example.com"}`, age) },
+		http.MethodPatch: func(age int) string { return fmt.Sprintf(`{"age":%d}`, age) },
+	}
+	for _, tt := range tests {
+		for method, body := range update {
+			t.Run(fmt.Sprintf("%s/AGE_NO_DECREASE=%t%s/age=%d", method, tt.enabled, tt.query, tt.age), func(t *testing.T) {
+				s := newTestServer(t, map[string]string{"AGE_NO_DECREASE": strconv.FormatBool(tt.enabled)})
+				u := createUser(t, s, "Taro", 30, "taro@example.com")
+				path := fmt.Sprintf("/users/%d", u.ID)
+				expectStatus(t, request(s, method, path+tt.query, body(tt.age)), tt.want)
+
+				// 拒否された場合は年齢を変更しない
+				want := tt.age
+				if tt.want != http.StatusOK {
+					want = u.Age
+				}
+				var got User
+				rec := request(s, http.MethodGet, path, "")
+				expectStatus(t, rec, http.StatusOK)
+				decode(t, rec, &got)
+				if got.Age != want {
+					t.Errorf("age = %d, want %d", got.Age, want)
+				}
+			})
+		}
+	}
+
+	// 管理者のキーでも年齢は減らせない
+	s := newAdminTestServer(t, map[string]string{"AGE_NO_DECREASE": "true"})
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+	path := fmt.Sprintf("/users/%d", u.ID)
+	expectStatus(t, request(s, http.MethodPut, path, update[http.MethodPut](29)), http.StatusBadRequest)
+	expectStatus(t, request(s, http.MethodPatch, path, update[http.MethodPatch](29)), http.StatusBadRequest)
+}
+
+func TestListUsersAsMap(t *testing.T) {
+	s := newTestServer(t, nil)
+	a := createUser(t, s, "Taro", 30, "taro@example.com")
+	b := createUser(t, s, "Hanako", 25, "hanako@example.com")
+
+	rec := request(s, http.MethodGet, "/users?as=map", "")
+	expectStatus(t, rec, http.StatusOK)
+	var byID map[string]User
+	decode(t, rec, &byID)
+	if len(byID) != 2 || byID[strconv.Itoa(a.ID)].Name != "Taro" || byID[strconv.Itoa(b.ID)].Name != "Hanako" {
+		t.Errorf("GET /users?as=map = %s", rec.Body.String())
+	}
+
+	// 既定は配列
+	rec = request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.HasPrefix(rec.Body.String(), "[") {
+		t.Errorf("GET /users = %s", rec.Body.String())
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users?as=set", ""), http.StatusBadRequest)
+}
+
+// batchResponse は GET /users/batch のレスポンスです。
+type batchResponse struct {
+	Found   []User `json:"found"`
+	Missing []int  `json:"missing"`
+}
+
+func TestBatchReportsMissing(t *testing.T) {
+	s := newTestServer(t, nil)
+	a := createUser(t, s, "Taro", 30, "taro@example.com")
+	b := createUser(t, s, "Hanako", 25, "hanako@example.com")
+
+	rec := request(s, http.MethodGet, fmt.Sprintf("/users/batch?ids=%d,99,%d,7", a.ID, b.ID), "")
+	expectStatus(t, rec, http.StatusOK)
+	var res batchResponse
+	decode(t, rec, &res)
+	if len(res.Found) != 2 || fmt.Sprint(res.Missing) != "[99 7]" {
+		t.Errorf("GET /users/batch = %s", rec.Body.String())
+	}
+
+	// すべて見つからない場合も、found は空の配列
+	rec = request(s, http.MethodGet, "/users/batch?ids=98,99", "")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), `"found":[]`) || !strings.Contains(rec.Body.String(), `"missing":[98,99]`) {
+		t.Errorf("GET /users/batch = %s", rec.Body.String())
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/batch?ids=1,x", ""), http.StatusBadRequest)
+}
+
+// allowedMethods は Allow ヘッダーのメソッドを並べ替えて返します。
+func allowedMethods(rec *httptest.ResponseRecorder) string {
+	methods := strings.Split(rec.Header().Get(echo.HeaderAllow), ", ")
+	sort.Strings(methods)
+	return strings.Join(methods, ",")
+}
+
+func TestOptionsOnEveryRoute(t *testing.T) {
+	// 認証が有効でも、OPTIONS はキーなしで答える
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys})
+	tests := []struct {
+		path, want string
+	}{
+		{"/users", "DELETE,GET,OPTIONS,POST"},
+		{"/users/1", "DELETE,GET,OPTIONS,PATCH,PUT"},
+		{"/users/1/posts", "GET,OPTIONS,POST"},
+		{"/healthz", "GET,OPTIONS"},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodOptions, tt.path, "")
+		expectStatus(t, rec, http.StatusNoContent)
+		if got := allowedMethods(rec); got != tt.want {
+			t.Errorf("OPTIONS %s: Allow = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	expectStatus(t, request(s, http.MethodOptions, "/nope", ""), http.StatusNotFound)
+
+	// 405 にも同じ Allow ヘッダーを付ける
+	rec := request(s, http.MethodPut, "/healthz", "", "X-API-Key", "admin-secret")
+	expectStatus(t, rec, http.StatusMethodNotAllowed)
+	if got := allowedMethods(rec); got != "GET,OPTIONS" {
+		t.Errorf("PUT /healthz: Allow = %q", got)
+	}
+}
+
+func TestPositiveID(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+	for _, id := range []string{"0", "-1"} {
+		for _, tt := range []struct{ method, body string }{
+			{http.MethodGet, ""},
+			{http.MethodPut, `{"name":"Taro","age":30,"email":"taro@example.com"}`},
+			{http.MethodPatch, `{"age":31}`},
+			{http.MethodDelete, ""},
+		} {
+			rec := request(s, tt.method, "/users/"+id, tt.body)
+			expectStatus(t, rec, http.StatusBadRequest)
+			var body struct {
+				Message string `json:"message"`
+			}
+			decode(t, rec, &body)
+			if body.Message != "id must be positive" {
+				t.Errorf("%s /users/%s: message = %q", tt.method, id, body.Message)
+			}
+		}
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/abc", ""), http.StatusBadRequest)
+}
+
+func TestNotFoundSuggestions(t *testing.T) {
+	messageOf := func(t *testing.T, s *server, id int) string {
+		t.Helper()
+		rec := request(s, http.MethodGet, fmt.Sprintf("/users/%d", id), "")
+		expectStatus(t, rec, http.StatusNotFound)
+		var body struct {
+			Message string `json:"message"`
+		}
+		decode(t, rec, &body)
+		return body.Message
+	}
+
+	// 既定では候補を示さない
+	t.Run("default", func(t *testing.T) {
+		s := newTestServer(t, nil)
+		insertUsers(t, s, 2)
+		if got := messageOf(t, s, 3); got != "Not Found" {
+			t.Errorf("message = %q", got)
+		}
+	})
+
+	s := newTestServer(t, map[string]string{"NOT_FOUND_SUGGESTIONS": "true"})
+	if got, want := messageOf(t, s, 1), "user 1 not found"; got != want {
+		t.Errorf("empty table: message = %q, want %q", got, want)
+	}
+	insertUsers(t, s, 5)
+	for _, id := range []int{3, 5} {
+		expectStatus(t, request(s, http.MethodDelete, fmt.Sprintf("/users/%d", id), ""), http.StatusNoContent)
+	}
+	// 削除されたユーザーは候補に含めない
+	tests := []struct {
+		id   int
+		want string
+	}{
+		{3, "user 3 not found, did you mean 2 or 4?"},
+		{5, "user 5 not found, did you mean 4?"},
+		{100, "user 100 not found, did you mean 4?"},
+	}
+	for _, tt := range tests {
+		if got := messageOf(t, s, tt.id); got != tt.want {
+			t.Errorf("GET /users/%d: message = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestGroupCount(t *testing.T) {
+	s := newTestServer(t, nil)
+	for i, age := range []int{30, 20, 30, 40} {
+		createUser(t, s, []string{"Taro", "Hanako", "Taro", "Jiro"}[i], age, fmt.Sprintf("user%d@example.com", i))
+	}
+	expectStatus(t, request(s, http.MethodDelete, "/users/4", ""), http.StatusNoContent)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"?by=age", `{"20":1,"30":2}`},
+		{"?by=name", `{"Hanako":1,"Taro":2}`},
+		{"?by=age&format=array", `[{"value":20,"count":1},{"value":30,"count":2}]`},
+		{"?by=name&format=array", `[{"value":"Hanako","count":1},{"value":"Taro","count":2}]`},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users/group-count"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+			t.Errorf("group-count%s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	// 許可していないカラムやSQLは400で拒否する
+	for _, query := range []string{"", "?by=email", "?by=age;DROP%20TABLE%20users", "?by=age&format=csv"} {
+		expectStatus(t, request(s, http.MethodGet, "/users/group-count"+query, ""), http.StatusBadRequest)
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusOK)
+}
+
+func TestUniqueNames(t *testing.T) {
+	t.Run("off", func(t *testing.T) {
+		s := newTestServer(t, nil)
+		createUser(t, s, "Taro", 30, "taro@example.com")
+		createUser(t, s, "Taro", 31, "taro2@example.com")
+	})
+
+	t.Run("on", func(t *testing.T) {
+		s := newTestServer(t, map[string]string{"UNIQUE_NAMES": "true"})
+		taro := createUser(t, s, "Taro", 30, "taro@example.com")
+		hanako := createUser(t, s, "Hanako", 25, "hanako@example.com")
+		path := fmt.Sprintf("/users/%d", hanako.ID)
+
+		// 大文字小文字だけが違う名前も重複として扱う
+		for _, tt := range []struct{ method, path, body string }{
+			{http.MethodPost, "/users", `{"name":"taro","age":20,"email":"jiro@example.com"}`},
+			{http.MethodPut, path, `{"name":"Taro","age":25,"email":"hanako@example.com"}`},
+			{http.MethodPatch, path, `{"name":"TARO"}`},
+		} {
+			rec := request(s, tt.method, tt.path, tt.body)
+			expectStatus(t, rec, http.StatusConflict)
+			var body errorResponse
+			decode(t, rec, &body)
+			if body.Code != codeNameConflict {
+				t.Errorf("%s %s: code = %q", tt.method, tt.path, body.Code)
+			}
+		}
+		// 自分自身の名前のままの更新は重複にならない
+		expectStatus(t, request(s, http.MethodPatch, path, `{"name":"Hanako","age":26}`), http.StatusOK)
+
+		// 削除されたユーザーの名前は再び使える
+		expectStatus(t, request(s, http.MethodDelete, fmt.Sprintf("/users/%d", taro.ID), ""), http.StatusNoContent)
+		createUser(t, s, "Taro", 40, "taro3@example.com")
+	})
+
+	t.Run("existing duplicates", func(t *testing.T) {
+		t.Setenv("UNIQUE_NAMES", "true")
+		path := filepath.Join(t.TempDir(), "test.db")
+		db, err := initDB(path, "immediate", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := migrate(db); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := db.Exec("INSERT INTO users (name, age, email, created_at, updated_at) VALUES ('Taro', 30, '', '', '')"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+		if s, err := newServer(loadConfig(), path); err == nil {
+			s.close(context.Background())
+			t.Fatal("newServer succeeded with duplicate names")
+		}
+	})
+}
+
+func TestEmptyIs404(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	tests := []struct {
+		query string
+		want  int
+		count int
+	}{
+		// 既定では0件でも200と空配列
+		{"?min_age=100", http.StatusOK, 0},
+		{"?min_age=100&empty_is_404=true", http.StatusNotFound, 0},
+		{"?min_age=20&empty_is_404=true", http.StatusOK, 1},
+		{"?min_age=100&empty_is_404=false", http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users"+tt.query, "")
+		expectStatus(t, rec, tt.want)
+		if tt.want != http.StatusOK {
+			continue
+		}
+		var list []User
+		decode(t, rec, &list)
+		if list == nil || len(list) != tt.count {
+			t.Errorf("GET /users%s = %s", tt.query, rec.Body.String())
+		}
+	}
+
+	// 絞り込みのない一覧は、0件でも404にしない
+	expectStatus(t, request(s, http.MethodDelete, "/users/1", ""), http.StatusNoContent)
+	expectStatus(t, request(s, http.MethodGet, "/users?empty_is_404=true", ""), http.StatusOK)
+}
+
+func TestEmptyDatabaseHint(t *testing.T) {
+	hinted := func(t *testing.T, s *server, query string) bool {
+		t.Helper()
+		rec := request(s, http.MethodGet, "/users"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		// ボディは案内があっても空配列のまま
+		if body := strings.TrimSpace(rec.Body.String()); rec.Header().Get("X-Empty-Database") == "true" && body != "[]" {
+			t.Errorf("GET /users%s = %s, want []", query, body)
+		}
+		return rec.Header().Get("X-Empty-Database") == "true" && rec.Header().Get("X-Empty-Database-Hint") != ""
+	}
+
+	t.Run("off", func(t *testing.T) {
+		s := newTestServer(t, nil)
+		if hinted(t, s, "") {
+			t.Error("hint shown without EMPTY_DATABASE_HINT")
+		}
+	})
+	t.Run("on", func(t *testing.T) {
+		s := newTestServer(t, map[string]string{"EMPTY_DATABASE_HINT": "true"})
+		if !hinted(t, s, "") {
+			t.Error("hint not shown for an empty table")
+		}
+		createUser(t, s, "Taro", 30, "taro@example.com")
+		if hinted(t, s, "") {
+			t.Error("hint shown after a user was created")
+		}
+		// 絞り込んだ結果が0件なのは、DBが空だからではない
+		if hinted(t, s, "?min_age=100") {
+			t.Error("hint shown for a filter without matches")
+		}
+	})
+}
+
+func TestValidateEmail(t *testing.T) {
+	s := newTestServer(t, nil)
+	long := strings.Repeat("a", 243) + "@example.com"
+	tests := []struct {
+		email  string
+		valid  bool
+		reason string
+	}{
+		{"taro@example.com", true, ""},
+		{"Taro <taro@example.com>", false, "email is invalid"},
+		{"taro", false, "email is invalid"},
+		{"taro@", false, "email is invalid"},
+		{long, false, "email is too long"},
+	}
+	for i, tt := range tests {
+		rec := request(s, http.MethodGet, "/users/validate-email?email="+url.QueryEscape(tt.email), "")
+		expectStatus(t, rec, http.StatusOK)
+		var res struct {
+			Valid  bool   `json:"valid"`
+			Reason string `json:"reason"`
+		}
+		decode(t, rec, &res)
+		if res.Valid != tt.valid || res.Reason != tt.reason {
+			t.Errorf("validate-email %q = %+v", tt.email, res)
+		}
+
+		// 実際の登録と同じ結果になる
+		body, _ := json.Marshal(map[string]interface{}{"name": fmt.Sprintf("user%d", i), "age": 20, "email": tt.email})
+		rec = request(s, http.MethodPost, "/users", string(body))
+		if created := rec.Code == http.StatusCreated; created != tt.valid {
+			t.Errorf("POST /users with %q: status = %d, validate-email said valid=%v", tt.email, rec.Code, tt.valid)
+		}
+	}
+}
+
+func TestBulkUpsert(t *testing.T) {
+	s := newAdminTestServer(t, nil)
+	taro := createUser(t, s, "Taro", 30, "taro@example.com")
+	type upsertResponse struct {
+		Results []upsertResult `json:"results"`
+		Errors  []bulkFailure  `json:"errors"`
+	}
+	upsert := func(t *testing.T, query, body string, want int) upsertResponse {
+		t.Helper()
+		rec := request(s, http.MethodPost, "/users/bulk-upsert"+query, body)
+		expectStatus(t, rec, want)
+		var res upsertResponse
+		decode(t, rec, &res)
+		return res
+	}
+
+	// 既存のメールアドレスは更新、新しいメールアドレスは登録
+	res := upsert(t, "", `[{"name":"Taro","age":31,"email":"taro@example.com"},{"name":"Hanako","age":25,"email":"hanako@example.com"}]`, http.StatusCreated)
+	if len(res.Results) != 2 || res.Results[0].Outcome != "updated" || res.Results[0].ID != taro.ID ||
+		res.Results[1].Outcome != "created" || res.Results[1].Index != 1 {
+		t.Fatalf("results = %+v", res.Results)
+	}
+	rec := request(s, http.MethodGet, fmt.Sprintf("/users/%d", taro.ID), "")
+	var got User
+	decode(t, rec, &got)
+	if got.Age != 31 {
+		t.Errorf("age after upsert = %d", got.Age)
+	}
+
+	// すべて更新だった場合は200
+	res = upsert(t, "", `[{"name":"Hanako","age":26,"email":"hanako@example.com"}]`, http.StatusOK)
+	if len(res.Results) != 1 || res.Results[0].Outcome != "updated" {
+		t.Errorf("results = %+v", res.Results)
+	}
+
+	// 不正なレコードが1件でもあれば何も変更しない
+	rec = request(s, http.MethodPost, "/users/bulk-upsert", `[{"name":"Jiro","age":20,"email":"jiro@example.com"},{"name":"NoEmail","age":20}]`)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if !strings.Contains(rec.Body.String(), "record 1") {
+		t.Errorf("error does not name the record: %s", rec.Body.String())
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/by-email/jiro@example.com", ""), http.StatusNotFound)
+
+	// ?partial=true では正しいレコードだけを反映し、失敗したレコードを報告する
+	res = upsert(t, "?partial=true", `[{"name":"Jiro","age":20,"email":"jiro@example.com"},{"name":"NoEmail","age":20}]`, http.StatusMultiStatus)
+	if len(res.Results) != 1 || res.Results[0].Outcome != "created" || len(res.Errors) != 1 || res.Errors[0].Index != 1 {
+		t.Errorf("partial = %+v", res)
+	}
+}
+
+func TestBulkUpsertPartial(t *testing.T) {
+	// DBで失敗したレコード（名前の重複）も、そのレコードだけを取り消して続ける
+	s := newAdminTestServer(t, map[string]string{"UNIQUE_NAMES": "true"})
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	body := `[
+		{"name":"Hanako","age":25,"email":"hanako@example.com"},
+		{"name":"","age":25,"email":"empty@example.com"},
+		{"name":"Taro","age":20,"email":"other@example.com"},
+		{"name":"Jiro","age":-1,"email":"jiro@example.com"},
+		{"name":"Saburo","age":40,"email":"saburo@example.com"}
+	]`
+	rec := request(s, http.MethodPost, "/users/bulk-upsert?partial=true", body)
+	expectStatus(t, rec, http.StatusMultiStatus)
+	var res struct {
+		Results []upsertResult `json:"results"`
+		Errors  []bulkFailure  `json:"errors"`
+	}
+	decode(t, rec, &res)
+	var created, failed []int
+	for _, r := range res.Results {
+		created = append(created, r.Index)
+	}
+	for _, f := range res.Errors {
+		failed = append(failed, f.Index)
+		if f.Error == "" {
+			t.Errorf("record %d has no error message", f.Index)
+		}
+	}
+	if fmt.Sprint(created) != "[0 4]" || fmt.Sprint(failed) != "[1 2 3]" {
+		t.Errorf("created %v, failed %v: %s", created, failed, rec.Body.String())
+	}
+	if res.Errors[1].Error != "name already exists" {
+		t.Errorf("duplicate name error = %q", res.Errors[1].Error)
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/by-email/other@example.com", ""), http.StatusNotFound)
+	expectStatus(t, request(s, http.MethodGet, "/users/by-email/saburo@example.com", ""), http.StatusOK)
+
+	// 失敗がなければ201と空の errors
+	rec = request(s, http.MethodPost, "/users/bulk-upsert?partial=true", `[{"name":"Shiro","age":20,"email":"shiro@example.com"}]`)
+	expectStatus(t, rec, http.StatusCreated)
+	if !strings.Contains(rec.Body.String(), `"errors":[]`) {
+		t.Errorf("body = %s", rec.Body.String())
+	}
+}
+
+func TestMaxBulkRecords(t *testing.T) {
+	s := newAdminTestServer(t, map[string]string{"MAX_BULK_RECORDS": "2"})
+	record := func(i int) string {
+		return fmt.Sprintf(`{"name":"user%d","age":20,"email":"user%d@example.com"}`, i, i)
+	}
+	expectStatus(t, request(s, http.MethodPost, "/users/bulk-upsert", "["+record(0)+","+record(1)+"]"), http.StatusCreated)
+
+	rec := request(s, http.MethodPost, "/users/bulk-upsert", "["+record(2)+","+record(3)+","+record(4)+"]")
+	expectStatus(t, rec, http.StatusRequestEntityTooLarge)
+	if !strings.Contains(rec.Body.String(), "at most 2 per request") {
+		t.Errorf("body = %s", rec.Body.String())
+	}
+	// 上限を超えた時点で止めるので、残りのボディが壊れていても413になる
+	rec = request(s, http.MethodPost, "/users/bulk-upsert", "["+record(2)+","+record(3)+","+record(4)+",{broken")
+	expectStatus(t, rec, http.StatusRequestEntityTooLarge)
+	expectStatus(t, request(s, http.MethodGet, "/users/by-email/user2@example.com", ""), http.StatusNotFound)
+
+	expectStatus(t, request(s, http.MethodPost, "/users/age-adjust", `{"delta":1,"ids":[1,2,3]}`), http.StatusRequestEntityTooLarge)
+	expectStatus(t, request(s, http.MethodPost, "/users/age-adjust", `{"delta":1,"ids":[1,2]}`), http.StatusOK)
+}
+
+func TestGroupCountFormats(t *testing.T) {
+	s := newTestServer(t, nil)
+	// 既定はオブジェクト
+	for query, want := range map[string]string{"?by=age": "{}", "?by=age&format=map": "{}", "?by=age&format=array": "[]"} {
+		rec := request(s, http.MethodGet, "/users/group-count"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Errorf("empty group-count%s = %s, want %s", query, got, want)
+		}
+	}
+
+	// 配列は値の順に並ぶ
+	for i, age := range []int{40, 9, 100, 9, 25} {
+		createUser(t, s, fmt.Sprintf("user%d", i), age, "")
+	}
+	rec := request(s, http.MethodGet, "/users/group-count?by=age&format=array", "")
+	expectStatus(t, rec, http.StatusOK)
+	var groups []struct {
+		Value int   `json:"value"`
+		Count int64 `json:"count"`
+	}
+	decode(t, rec, &groups)
+	if fmt.Sprint(groups) != "[{9 2} {25 1} {40 1} {100 1}]" {
+		t.Errorf("groups = %v", groups)
+	}
+}
+
+func TestEmailNormalization(t *testing.T) {
+	t.Run("off", func(t *testing.T) {
+		s := newTestServer(t, map[string]string{"EMAIL_NORMALIZE": "false"})
+		if u := createUser(t, s, "Bob", 30, "Bob@Example.COM"); u.Email != "Bob@Example.COM" {
+			t.Errorf("created email = %q", u.Email)
+		}
+	})
+
+	s := newTestServer(t, map[string]string{"EMAIL_NORMALIZE": "true"})
+	u := createUser(t, s, "Bob", 30, "  Bob@Example.COM ")
+	if u.Email != "bob@example.com" {
+		t.Errorf("created email = %q", u.Email)
+	}
+	path := fmt.Sprintf("/users/%d", u.ID)
+	rec := request(s, http.MethodPatch, path, `{"email":" BOB@example.com"}`)
+	expectStatus(t, rec, http.StatusOK)
+	var got User
+	decode(t, rec, &got)
+	if got.Email != "bob@example.com" {
+		t.Errorf("patched email = %q", got.Email)
+	}
+
+	// 検索も同じ形にそろえてから行う
+	for _, email := range []string{"BOB@EXAMPLE.COM", "bob@example.com"} {
+		expectStatus(t, request(s, http.MethodGet, "/users/by-email/"+email, ""), http.StatusOK)
+		rec := request(s, http.MethodGet, "/users?email="+url.QueryEscape(" "+email), "")
+		var list []User
+		decode(t, rec, &list)
+		if len(list) != 1 {
+			t.Errorf("GET /users?email=%q = %+v", " "+email, list)
+		}
+	}
+	// 暗号化して保存する場合も、大文字小文字の違いで別のユーザーにならない
+	s = newTestServer(t, map[string]string{"EMAIL_NORMALIZE": "true", "EMAIL_ENC_KEY": testEmailKey})
+	createUser(t, s, "Bob", 30, "Bob@Example.com")
+	expectStatus(t, request(s, http.MethodGet, "/users/by-email/bob@example.COM", ""), http.StatusOK)
+}
+
+func TestSortParams(t *testing.T) {
+	namesOf := func(t *testing.T, s *server, query string, want int) string {
+		t.Helper()
+		rec := request(s, http.MethodGet, "/users"+query, "")
+		expectStatus(t, rec, want)
+		if want != http.StatusOK {
+			return rec.Body.String()
+		}
+		var list []User
+		decode(t, rec, &list)
+		var names []string
+		for _, u := range list {
+			names = append(names, u.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	setup := func(t *testing.T, env map[string]string) *server {
+		t.Helper()
+		s := newTestServer(t, env)
+		for i, name := range []string{"Charlie", "Alice", "Bob"} {
+			createUser(t, s, name, 30-i, "")
+		}
+		return s
+	}
+
+	t.Run("lenient", func(t *testing.T) {
+		s := setup(t, nil)
+		tests := map[string]string{
+			"?sort=name":              "Alice,Bob,Charlie",
+			"?sort=age&order=desc":    "Charlie,Alice,Bob",
+			"?sort=password":          "Charlie,Alice,Bob",
+			"?sort=name&order=upside": "Alice,Bob,Charlie",
+		}
+		for query, want := range tests {
+			if got := namesOf(t, s, query, http.StatusOK); got != want {
+				t.Errorf("GET /users%s = %s, want %s", query, got, want)
+			}
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		s := setup(t, map[string]string{"STRICT_SORT": "true"})
+		if got := namesOf(t, s, "?sort=name&order=desc", http.StatusOK); got != "Charlie,Bob,Alice" {
+			t.Errorf("GET /users?sort=name&order=desc = %s", got)
+		}
+		body := namesOf(t, s, "?sort=password", http.StatusBadRequest)
+		if !strings.Contains(body, "invalid sort field: allowed values are id, name, age, created_at, updated_at") {
+			t.Errorf("body = %s", body)
+		}
+		namesOf(t, s, "?order=upside", http.StatusBadRequest)
+	})
+}
+
+func TestParseAgeList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"25,30,35", "[25 30 35]"},
+		{" 25, abc,30,,25, 3.5", "[25 30]"},
+	}
+	for _, tt := range tests {
+		ages, err := parseAgeList(tt.in)
+		if err != nil || fmt.Sprint(ages) != tt.want {
+			t.Errorf("parseAgeList(%q) = %v, %v, want %s", tt.in, ages, err, tt.want)
+		}
+	}
+	many := make([]string, maxAgesPerQuery+1)
+	for i := range many {
+		many[i] = strconv.Itoa(i)
+	}
+	for _, in := range []string{"", "abc,x", strings.Join(many, ",")} {
+		if _, err := parseAgeList(in); err == nil {
+			t.Errorf("parseAgeList(%.20q) succeeded", in)
+		}
+	}
+}
+
+func TestUsersByAges(t *testing.T) {
+	s := newTestServer(t, nil)
+	for i, age := range []int{25, 30, 35, 30, 40} {
+		createUser(t, s, fmt.Sprintf("user%d", i), age, "")
+	}
+	expectStatus(t, request(s, http.MethodDelete, "/users/4", ""), http.StatusNoContent)
+
+	tests := []struct {
+		query string
+		want  string
+		total int
+	}{
+		{"?ages=30,40,x", "user1,user4", 2},
+		{"?ages=25,30,35&limit=2", "user0,user1", 3},
+		{"?ages=25,30,35&limit=2&offset=2", "user2", 3},
+		{"?ages=99", "", 0},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users/by-ages"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		var page struct {
+			Users         []User `json:"users"`
+			FilteredTotal int    `json:"filtered_total"`
+		}
+		decode(t, rec, &page)
+		var names []string
+		for _, u := range page.Users {
+			names = append(names, u.Name)
+		}
+		if strings.Join(names, ",") != tt.want || page.FilteredTotal != tt.total {
+			t.Errorf("by-ages%s = %v (filtered_total %d), want %s (%d)", tt.query, names, page.FilteredTotal, tt.want, tt.total)
+		}
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/by-ages?ages=x", ""), http.StatusBadRequest)
+}
+
+func TestCreateStatus(t *testing.T) {
+	tests := []struct {
+		name, method, target, body string
+		headers                    []string
+		status                     int
+		location                   string
+	}{
+		{"user", http.MethodPost, "/users", `{"name":"Taro","age":30,"email":"taro@example.com"}`, nil, http.StatusCreated, "/users/2"},
+		{"user from a form", http.MethodPost, "/users", "name=Hanako&age=25", []string{echo.HeaderContentType, echo.MIMEApplicationForm}, http.StatusCreated, "/users/2"},
+		{"upsert created", http.MethodPost, "/users/bulk-upsert", `[{"name":"Jiro","age":20,"email":"jiro@example.com"},{"name":"Existing","age":41,"email":"existing@example.com"}]`, nil, http.StatusCreated, ""},
+		{"upsert updated only", http.MethodPost, "/users/bulk-upsert", `[{"name":"Existing","age":41,"email":"existing@example.com"}]`, nil, http.StatusOK, ""},
+		{"upsert partial", http.MethodPost, "/users/bulk-upsert?partial=true", `[{"name":"Jiro","age":20,"email":"jiro@example.com"},{"name":"","age":20}]`, nil, http.StatusMultiStatus, ""},
+		{"post", http.MethodPost, "/users/1/posts", "title=first", []string{echo.HeaderContentType, echo.MIMEApplicationForm}, http.StatusCreated, ""},
+	}
+	for _, legacy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("legacy=%v", legacy), func(t *testing.T) {
+			for _, tt := range tests {
+				s := newAdminTestServer(t, map[string]string{"LEGACY_CREATE_STATUS": strconv.FormatBool(legacy)})
+				if rec := request(s, http.MethodPost, "/users", `{"name":"Existing","age":40,"email":"existing@example.com"}`); rec.Code >= 300 {
+					t.Fatalf("create: status = %d: %s", rec.Code, rec.Body.String())
+				}
+				status, location := tt.status, tt.location
+				// 以前の動作では、ユーザーの登録も200で Location を付けない（投稿は以前から201）
+				if legacy && status == http.StatusCreated && tt.target != "/users/1/posts" {
+					status, location = http.StatusOK, ""
+				}
+				for _, replay := range []bool{false, true} {
+					// Idempotency-Key で再送しても、同じステータスと Location を返す
+					rec := request(s, tt.method, tt.target, tt.body, append([]string{idempotencyKeyHeader, "key-1"}, tt.headers...)...)
+					if rec.Code != status || rec.Header().Get(echo.HeaderLocation) != location {
+						t.Errorf("%s (replay %v): status %d, Location %q, want %d %q: %s",
+							tt.name, replay, rec.Code, rec.Header().Get(echo.HeaderLocation), status, location, rec.Body.String())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNewServerCleansUpOnError(t *testing.T) {
+	// 起動したワーカーと開いたDBを後片付けすれば、ゴルーチンは起動前の数に戻る
+	before := runtime.NumGoroutine()
+	t.Setenv("LIST_CACHE_INTERVAL_S", "60")
+	t.Setenv("WEBHOOK_URL", "http://127.0.0.1:1/hook")
+	t.Setenv("PURGE_RETENTION_DAYS", "30")
+	t.Setenv("PURGE_INTERVAL_S", "0")
+	if _, err := newServer(loadConfig(), filepath.Join(t.TempDir(), "test.db")); err == nil {
+		t.Fatal("newServer accepted PURGE_INTERVAL_S=0")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running after a failed startup (%d before)", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseAfterShutdownTimeout(t *testing.T) {
+	s, err := newServer(loadConfig(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	s.workers.Go("stuck", func(ctx context.Context) { <-release })
+
+	// ワーカーが止まらなくても、DBは閉じてからエラーを返す
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.close(ctx); err == nil {
+		t.Error("close succeeded while a worker was still running")
+	}
+	for _, db := range []*sql.DB{s.db, s.snapshotDB} {
+		if err := db.Ping(); err == nil {
+			t.Error("database is still open after close")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maintenanceWindow はメンテナンスの予定時間帯です。この間は /healthz 以外のすべてのリクエストに503を返します。
+type maintenanceWindow struct {
+	start, end time.Time
+	now        func() time.Time
+}
+
+// parseMaintenanceWindow は RFC 3339 形式の開始・終了日時から maintenanceWindow を作ります。
+// どちらも空の場合は nil を返します（メンテナンスなし）。
+func parseMaintenanceWindow(start, end string) (*maintenanceWindow, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	if start == "" || end == "" {
+		return nil, errors.New("MAINTENANCE_START and MAINTENANCE_END must be set together")
+	}
+	s, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return nil, errors.New("MAINTENANCE_START must be RFC 3339: " + err.Error())
+	}
+	e, err := time.Parse(time.RFC3339, end)
+	if err != nil {
+		return nil, errors.New("MAINTENANCE_END must be RFC 3339: " + err.Error())
+	}
+	if !e.After(s) {
+		return nil, errors.New("MAINTENANCE_END must be after MAINTENANCE_START")
+	}
+	return &maintenanceWindow{start: s, end: e, now: time.Now}, nil
+}
+
+// active は現在がメンテナンス中かどうかを返します（開始を含み、終了を含みません）。
+func (w *maintenanceWindow) active() bool {
+	now := w.now()
+	return !now.Before(w.start) && now.Before(w.end)
+}
+
+func (w *maintenanceWindow) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// ロードバランサーからの死活監視は止めない
+			if c.Path() == "/healthz" || !w.active() {
+				return next(c)
+			}
+			// メンテナンスの終了までの秒数（切り上げ）
+			wait := int(math.Ceil(w.end.Sub(w.now()).Seconds()))
+			setRetryAfter(c, wait)
+			return echo.NewHTTPError(http.StatusServiceUnavailable,
+				"under maintenance until "+w.end.UTC().Format(time.RFC3339))
+		}
+	}
+}
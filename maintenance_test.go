@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	w, err := parseMaintenanceWindow("2024-01-02T03:00:00Z", "2024-01-02T04:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(standardHeaders(time.Now), w.middleware())
+	e.GET("/users", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	e.GET("/healthz", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	tests := []struct {
+		now        string
+		want       int
+		retryAfter string
+	}{
+		{"2024-01-02T02:59:59Z", http.StatusOK, ""},
+		{"2024-01-02T03:00:00Z", http.StatusServiceUnavailable, "3600"},
+		{"2024-01-02T03:59:59.5Z", http.StatusServiceUnavailable, "1"},
+		{"2024-01-02T04:00:00Z", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		now, _ := time.Parse(time.RFC3339, tt.now)
+		w.now = func() time.Time { return now }
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users", nil))
+		if rec.Code != tt.want || rec.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("at %s: status = %d, Retry-After = %q", tt.now, rec.Code, rec.Header().Get("Retry-After"))
+		}
+		// 死活監視はメンテナンス中も通す
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		expectStatus(t, rec, http.StatusOK)
+	}
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	if w, err := parseMaintenanceWindow("", ""); w != nil || err != nil {
+		t.Errorf("empty window = %v, %v", w, err)
+	}
+	for _, tt := range [][2]string{
+		{"2024-01-02T03:00:00Z", ""},
+		{"tomorrow", "2024-01-02T04:00:00Z"},
+		{"2024-01-02T04:00:00Z", "2024-01-02T03:00:00Z"},
+	} {
+		if _, err := parseMaintenanceWindow(tt[0], tt[1]); err == nil {
+			t.Errorf("parseMaintenanceWindow(%q, %q) succeeded", tt[0], tt[1])
+		}
+	}
+}
+
+func TestMaintenanceServer(t *testing.T) {
+	now := time.Now()
+	s := newTestServer(t, map[string]string{
+		"MAINTENANCE_START": now.Add(-time.Minute).Format(time.RFC3339),
+		"MAINTENANCE_END":   now.Add(time.Hour).Format(time.RFC3339),
+	})
+	expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusServiceUnavailable)
+	expectStatus(t, request(s, http.MethodPost, "/users", `{"name":"Taro","age":30}`), http.StatusServiceUnavailable)
+	expectStatus(t, request(s, http.MethodGet, "/healthz", ""), http.StatusOK)
+}
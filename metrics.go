@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// metric は /metrics に出力する1つの値です。
+type metric struct {
+	name, typ, help string
+	value           interface{}
+}
+
+// metricsHandler は再試行の予算と同時実行数の上限の状態を Prometheus のテキスト形式で返します。
+// budget と concurrency のうち nil のものは出力しません。
+func metricsHandler(budget *retryBudget, concurrency *concurrencyCap) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var metrics []metric
+		if budget != nil {
+			s := budget.stats()
+			metrics = append(metrics,
+				metric{"retry_budget_percent", "gauge", "Retries allowed per client as a percentage of its requests.", s.Percent},
+				metric{"retry_budget_min", "gauge", "Retries always allowed per client and window.", s.Min},
+				metric{"retry_budget_window_seconds", "gauge", "Length of the retry budget window.", s.WindowSecs},
+				metric{"retry_budget_clients", "gauge", "Clients tracked in the current window.", s.Clients},
+				metric{"retry_budget_exhausted_clients", "gauge", "Clients that have used up their retry budget.", s.Exhausted},
+				metric{"retry_budget_retries_total", "counter", "Retries allowed.", s.Retries},
+				metric{"retry_budget_rejected_total", "counter", "Retries rejected with 429.", s.Rejected},
+			)
+		}
+		if concurrency != nil {
+			inFlight, queued := concurrency.sem.Stats()
+			metrics = append(metrics,
+				metric{"http_max_concurrent_requests", "gauge", "Maximum number of requests handled at the same time.", concurrency.max},
+				metric{"http_inflight_requests", "gauge", "Requests being handled now.", inFlight},
+				metric{"http_queued_requests", "gauge", "Requests waiting for a free slot.", queued},
+				metric{"http_overload_rejected_total", "counter", "Requests rejected with 503 because the queue was full or the wait timed out.", concurrency.rejected.Load()},
+			)
+		}
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+		res.WriteHeader(http.StatusOK)
+		for _, m := range metrics {
+			if _, err := fmt.Fprintf(res, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.typ, m.name, m.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// contentTypeMiddleware はボディを持つリクエストのContent-Typeを検証します。
+// メディアタイプのパラメータ（charsetなど）も解析し、不正な場合は415を返します。
+// strictCharset がtrueの場合、application/jsonはcharset未指定かutf-8のみを受け付けます。
+func contentTypeMiddleware(strictCharset bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if !hasBody(c) {
+				return next(c)
+			}
+
+			ctype := req.Header.Get(echo.HeaderContentType)
+			if ctype == "" {
+				return next(c)
+			}
+			mediaType, params, err := mime.ParseMediaType(ctype)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnsupportedMediaType, "invalid Content-Type")
+			}
+
+			if strictCharset && mediaType == echo.MIMEApplicationJSON {
+				// JSONはUTF-8でエンコードされている必要があります（RFC 8259）。
+				if charset, ok := params["charset"]; ok && !isUTF8Charset(charset) {
+					return echo.NewHTTPError(http.StatusUnsupportedMediaType, "unsupported charset: "+charset)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// multipartMiddleware は multipart/form-data のボディを先に解析します。
+// maxMemory を超える部分（主にファイル）はメモリに置かず一時ファイルに書き出します。
+// 解析済みのフォームは c.FormValue や c.Bind からそのまま使えます。
+func multipartMiddleware(maxMemory int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if !hasBody(c) || !strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+				return next(c)
+			}
+			if err := req.ParseMultipartForm(maxMemory); err != nil {
+				// ボディの上限（BodyLimit）を超えた場合は、BodyLimit が返す413をそのまま返す
+				var he *echo.HTTPError
+				if errors.As(err, &he) {
+					return he
+				}
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid multipart body").SetInternal(err)
+			}
+			return next(c)
+		}
+	}
+}
+
+// queryStringMiddleware はクエリ文字列のパーセントエンコーディングが壊れている場合（?name=% など）に400を返します。
+// echo の c.QueryParam は解析できない値を黙って捨てるため、そのままでは条件が無視されたまま処理されてしまいます。
+func queryStringMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, err := url.ParseQuery(c.Request().URL.RawQuery); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "malformed query string").SetInternal(err)
+			}
+			return next(c)
+		}
+	}
+}
+
+// deleteBodyRoutes はボディで条件を受け取る DELETE のルートです。STRICT_BODYLESS_METHODS でも拒否しません。
+var deleteBodyRoutes = map[string]bool{
+	"/users": true,
+}
+
+// bodylessMethodMiddleware は、ボディを持たないはずの GET/HEAD/DELETE にボディが付いたリクエストの扱いを決めます。
+// strict がfalse（既定）の場合はこれまで通りボディを読まずに無視し、trueの場合は400を返します。
+// 無視するとクライアントはボディの条件が効いていないことに気付けないため、クライアントの不具合を見つけたいときに使います。
+// ただし、DELETE /users のように deleteBodyRoutes にあるルートはボディを使うので拒否しません。
+func bodylessMethodMiddleware(strict bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if !strict || req.ContentLength == 0 {
+				return next(c)
+			}
+			switch req.Method {
+			case http.MethodGet, http.MethodHead:
+				return echo.NewHTTPError(http.StatusBadRequest, req.Method+" requests must not have a body")
+			case http.MethodDelete:
+				if deleteBodyRoutes[c.Path()] {
+					return next(c)
+				}
+				return echo.NewHTTPError(http.StatusBadRequest, req.Method+" requests must not have a body")
+			}
+			return next(c)
+		}
+	}
+}
+
+// hasBody はリクエストにボディが含まれるかどうかを返します。
+// DELETE は、ボディで条件を受け取る deleteBodyRoutes のルートだけを対象にします。
+func hasBody(c echo.Context) bool {
+	req := c.Request()
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return req.ContentLength != 0
+	case http.MethodDelete:
+		return deleteBodyRoutes[c.Path()] && req.ContentLength != 0
+	}
+	return false
+}
+
+func isUTF8Charset(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8":
+		return true
+	}
+	return false
+}
+
+// caseInsensitivePaths はパスの大文字小文字を区別せずにルートに一致させる Pre ミドルウェアを返します（/Users → /users）。
+// パラメータ（:id や :email）の値は大文字小文字を区別するものがあるので、全体を小文字にはせず、
+// 登録されているルートの固定部分（users や by-email など）と大文字小文字を無視して一致するセグメントだけを小文字にします。
+// そのため、パラメータの値が固定部分の名前と同じ場合（/users/by-email/USERS など）はその値も小文字になります。
+func caseInsensitivePaths(e *echo.Echo) echo.MiddlewareFunc {
+	var once sync.Once
+	static := map[string]bool{}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// ルートは Pre の登録より後に追加されるので、最初のリクエストで固定部分を集める
+			once.Do(func() {
+				for _, r := range e.Routes() {
+					for _, seg := range strings.Split(r.Path, "/") {
+						if seg != "" && seg[0] != ':' && seg[0] != '*' {
+							static[strings.ToLower(seg)] = true
+						}
+					}
+				}
+			})
+			u := c.Request().URL
+			u.Path = lowerStaticSegments(u.Path, static)
+			if u.RawPath != "" {
+				u.RawPath = lowerStaticSegments(u.RawPath, static)
+			}
+			return next(c)
+		}
+	}
+}
+
+func lowerStaticSegments(path string, static map[string]bool) string {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if lower := strings.ToLower(seg); lower != seg && static[lower] {
+			segs[i] = lower
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// collapseSlashes はパスの連続したスラッシュを1つにまとめる Pre ミドルウェアを返します（/users//5 → /users/5）。
+// 空のセグメントがあるとルートに一致せず、理由の分かりにくい404になるためです。
+// redirectCode が0でない場合は書き換えずに、まとめたURLへそのステータスでリダイレクトします（TRAILING_SLASH_REDIRECT と同じ扱い）。
+func collapseSlashes(redirectCode int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			u := c.Request().URL
+			if !strings.Contains(u.Path, "//") {
+				return next(c)
+			}
+			path, rawPath := collapsePath(u.Path), collapsePath(u.RawPath)
+			if redirectCode != 0 {
+				target := path
+				if rawPath != "" {
+					target = rawPath
+				}
+				if u.RawQuery != "" {
+					target += "?" + u.RawQuery
+				}
+				return c.Redirect(redirectCode, target)
+			}
+			u.Path, u.RawPath = path, rawPath
+			return next(c)
+		}
+	}
+}
+
+func collapsePath(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	return path
+}
+
+// malformedUserPaths は /users より下のパスで、メソッドに関係なくどのルートの形にも一致しないもの
+// （/users/5/extra のような余分なセグメントなど）を、404ではなく400にするミドルウェアを返します。
+// ルートの形には一致してメソッドだけが違う場合は、これまで通り405になります。
+// ルーターと同じく、エスケープされたパス（RawPath）があればそちらで判定するので、
+// /users/by-email/a%2Fb の %2F はセグメントの区切りになりません。
+func malformedUserPaths(e *echo.Echo) echo.MiddlewareFunc {
+	var once sync.Once
+	var patterns [][]string
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			u := c.Request().URL
+			path := u.Path
+			if u.RawPath != "" {
+				path = u.RawPath
+			}
+			if !strings.HasPrefix(path, "/users/") {
+				return next(c)
+			}
+			once.Do(func() {
+				for _, r := range e.Routes() {
+					if strings.HasPrefix(r.Path, "/users") {
+						patterns = append(patterns, strings.Split(r.Path, "/"))
+					}
+				}
+			})
+			segs := strings.Split(path, "/")
+			for _, pattern := range patterns {
+				if matchSegments(pattern, segs) {
+					return next(c)
+				}
+			}
+			return echo.NewHTTPError(http.StatusBadRequest, "malformed user path: "+path)
+		}
+	}
+}
+
+// matchSegments はパスのセグメントがルートの形に一致するかどうかを返します。
+// :name は空でない1つのセグメントに、* は残りのすべてに一致します。
+func matchSegments(pattern, segs []string) bool {
+	for i, p := range pattern {
+		if p == "*" {
+			return true
+		}
+		if i >= len(segs) {
+			return false
+		}
+		switch {
+		case strings.HasPrefix(p, ":"):
+			if segs[i] == "" {
+				return false
+			}
+		case p != segs[i]:
+			return false
+		}
+	}
+	return len(pattern) == len(segs)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestMalformedUserPaths(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "a/b@example.com")
+	createUser(t, s, "Hanako", 25, "100%@example.com")
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/users/1", http.StatusOK},
+		{http.MethodGet, "/users/1/extra", http.StatusBadRequest},
+		{http.MethodGet, "/users/1/posts/extra", http.StatusBadRequest},
+		{http.MethodDelete, "/users/1/posts", http.StatusMethodNotAllowed},
+		// エスケープされたスラッシュはセグメントの区切りではない
+		{http.MethodGet, "/users/by-email/a%2Fb@example.com", http.StatusOK},
+		{http.MethodGet, "/users/by-email/x%2Fy@example.com", http.StatusNotFound},
+		{http.MethodGet, "/users/by-email/100%25@example.com", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := request(s, tt.method, tt.path, ""); rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body.String())
+		}
+	}
+}
+
+func TestJSONCharset(t *testing.T) {
+	body := `{"name":"Taro","age":30,"email":"taro@example.com"}`
+	tests := []struct {
+		strict      string
+		contentType string
+		want        int
+	}{
+		{"", "application/json", http.StatusCreated},
+		{"", "application/json; charset=utf-8", http.StatusCreated},
+		{"", "application/json; charset=UTF-8", http.StatusCreated},
+		{"", "application/json;charset=utf8", http.StatusCreated},
+		{"", `application/json; charset="utf-8"`, http.StatusCreated},
+		{"", "application/json; charset=ascii-7", http.StatusUnsupportedMediaType},
+		{"", "application/json; charset=iso-8859-1", http.StatusUnsupportedMediaType},
+		{"", "application/json; charset", http.StatusUnsupportedMediaType},
+		{"false", "application/json; charset=ascii-7", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strict+" "+tt.contentType, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"STRICT_JSON_CHARSET": tt.strict})
+			rec := request(s, http.MethodPost, "/users", body, "Content-Type", tt.contentType)
+			expectStatus(t, rec, tt.want)
+		})
+	}
+}
+
+func TestStrictJSONBody(t *testing.T) {
+	form := []string{echo.HeaderContentType, echo.MIMEApplicationForm}
+	formBody := "name=Taro&age=30&email=taro%40example.com"
+	jsonBody := `{"name":"Taro","age":30,"email":"taro@example.com"}`
+
+	t.Run("strict", func(t *testing.T) {
+		s := newTestServer(t, map[string]string{"STRICT_JSON_BODY": "true"})
+		u := createUser(t, s, "Hanako", 25, "hanako@example.com")
+		path := fmt.Sprintf("/users/%d", u.ID)
+		for _, method := range []string{http.MethodPost, http.MethodPut} {
+			target := "/users"
+			if method == http.MethodPut {
+				target = path
+			}
+			rec := request(s, method, target, formBody, form...)
+			expectStatus(t, rec, http.StatusUnsupportedMediaType)
+			var res errorResponse
+			decode(t, rec, &res)
+			if res.Message != "request body must be application/json" {
+				t.Errorf("%s %s: message = %q", method, target, res.Message)
+			}
+		}
+		// JSONは charset 付きでも受け付ける
+		expectStatus(t, request(s, http.MethodPost, "/users", jsonBody, echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8), http.StatusCreated)
+		expectStatus(t, request(s, http.MethodPut, path, `{"name":"Hanako","age":26,"email":"hanako@example.com"}`), http.StatusOK)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		s := newTestServer(t, nil)
+		rec := request(s, http.MethodPost, "/users", formBody, form...)
+		expectStatus(t, rec, http.StatusCreated)
+		var u User
+		decode(t, rec, &u)
+		if u.Name != "Taro" || u.Age != 30 || u.Email != "taro@example.com" {
+			t.Errorf("POST /users (form) = %+v", u)
+		}
+		rec = request(s, http.MethodPut, fmt.Sprintf("/users/%d", u.ID), "name=Taro&age=31&email=taro%40example.com", form...)
+		expectStatus(t, rec, http.StatusOK)
+		decode(t, rec, &u)
+		if u.Age != 31 {
+			t.Errorf("PUT /users/%d (form) = %+v", u.ID, u)
+		}
+	})
+}
+
+func TestBodylessMethods(t *testing.T) {
+	body := `{"name":"Hanako"}`
+	tests := []struct {
+		strict string
+		method string
+		path   string
+		want   int
+	}{
+		// 既定ではボディを読まずに無視する
+		{"", http.MethodGet, "/users/1", http.StatusOK},
+		{"", http.MethodGet, "/users", http.StatusOK},
+		{"", http.MethodDelete, "/users/1", http.StatusNoContent},
+		{"true", http.MethodGet, "/users/1", http.StatusBadRequest},
+		{"true", http.MethodGet, "/users", http.StatusBadRequest},
+		{"true", http.MethodDelete, "/users/1", http.StatusBadRequest},
+		// DELETE /users はボディで条件を受け取るので拒否しない
+		{"true", http.MethodDelete, "/users?confirm=true", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("STRICT_BODYLESS_METHODS=%s/%s %s", tt.strict, tt.method, tt.path), func(t *testing.T) {
+			s := newAdminTestServer(t, map[string]string{"STRICT_BODYLESS_METHODS": tt.strict})
+			createUser(t, s, "Taro", 30, "taro@example.com")
+			createUser(t, s, "Hanako", 25, "hanako@example.com")
+			rec := request(s, tt.method, tt.path, body)
+			expectStatus(t, rec, tt.want)
+			if tt.want == http.StatusBadRequest {
+				var res errorResponse
+				decode(t, rec, &res)
+				if want := tt.method + " requests must not have a body"; res.Message != want {
+					t.Errorf("message = %q, want %q", res.Message, want)
+				}
+				return
+			}
+			// 無視した場合、GET /users はボディの条件で絞り込まない
+			if tt.method == http.MethodGet && tt.path == "/users" {
+				var users []User
+				decode(t, rec, &users)
+				if len(users) != 2 {
+					t.Errorf("GET /users with a body = %+v, want both users", users)
+				}
+			}
+		})
+	}
+
+	// ボディのない GET はそのまま通す
+	s := newTestServer(t, map[string]string{"STRICT_BODYLESS_METHODS": "true"})
+	expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusOK)
+}
+
+func TestMalformedQueryString(t *testing.T) {
+	s := newTestServer(t, nil)
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	for _, target := range []string{
+		"/users?name=%zz",
+		"/users?name=%",
+		"/users?name=Taro%2",
+		"/users?name=Taro;age=30",
+		"/users/1?fields=%zz",
+	} {
+		rec := request(s, http.MethodGet, target, "")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status = %d, want 400: %s", target, rec.Code, rec.Body.String())
+			continue
+		}
+		var res errorResponse
+		decode(t, rec, &res)
+		if res.Message != "malformed query string" {
+			t.Errorf("GET %s: message = %q", target, res.Message)
+		}
+	}
+
+	// 書き込みのリクエストも処理せずに断る
+	expectStatus(t, request(s, http.MethodPost, "/users?x=%", `{"name":"Hanako","age":25}`), http.StatusBadRequest)
+	rec := request(s, http.MethodGet, "/users?name=Hanako", "")
+	expectStatus(t, rec, http.StatusOK)
+	var users []User
+	decode(t, rec, &users)
+	if len(users) != 0 {
+		t.Errorf("POST with a malformed query created %+v", users)
+	}
+
+	// 正しくエンコードされた値はそのまま使う
+	rec = request(s, http.MethodGet, "/users?name=T%61ro", "")
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &users)
+	if len(users) != 1 || users[0].Name != "Taro" {
+		t.Errorf("GET /users?name=T%%61ro = %+v", users)
+	}
+}
+
+func TestCaseInsensitivePaths(t *testing.T) {
+	tests := []struct {
+		enabled      string
+		method, path string
+		want         int
+	}{
+		{"true", http.MethodGet, "/Users", http.StatusOK},
+		{"true", http.MethodGet, "/USERS/1", http.StatusOK},
+		{"true", http.MethodGet, "/Users/1/Posts", http.StatusOK},
+		{"true", http.MethodPut, "/Users/1", http.StatusOK},
+		{"true", http.MethodGet, "/Users/By-Email/Foo@x.com", http.StatusOK},
+		{"true", http.MethodGet, "/USERS/BY-EMAIL/Foo%2FBar@x.com", http.StatusOK},
+		{"false", http.MethodGet, "/users", http.StatusOK},
+		{"false", http.MethodGet, "/Users", http.StatusNotFound},
+		{"false", http.MethodGet, "/USERS/1", http.StatusNotFound},
+		{"false", http.MethodGet, "/users/By-Email/Foo@x.com", http.StatusBadRequest},
+		{"false", http.MethodGet, "/users/by-email/Foo@x.com", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("CASE_INSENSITIVE_PATHS=%s/%s %s", tt.enabled, tt.method, tt.path), func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"CASE_INSENSITIVE_PATHS": tt.enabled})
+			createUser(t, s, "Taro", 30, "Foo@x.com")
+			createUser(t, s, "Hanako", 25, "Foo/Bar@x.com")
+			body := ""
+			if tt.method == http.MethodPut {
+				body = `{"name":"Taro","age":31,"email":"Foo@x.com"}`
+			}
+			expectStatus(t, request(s, tt.method, tt.path, body), tt.want)
+		})
+	}
+
+	// パラメータの値は大文字小文字を区別したまま渡す（メールアドレスの検索は大文字小文字を区別しないので、値をそのまま返すルートで確かめる）
+	s := newTestServer(t, map[string]string{"CASE_INSENSITIVE_PATHS": "true"})
+	s.e.GET("/users/by-email/:email/echo", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Param("email"))
+	})
+	for path, want := range map[string]string{
+		"/Users/By-Email/Foo@x.com/Echo":       "Foo@x.com",
+		"/USERS/by-email/Foo%2FBar@x.com/ECHO": "Foo%2FBar@x.com",
+	} {
+		rec := request(s, http.MethodGet, path, "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := rec.Body.String(); got != want {
+			t.Errorf("GET %s: email = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// multipartBody は fields と、size バイトのファイル（size が0なら省く）を含む multipart/form-data のボディを作ります。
+func multipartBody(t *testing.T, fields map[string]string, size int) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size > 0 {
+		f, err := w.CreateFormFile("avatar", "avatar.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), w.FormDataContentType()
+}
+
+func TestMultipartForm(t *testing.T) {
+	fields := map[string]string{"name": "Taro", "age": "30", "email": "taro@example.com"}
+
+	t.Run("fields", func(t *testing.T) {
+		s := newTestServer(t, nil)
+		body, ctype := multipartBody(t, fields, 0)
+		rec := request(s, http.MethodPost, "/users", body, echo.HeaderContentType, ctype)
+		expectStatus(t, rec, http.StatusCreated)
+		var u User
+		decode(t, rec, &u)
+		if u.Name != "Taro" || u.Age != 30 || u.Email != "taro@example.com" {
+			t.Errorf("POST /users (multipart) = %+v", u)
+		}
+
+		body, ctype = multipartBody(t, map[string]string{"name": "Taro", "age": "31", "email": "taro@example.com"}, 0)
+		rec = request(s, http.MethodPut, fmt.Sprintf("/users/%d", u.ID), body, echo.HeaderContentType, ctype)
+		expectStatus(t, rec, http.StatusOK)
+		decode(t, rec, &u)
+		if u.Age != 31 {
+			t.Errorf("PUT /users/%d (multipart) = %+v", u.ID, u)
+		}
+	})
+
+	t.Run("file larger than MULTIPART_MAX_MEMORY_KB", func(t *testing.T) {
+		// メモリに置けない分は一時ファイルに書き出すので、ボディの上限以内なら受け付ける
+		s := newTestServer(t, map[string]string{"MULTIPART_MAX_MEMORY_KB": "1"})
+		body, ctype := multipartBody(t, fields, 64<<10)
+		expectStatus(t, request(s, http.MethodPost, "/users", body, echo.HeaderContentType, ctype), http.StatusCreated)
+	})
+
+	t.Run("body larger than BODY_LIMIT", func(t *testing.T) {
+		s := newTestServer(t, map[string]string{"BODY_LIMIT": "4K"})
+		body, ctype := multipartBody(t, fields, 8<<10)
+		expectStatus(t, request(s, http.MethodPost, "/users", body, echo.HeaderContentType, ctype), http.StatusRequestEntityTooLarge)
+
+		// Content-Length がない（chunked の）場合も、解析中に上限を超えた時点で413にする
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, ctype)
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, req)
+		expectStatus(t, rec, http.StatusRequestEntityTooLarge)
+
+		rec = request(s, http.MethodGet, "/users", "")
+		var users []User
+		decode(t, rec, &users)
+		if len(users) != 0 {
+			t.Errorf("rejected multipart bodies created %+v", users)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		s := newTestServer(t, nil)
+		body, ctype := multipartBody(t, fields, 0)
+		// 閉じの境界がないボディ
+		body = body[:strings.LastIndex(body, "--")]
+		rec := request(s, http.MethodPost, "/users", body, echo.HeaderContentType, ctype)
+		expectStatus(t, rec, http.StatusBadRequest)
+		var res errorResponse
+		decode(t, rec, &res)
+		if res.Message != "invalid multipart body" {
+			t.Errorf("message = %q", res.Message)
+		}
+	})
+}
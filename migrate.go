@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migrations はスキーマ変更の一覧です。PRAGMA user_version に適用済みの件数を記録し、
+// 起動時に未適用のものだけを順番に実行します。追加するときは必ず末尾に追記してください。
+var migrations = []string{
+	// 1: usersテーブルの作成
+	`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		age INTEGER NOT NULL
+	)`,
+	// 2: emailカラムの追加
+	`ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT ''`,
+	// 3: emailでの検索用に、大文字小文字を区別しない部分インデックスを作成
+	`CREATE INDEX IF NOT EXISTS idx_users_email ON users(email COLLATE NOCASE) WHERE email <> ''`,
+	// 4: サンプリングしたリクエストを記録するテーブルの作成
+	`CREATE TABLE IF NOT EXISTS requests_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TEXT NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		latency_ms REAL NOT NULL
+	)`,
+	// 5: 作成日時と更新日時の追加。既存の行にはマイグレーション時の日時を設定
+	`ALTER TABLE users ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
+	UPDATE users SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now'), updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')`,
+	// 6: 論理削除用の削除日時の追加（NULLの場合は削除されていない）
+	`ALTER TABLE users ADD COLUMN deleted_at TEXT`,
+	// 7: ユーザーの投稿テーブルの作成
+	`CREATE TABLE IF NOT EXISTS posts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		title TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_posts_user_id ON posts(user_id)`,
+	// 8: Idempotency-Key のレスポンスを保存するテーブルの作成（IDEMPOTENCY_STORE=db の場合に使用）
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		body BLOB NOT NULL,
+		expires_at TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at)`,
+	// 9: ユーザーの状態（active/suspended）の追加。削除済みは deleted_at で表すため、ここには保存しない
+	`ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT 'active'`,
+	// 10: 登録・最後に更新したAPIキーのラベル（認証が無効な場合や、既存の行は空文字）
+	`ALTER TABLE users ADD COLUMN created_by TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN updated_by TEXT NOT NULL DEFAULT ''`,
+	// 11: 匿名化した日時（POST /admin/anonymize）
+	`ALTER TABLE users ADD COLUMN anonymized_at TEXT`,
+	// 12: Idempotency-Key で再送されたリクエストに返す Location ヘッダー（既存の行は空文字）
+	`ALTER TABLE idempotency_keys ADD COLUMN location TEXT NOT NULL DEFAULT ''`,
+}
+
+// migrate は未適用のマイグレーションを1つのトランザクションで実行します。
+// 複数のインスタンスが同じDBで同時に起動しても競合しないよう、BEGIN IMMEDIATE で先に書き込みロックを取得し、
+// ロックを取得してからスキーマバージョンを読み直します。後から来たインスタンスはロックが解放されるまで待ち、
+// 適用済みのマイグレーションは実行しません。
+func migrate(db *sql.DB) (err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// 他のインスタンスのマイグレーションが終わるまで待つ時間
+	if _, err := conn.ExecContext(ctx, "PRAGMA busy_timeout = 30000"); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+
+	// 現在のスキーマバージョンを取得
+	var version int
+	if err := conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= len(migrations) {
+		_, err := conn.ExecContext(ctx, "COMMIT")
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if _, err := conn.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	// PRAGMAはプレースホルダを使えないため、数値を埋め込みます。
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", len(migrations))); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+// applyNameIndex は名前検索用のインデックスを設定に応じて作成または削除します。
+// SQLiteのLIKEは大文字小文字を区別しないため、COLLATE NOCASE のインデックスでないと使われません。
+// また、インデックスが効くのは前方一致（LIKE 'x%'）だけで、部分一致（LIKE '%x%'）では使われません。
+func applyNameIndex(db *sql.DB, enabled bool) error {
+	query := "DROP INDEX IF EXISTS idx_users_name"
+	if enabled {
+		query = "CREATE INDEX IF NOT EXISTS idx_users_name ON users(name COLLATE NOCASE)"
+	}
+	_, err := db.Exec(query)
+	return err
+}
+
+// applyUniqueNames は名前の重複を禁止する一意インデックスを設定に応じて作成または削除します。
+// 名前は大文字小文字を区別せずに比較し、論理削除されたユーザーの名前は再び使えます。
+// 既に重複した名前がある場合は作成に失敗するので、先に重複を解消する必要があります。
+func applyUniqueNames(db *sql.DB, enabled bool) error {
+	query := "DROP INDEX IF EXISTS idx_users_name_unique"
+	if enabled {
+		query = "CREATE UNIQUE INDEX IF NOT EXISTS idx_users_name_unique ON users(name COLLATE NOCASE) WHERE deleted_at IS NULL"
+	}
+	if _, err := db.Exec(query); err != nil {
+		if enabled {
+			return fmt.Errorf("UNIQUE_NAMES: cannot create unique index (duplicate names exist?): %w", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// column はテーブルのカラム名と型です。
+type column struct {
+	Name string
+	Type string
+}
+
+// expectedUserColumns はコードが前提としているusersテーブルのカラムです。
+// マイグレーションでカラムを追加したときは、ここも更新してください。
+var expectedUserColumns = []column{
+	{"id", "INTEGER"},
+	{"name", "TEXT"},
+	{"age", "INTEGER"},
+	{"email", "TEXT"},
+	{"created_at", "TEXT"},
+	{"updated_at", "TEXT"},
+	{"deleted_at", "TEXT"},
+	{"status", "TEXT"},
+	{"created_by", "TEXT"},
+	{"updated_by", "TEXT"},
+	{"anonymized_at", "TEXT"},
+}
+
+// checkSchema は実際のusersテーブルのカラムを PRAGMA table_info で取得し、
+// expectedUserColumns と比べて不足や型の不一致があればエラーを返します。
+// マイグレーションされていないDBで起動し、実行時にScanエラーになるのを防ぎます。
+func checkSchema(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(users)")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	actual := map[string]string{}
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		actual[name] = strings.ToUpper(typ)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var diffs []string
+	for _, col := range expectedUserColumns {
+		typ, ok := actual[col.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("  missing column %q (expected %s)", col.Name, col.Type))
+		case typ != col.Type:
+			diffs = append(diffs, fmt.Sprintf("  column %q has type %s (expected %s)", col.Name, typ, col.Type))
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("users table does not match the expected schema:\n%s", strings.Join(diffs, "\n"))
+	}
+	return nil
+}
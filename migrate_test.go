@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSchemaDriftDetection(t *testing.T) {
+	// マイグレーション済みと記録されているのに、カラムが足りず型も違うDB
+	path := filepath.Join(t.TempDir(), "drift.db")
+	db, err := initDB(path, "immediate", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, age TEXT, email TEXT)",
+		"CREATE TABLE posts (id INTEGER PRIMARY KEY, user_id INTEGER, title TEXT)",
+		fmt.Sprintf("PRAGMA user_version = %d", len(migrations)),
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	err = checkSchemaOf(t, path)
+	if err == nil {
+		t.Fatal("checkSchema accepted a mismatched schema")
+	}
+	for _, want := range []string{`column "age" has type TEXT (expected INTEGER)`, `missing column "created_at"`, `missing column "status"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not contain %q:\n%v", want, err)
+		}
+	}
+
+	// SKIP_SCHEMA_CHECK=true の場合は確認せずに起動する
+	t.Setenv("SKIP_SCHEMA_CHECK", "true")
+	s, err := newServer(loadConfig(), path)
+	if err != nil {
+		t.Fatalf("newServer with SKIP_SCHEMA_CHECK: %v", err)
+	}
+	if err := s.close(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	// 正しくマイグレーションしたDBは通る
+	if err := checkSchemaOf(t, filepath.Join(t.TempDir(), "ok.db")); err != nil {
+		t.Errorf("checkSchema after migrate: %v", err)
+	}
+}
+
+// checkSchemaOf は path のDBをマイグレーションしてから checkSchema を実行します。
+func checkSchemaOf(t *testing.T, path string) error {
+	t.Helper()
+	db, err := initDB(path, "immediate", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return checkSchema(db)
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	// 同じDBに対して、複数のインスタンスが同時にマイグレーションを実行する
+	path := filepath.Join(t.TempDir(), "shared.db")
+	const instances = 8
+	errs := make(chan error, instances)
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := initDB(path, "immediate", "")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+			errs <- migrate(db)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("migrate: %v", err)
+		}
+	}
+
+	db, err := initDB(path, "immediate", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("user_version = %d, want %d", version, len(migrations))
+	}
+	if err := checkSchema(db); err != nil {
+		t.Errorf("schema after concurrent migrations: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// networkFSTypes はネットワーク上のファイルシステムとみなす /proc/self/mounts の種類です。
+// これらの上ではSQLiteのファイルロックが正しく働かないことがあり、DBが壊れるおそれがあります。
+var networkFSTypes = map[string]bool{
+	"nfs": true, "nfs4": true, "cifs": true, "smbfs": true, "smb3": true,
+	"fuse.sshfs": true, "9p": true, "afs": true, "glusterfs": true, "ceph": true,
+}
+
+// networkFSReason は path がネットワーク上のファイルシステムにありそうな場合に、その理由を返します。
+// hints（NETWORK_FS_PATHS）のいずれかのディレクトリの下にある場合と、
+// /proc/self/mounts でマウント先の種類がネットワークのファイルシステムの場合に該当します。
+// /proc/self/mounts がない環境（Linux以外）では hints だけで判定します。
+func networkFSReason(path string, hints map[string]bool) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for hint := range hints {
+		if under(abs, filepath.Clean(hint)) {
+			return "it is under " + hint + " (NETWORK_FS_PATHS)"
+		}
+	}
+
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	// パスを含むマウントのうち、最も深いものが実際のマウント先
+	var mountPoint, fsType string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		if under(abs, fields[1]) && len(fields[1]) >= len(mountPoint) {
+			mountPoint, fsType = fields[1], fields[2]
+		}
+	}
+	if networkFSTypes[fsType] {
+		return fmt.Sprintf("%s is mounted as %s", mountPoint, fsType)
+	}
+	return ""
+}
+
+// under は path が dir と同じか、dir の下にあるかどうかを返します。
+func under(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// checkNetworkFS はDBファイルがネットワーク上のファイルシステムにありそうな場合に、policy に従って
+// 警告を出すか（"warn"）、起動を中止するエラーを返します（"refuse"）。"ignore" の場合は確認しません。
+func checkNetworkFS(path string, hints map[string]bool, policy string) error {
+	if policy == "ignore" {
+		return nil
+	}
+	reason := networkFSReason(path, hints)
+	if reason == "" {
+		return nil
+	}
+	if policy == "refuse" {
+		return fmt.Errorf("database %s looks like it is on a network filesystem (%s); "+
+			"SQLite locking is unreliable there. Move it to a local disk or set NETWORK_FS_POLICY=warn to start anyway", path, reason)
+	}
+	log.Printf("WARNING: database %s looks like it is on a network filesystem (%s). "+
+		"SQLite locking is unreliable there and the database may be corrupted. Move it to a local disk", path, reason)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnder(t *testing.T) {
+	tests := []struct {
+		path, dir string
+		want      bool
+	}{
+		{"/mnt/nfs/app.db", "/mnt/nfs", true},
+		{"/mnt/nfs", "/mnt/nfs", true},
+		{"/mnt/nfs/app.db", "/mnt/nfs/", true},
+		{"/mnt/nfs2/app.db", "/mnt/nfs", false},
+		{"/var/app.db", "/", true},
+	}
+	for _, tt := range tests {
+		if got := under(tt.path, tt.dir); got != tt.want {
+			t.Errorf("under(%q, %q) = %v, want %v", tt.path, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestCheckNetworkFS(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.db")
+	hints := map[string]bool{dir: true}
+
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	if err := checkNetworkFS(path, hints, "warn"); err != nil {
+		t.Errorf("warn: %v", err)
+	}
+	if !strings.Contains(buf.String(), "WARNING") || !strings.Contains(buf.String(), "NETWORK_FS_PATHS") {
+		t.Errorf("warn: log = %q", buf.String())
+	}
+
+	buf.Reset()
+	err := checkNetworkFS(path, hints, "refuse")
+	if err == nil || !strings.Contains(err.Error(), "NETWORK_FS_POLICY=warn") {
+		t.Errorf("refuse: err = %v", err)
+	}
+	if err := checkNetworkFS(path, hints, "ignore"); err != nil {
+		t.Errorf("ignore: %v", err)
+	}
+	// 指定されていないディレクトリは、マウントの種類で判定する（テストの一時ディレクトリはローカル）
+	if err := checkNetworkFS(path, map[string]bool{"/mnt/nfs": true}, "refuse"); err != nil {
+		t.Errorf("local path: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected log: %q", buf.String())
+	}
+
+	// 起動時の確認で中止する
+	t.Setenv("NETWORK_FS_POLICY", "refuse")
+	t.Setenv("NETWORK_FS_PATHS", dir)
+	if _, err := newServer(loadConfig(), path); err == nil {
+		t.Error("newServer started on a flagged path")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// userPage は GET /users?as=page で返す、1ページ分のユーザーと件数です。
+// 「全 Total 件中、条件に一致する FilteredTotal 件のうち Offset+1 件目から」のような表示に使えます。
+type userPage struct {
+	Users  interface{} `json:"users"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	// Total は削除されていないすべてのユーザーの件数、FilteredTotal は絞り込みの条件に一致する件数です。
+	Total         int `json:"total"`
+	FilteredTotal int `json:"filtered_total"`
+}
+
+// listUserPage は ?limit= と ?offset= のページを件数と一緒に返します。
+// 件数とページは別々のクエリで読み込むため、その間に他のリクエストが追加や削除をすると、
+// 「total は100件なのにページが空」のように一時的に食い違うことがあります。
+// consistent がtrueの場合は1つの読み取りトランザクション（withReadTx）の中で読み込み、同じ時点の内容を返します。
+// 書き込みのロックは取りませんが、WALモードでなければその間は他の書き込みのコミットを待たせるため、既定では使いません。
+func listUserPage(c echo.Context, repo *userRepository, filter userFilter, order userSort, fields fieldSelection, consistent bool) error {
+	limit, offset, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	page := userPage{Limit: limit, Offset: offset}
+	read := func(ctx context.Context) error {
+		users, err := repo.List(ctx, filter, order, limit, offset)
+		if err != nil {
+			return err
+		}
+		page.Users = fields.users(users)
+		page.Total, page.FilteredTotal, err = countTotals(ctx, repo, filter)
+		return err
+	}
+	ctx := c.Request().Context()
+	if consistent {
+		err = repo.withReadTx(ctx, read)
+	} else {
+		err = read(ctx)
+	}
+	if err != nil {
+		return dbError(c, err)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// countTotals は全体の件数と、条件に一致する件数を返します。条件がない場合はCOUNTを1回だけ実行します。
+func countTotals(ctx context.Context, repo *userRepository, filter userFilter) (total, filtered int, err error) {
+	if total, err = repo.Count(ctx, userFilter{}); err != nil {
+		return 0, 0, err
+	}
+	if filter.empty() {
+		return total, total, nil
+	}
+	filtered, err = repo.Count(ctx, filter)
+	return total, filtered, err
+}
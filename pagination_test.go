@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConsistentPageDoesNotBlockWriters(t *testing.T) {
+	s := newTestServer(t, map[string]string{"CONSISTENT_PAGE_COUNTS": "true"})
+	if _, err := s.db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		t.Fatal(err)
+	}
+	repo := newUserRepository(s.db)
+	repo.snapshotDB = s.snapshotDB
+
+	err := repo.withReadTx(context.Background(), func(ctx context.Context) error {
+		if _, err := repo.Count(ctx, userFilter{}); err != nil {
+			return err
+		}
+		// 読み取りのトランザクションの間も、書き込みは待たずに終わる
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			done <- request(s, http.MethodPost, "/users", `{"name":"Taro","age":30,"email":"taro@example.com"}`)
+		}()
+		select {
+		case rec := <-done:
+			expectStatus(t, rec, http.StatusCreated)
+		case <-time.After(2 * time.Second):
+			t.Fatal("write was blocked by the read transaction")
+		}
+		// トランザクションの中では、開始した時点の内容が見え続ける
+		n, err := repo.Count(ctx, userFilter{})
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			t.Errorf("count inside the read transaction = %d, want 0", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := request(s, http.MethodGet, "/users?as=page", "")
+	expectStatus(t, rec, http.StatusOK)
+	var page struct {
+		Users []User `json:"users"`
+		Total int    `json:"total"`
+	}
+	decode(t, rec, &page)
+	if page.Total != 1 || len(page.Users) != 1 {
+		t.Errorf("page = %+v", page)
+	}
+}
+
+func TestPageCounts(t *testing.T) {
+	for _, consistent := range []string{"false", "true"} {
+		t.Run("consistent="+consistent, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"CONSISTENT_PAGE_COUNTS": consistent})
+			for i, age := range []int{15, 20, 30, 40, 50} {
+				createUser(t, s, fmt.Sprintf("user%d", i), age, "")
+			}
+			expectStatus(t, request(s, http.MethodDelete, "/users/5", ""), http.StatusNoContent)
+
+			tests := []struct {
+				query                   string
+				total, filtered, onPage int
+			}{
+				{"", 4, 4, 4},
+				{"&limit=2", 4, 4, 2},
+				{"&min_age=18", 4, 3, 3},
+				{"&min_age=18&limit=2&offset=2", 4, 3, 1},
+				{"&min_age=100", 4, 0, 0},
+			}
+			for _, tt := range tests {
+				rec := request(s, http.MethodGet, "/users?as=page"+tt.query, "")
+				expectStatus(t, rec, http.StatusOK)
+				var page struct {
+					Users         []User `json:"users"`
+					Total         int    `json:"total"`
+					FilteredTotal int    `json:"filtered_total"`
+				}
+				decode(t, rec, &page)
+				if page.Total != tt.total || page.FilteredTotal != tt.filtered || len(page.Users) != tt.onPage {
+					t.Errorf("?as=page%s: total %d, filtered_total %d, %d users", tt.query, page.Total, page.FilteredTotal, len(page.Users))
+				}
+			}
+		})
+	}
+}
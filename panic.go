@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/labstack/echo/v4"
+)
+
+// panicReport は PANIC_REPORT_URL に送る、パニックの内容です。
+type panicReport struct {
+	RequestID string `json:"request_id"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Panic     string `json:"panic"`
+	Stack     string `json:"stack"`
+}
+
+// recoverMiddleware はハンドラのパニックを500のエラーに変えます。パニックしたままだと接続が切れるだけで、
+// クライアントにはエラーのJSONもリクエストIDも返りません。
+// reports が nil でなければ、パニックの内容をエラー収集用のWebhookに送ります（送信はバックグラウンドで、失敗してもレスポンスには影響しません）。
+// http.ErrAbortHandler は接続を切るためのパニックなので、そのまま投げ直します。
+func recoverMiddleware(reports *webhookNotifier) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				stack := debug.Stack()
+				report := panicReport{
+					RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+					Method:    c.Request().Method,
+					Path:      c.Request().URL.Path,
+					Panic:     fmt.Sprint(p),
+					Stack:     string(stack),
+				}
+				log.Printf("panic: request_id=%s %s %s: %s\n%s", report.RequestID, report.Method, report.Path, report.Panic, stack)
+				reports.notify("panic", report)
+				err = echo.NewHTTPError(http.StatusInternalServerError, "internal server error").
+					SetInternal(&stackError{err: fmt.Errorf("panic: %v", p), stack: stack})
+			}()
+			return next(c)
+		}
+	}
+}
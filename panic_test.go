@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPanicReport(t *testing.T) {
+	events := make(chan webhookEvent, 1)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event webhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid report %s: %v", body, err)
+		}
+		events <- event
+	}))
+	defer sink.Close()
+	s := newTestServer(t, map[string]string{"PANIC_REPORT_URL": sink.URL})
+	s.e.GET("/panic", func(c echo.Context) error {
+		panic("something went wrong")
+	})
+
+	// パニックしても、リクエストIDの付いた500のエラーを返す
+	rec := request(s, http.MethodGet, "/panic", "")
+	expectStatus(t, rec, http.StatusInternalServerError)
+	var res errorResponse
+	decode(t, rec, &res)
+	if res.RequestID == "" || res.Code != codeInternal {
+		t.Errorf("response = %s", rec.Body.String())
+	}
+
+	select {
+	case event := <-events:
+		b, _ := json.Marshal(event.Data)
+		var report panicReport
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != "panic" || report.RequestID != res.RequestID || report.Method != http.MethodGet ||
+			report.Path != "/panic" || report.Panic != "something went wrong" || !strings.Contains(report.Stack, "panic_test.go") {
+			t.Errorf("report = %s %+v", event.Type, report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic was not reported")
+	}
+}
+
+func TestRecoverWithoutReports(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.e.GET("/panic", func(c echo.Context) error {
+		panic("something went wrong")
+	})
+	expectStatus(t, request(s, http.MethodGet, "/panic", ""), http.StatusInternalServerError)
+
+	// 接続を切るためのパニックは、そのまま投げ直す
+	s.e.GET("/abort", func(c echo.Context) error {
+		panic(http.ErrAbortHandler)
+	})
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	request(s, http.MethodGet, "/abort", "")
+	t.Error("http.ErrAbortHandler was recovered")
+}
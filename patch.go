@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// userPatch は PATCH で変更するフィールドです。nil のフィールドは変更しません。
+type userPatch struct {
+	Name  *string `json:"name"`
+	Age   *int    `json:"age"`
+	Email *string `json:"email"`
+}
+
+// apply は current に変更を反映したユーザーを返します。
+func (p userPatch) apply(current User) User {
+	if p.Name != nil {
+		current.Name = *p.Name
+	}
+	if p.Age != nil {
+		current.Age = *p.Age
+	}
+	if p.Email != nil {
+		current.Email = *p.Email
+	}
+	return current
+}
+
+// userPrecondition は条件付きの更新で、現在の値がこれと一致する場合にだけ更新するという条件です。
+// nil のフィールドは条件に含めません。
+type userPrecondition struct {
+	Name  *string
+	Age   *int
+	Email *string
+}
+
+// parsePreconditions は ?if_name=, ?if_age=, ?if_email= を条件として読み込みます。
+func parsePreconditions(c echo.Context) (userPrecondition, error) {
+	var pre userPrecondition
+	q := c.QueryParams()
+	if q.Has("if_name") {
+		v := q.Get("if_name")
+		pre.Name = &v
+	}
+	if q.Has("if_age") {
+		v, err := strconv.Atoi(q.Get("if_age"))
+		if err != nil {
+			return pre, echo.NewHTTPError(http.StatusBadRequest, "if_age must be an integer")
+		}
+		pre.Age = &v
+	}
+	if q.Has("if_email") {
+		v := q.Get("if_email")
+		pre.Email = &v
+	}
+	return pre, nil
+}
+
+// patchUserHandler は指定されたフィールドだけを更新します。
+// ?if_age=30 のような条件を付けると、現在の値が一致する場合にだけ更新し、一致しない場合は412を返します。
+// 条件は UPDATE の WHERE 句に含めるので、確認と更新の間に他のリクエストが割り込むことはありません。
+// validate は組み込みの検証の後に実行する独自の検証です（server.runUserValidator）。
+func patchUserHandler(repo *userRepository, cfg config, webhooks *webhookNotifier, validate func(User) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := parseID(c)
+		if err != nil {
+			return err
+		}
+		pre, err := parsePreconditions(c)
+		if err != nil {
+			return err
+		}
+		var patch userPatch
+		if err := c.Bind(&patch); err != nil {
+			return err
+		}
+		if patch.Email != nil {
+			email := repo.normalizeEmail(*patch.Email)
+			patch.Email = &email
+		}
+
+		// 検証は変更後のユーザー全体に対して、PUT と同じ規則で行う
+		current, err := repo.Get(c.Request().Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return userNotFound()
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		updated := patch.apply(current)
+		if err := validateUser(updated.Name, updated.Age, cfg.MinAge); err != nil {
+			return err
+		}
+		if err := validateEmail(updated.Email); err != nil {
+			return err
+		}
+		if err := validate(updated); err != nil {
+			return err
+		}
+		if err := checkFieldPermissions(c, changedFields(current, updated), cfg.NonAdminFields); err != nil {
+			return err
+		}
+		if cfg.AgeNoDecrease && c.QueryParam("allow_age_decrease") != "true" {
+			if err := validateAgeChange(current.Age, updated.Age); err != nil {
+				return err
+			}
+		}
+
+		user, err := repo.Patch(c.Request().Context(), id, patch, pre)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return userNotFound()
+		case errors.Is(err, errPreconditionFailed):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "precondition failed")
+		case errors.Is(err, errDuplicateName):
+			return nameConflict()
+		case err != nil:
+			return dbError(c, err)
+		}
+
+		webhooks.notify("user.updated", user)
+		return c.JSON(http.StatusOK, responseSelection(c, cfg).user(user))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestPatchPreconditions(t *testing.T) {
+	s := newTestServer(t, nil)
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+	path := fmt.Sprintf("/users/%d", u.ID)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"?if_age=29", http.StatusPreconditionFailed},
+		{"?if_age=30&if_name=Hanako", http.StatusPreconditionFailed},
+		{"?if_email=other@example.com", http.StatusPreconditionFailed},
+		{"?if_age=abc", http.StatusBadRequest},
+		{"?if_age=30&if_name=Taro&if_email=taro@example.com", http.StatusOK},
+		// 前の更新で年齢が変わったので、同じ条件ではもう更新できない
+		{"?if_age=30", http.StatusPreconditionFailed},
+		{"?if_age=31", http.StatusOK},
+	}
+	age := 30
+	for _, tt := range tests {
+		rec := request(s, http.MethodPatch, path+tt.query, fmt.Sprintf(`{"age":%d}`, age+1))
+		expectStatus(t, rec, tt.want)
+		if tt.want == http.StatusOK {
+			age++
+		}
+	}
+
+	rec := request(s, http.MethodGet, path, "")
+	var got User
+	decode(t, rec, &got)
+	if got.Age != 32 {
+		t.Errorf("age = %d, want 32", got.Age)
+	}
+	// 存在しないユーザーは条件に関係なく404
+	expectStatus(t, request(s, http.MethodPatch, "/users/99?if_age=30", `{"age":31}`), http.StatusNotFound)
+}
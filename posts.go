@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Post はユーザーの投稿です。users と1対多の関係にあります。
+type Post struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreatePost はユーザーの投稿を登録します。ユーザーが存在しない場合は sql.ErrNoRows を返します。
+func (r *userRepository) CreatePost(ctx context.Context, post Post) (Post, error) {
+	post.CreatedAt = r.now().UTC().Truncate(time.Millisecond)
+	err := r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := r.Get(ctx, post.UserID); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, "INSERT INTO posts(user_id, title, created_at) VALUES(?, ?, ?)",
+			post.UserID, post.Title, formatTimestamp(post.CreatedAt))
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		post.ID = int(id)
+		return err
+	})
+	if err != nil {
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// PostsByUser はユーザーの投稿を古い順に返します。
+func (r *userRepository) PostsByUser(ctx context.Context, userID int) ([]Post, error) {
+	rows, err := r.conn(ctx).QueryContext(ctx,
+		"SELECT id, user_id, title, created_at FROM posts WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		var post Post
+		var createdAt string
+		if err := rows.Scan(&post.ID, &post.UserID, &post.Title, &createdAt); err != nil {
+			return nil, err
+		}
+		post.CreatedAt, _ = time.Parse(timestampFormat, createdAt)
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// CountPostsByUser はユーザーの投稿の件数を返します。
+func (r *userRepository) CountPostsByUser(ctx context.Context, userID int) (int, error) {
+	var n int
+	err := r.conn(ctx).QueryRowContext(ctx, "SELECT COUNT(*) FROM posts WHERE user_id = ?", userID).Scan(&n)
+	return n, err
+}
+
+// deletePreview は DELETE /users/:id を実行した場合に影響を受けるものです。
+type deletePreview struct {
+	User User `json:"user"`
+	// Posts はユーザーの投稿の件数、PostsAction は削除したときにその投稿がどうなるかです。
+	Posts       int    `json:"posts"`
+	PostsAction string `json:"posts_action"`
+}
+
+// deletePreviewHandler はユーザーを削除する前に、対象のユーザーと影響を受ける投稿の件数を返します。
+// 何も変更しません。削除は論理削除なので投稿は消えずに残りますが、GET /users/:id/posts からは見えなくなります
+// （posts の ON DELETE CASCADE が働くのは行を物理削除した場合だけです）。
+func deletePreviewHandler(repo *userRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := parseID(c)
+		if err != nil {
+			return err
+		}
+		user, err := repo.Get(c.Request().Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return userNotFound()
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		posts, err := repo.CountPostsByUser(c.Request().Context(), id)
+		if err != nil {
+			return dbError(c, err)
+		}
+		preview := deletePreview{User: user, Posts: posts, PostsAction: "none"}
+		if posts > 0 {
+			preview.PostsAction = "hidden"
+		}
+		return c.JSON(http.StatusOK, preview)
+	}
+}
+
+// listPostsHandler は指定されたユーザーの投稿一覧を返します。
+func listPostsHandler(repo *userRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := parseID(c)
+		if err != nil {
+			return err
+		}
+		if ok, err := repo.Exists(c.Request().Context(), id); err != nil {
+			return dbError(c, err)
+		} else if !ok {
+			return userNotFound()
+		}
+
+		posts, err := repo.PostsByUser(c.Request().Context(), id)
+		if err != nil {
+			return dbError(c, err)
+		}
+		return c.JSON(http.StatusOK, posts)
+	}
+}
+
+// createPostHandler は指定されたユーザーの投稿を登録します。
+func createPostHandler(repo *userRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := parseID(c)
+		if err != nil {
+			return err
+		}
+		title := c.FormValue("title")
+		if title == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "title is empty")
+		}
+
+		post, err := repo.CreatePost(c.Request().Context(), Post{UserID: id, Title: title})
+		if errors.Is(err, sql.ErrNoRows) {
+			return userNotFound()
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		return c.JSON(http.StatusCreated, post)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// createPost はフォームでユーザーの投稿を登録します。
+func createPost(t *testing.T, s *server, userID int, title string) {
+	t.Helper()
+	rec := request(s, http.MethodPost, fmt.Sprintf("/users/%d/posts", userID), "title="+title,
+		echo.HeaderContentType, echo.MIMEApplicationForm)
+	expectStatus(t, rec, http.StatusCreated)
+}
+
+func TestDeletePreview(t *testing.T) {
+	s := newTestServer(t, nil)
+	taro := createUser(t, s, "Taro", 30, "taro@example.com")
+	hanako := createUser(t, s, "Hanako", 25, "hanako@example.com")
+	createPost(t, s, taro.ID, "first")
+	createPost(t, s, taro.ID, "second")
+
+	tests := []struct {
+		id     int
+		posts  int
+		action string
+	}{
+		{taro.ID, 2, "hidden"},
+		{hanako.ID, 0, "none"},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, fmt.Sprintf("/users/%d/delete-preview", tt.id), "")
+		expectStatus(t, rec, http.StatusOK)
+		var preview deletePreview
+		decode(t, rec, &preview)
+		if preview.User.ID != tt.id || preview.Posts != tt.posts || preview.PostsAction != tt.action {
+			t.Errorf("delete-preview for %d = %+v", tt.id, preview)
+		}
+	}
+
+	// プレビューは何も変更しない
+	expectStatus(t, request(s, http.MethodGet, fmt.Sprintf("/users/%d", taro.ID), ""), http.StatusOK)
+	rec := request(s, http.MethodGet, fmt.Sprintf("/users/%d/posts", taro.ID), "")
+	var posts []Post
+	decode(t, rec, &posts)
+	if len(posts) != 2 {
+		t.Errorf("posts after preview = %+v", posts)
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users/99/delete-preview", ""), http.StatusNotFound)
+}
+
+func TestMergeUsers(t *testing.T) {
+	s := newTestServer(t, nil)
+	keep := createUser(t, s, "Taro", 30, "taro@example.com")
+	remove := createUser(t, s, "Taro Yamada", 30, "yamada@example.com")
+	other := createUser(t, s, "Hanako", 25, "hanako@example.com")
+	createPost(t, s, keep.ID, "kept")
+	createPost(t, s, remove.ID, "moved1")
+	createPost(t, s, remove.ID, "moved2")
+	createPost(t, s, other.ID, "untouched")
+
+	postOwners := func() string {
+		t.Helper()
+		rows, err := s.db.Query("SELECT title, user_id FROM posts ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		owners := []string{}
+		for rows.Next() {
+			var title string
+			var userID int
+			if err := rows.Scan(&title, &userID); err != nil {
+				t.Fatal(err)
+			}
+			owners = append(owners, fmt.Sprintf("%s=%d", title, userID))
+		}
+		return fmt.Sprint(owners)
+	}
+	before := postOwners()
+
+	// 同じユーザーや、存在しないユーザーとはまとめられず、何も変更しない
+	expectStatus(t, request(s, http.MethodPost, "/users/merge", fmt.Sprintf(`{"keep":%d,"remove":%d}`, keep.ID, keep.ID)), http.StatusBadRequest)
+	rec := request(s, http.MethodPost, "/users/merge", fmt.Sprintf(`{"keep":%d,"remove":99}`, keep.ID))
+	expectStatus(t, rec, http.StatusNotFound)
+	var res errorResponse
+	decode(t, rec, &res)
+	if res.Code != codeUserNotFound {
+		t.Errorf("missing user: code = %q", res.Code)
+	}
+	expectStatus(t, request(s, http.MethodPost, "/users/merge", fmt.Sprintf(`{"keep":99,"remove":%d}`, remove.ID)), http.StatusNotFound)
+	if got := postOwners(); got != before {
+		t.Errorf("posts changed by a rejected merge: %s", got)
+	}
+
+	rec = request(s, http.MethodPost, "/users/merge", fmt.Sprintf(`{"keep":%d,"remove":%d}`, keep.ID, remove.ID))
+	expectStatus(t, rec, http.StatusOK)
+	var merged User
+	decode(t, rec, &merged)
+	if merged.ID != keep.ID {
+		t.Errorf("merged user = %+v", merged)
+	}
+	// remove の投稿は keep に付け替え、他のユーザーの投稿はそのまま
+	want := fmt.Sprintf("[kept=%d moved1=%d moved2=%d untouched=%d]", keep.ID, keep.ID, keep.ID, other.ID)
+	if got := postOwners(); got != want {
+		t.Errorf("posts after merge = %s, want %s", got, want)
+	}
+	// remove は論理削除する
+	expectStatus(t, request(s, http.MethodGet, fmt.Sprintf("/users/%d", remove.ID), ""), http.StatusNotFound)
+	var deletedAt sql.NullString
+	if err := s.db.QueryRow("SELECT deleted_at FROM users WHERE id = ?", remove.ID).Scan(&deletedAt); err != nil {
+		t.Fatal(err)
+	}
+	if !deletedAt.Valid {
+		t.Error("removed user is not soft-deleted")
+	}
+	// 削除済みのユーザーとは、もうまとめられない
+	expectStatus(t, request(s, http.MethodPost, "/users/merge", fmt.Sprintf(`{"keep":%d,"remove":%d}`, other.ID, remove.ID)), http.StatusNotFound)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// errLaneFull は待ち行列が上限に達している場合に返されます。
+var errLaneFull = errors.New("queue is full")
+
+// prioritySemaphore はDBへの同時アクセス数を制限するセマフォです。
+// 空きがない場合は優先度ごとの待ち行列に並び、空きが出たときは高優先度の待ちから順に割り当てます。
+// そのため書き込みが集中しても、読み取りやヘルスチェックが待たされ続けることはありません。
+type prioritySemaphore struct {
+	mu       sync.Mutex
+	capacity int
+	slots    int
+	// queues[0] が高優先度、queues[1] が低優先度の待ち行列です。
+	queues [2][]chan struct{}
+	limits [2]int
+}
+
+func newPrioritySemaphore(slots, highQueue, lowQueue int) *prioritySemaphore {
+	return &prioritySemaphore{capacity: slots, slots: slots, limits: [2]int{highQueue, lowQueue}}
+}
+
+// Stats は確保されている空きの数と、待ち行列に並んでいる数を返します。
+func (s *prioritySemaphore) Stats() (inUse, queued int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.capacity - s.slots, len(s.queues[0]) + len(s.queues[1])
+}
+
+// Acquire は空きを1つ確保します。確保できるまで待ち、ctx がキャンセルされた場合はそのエラーを返します。
+func (s *prioritySemaphore) Acquire(ctx context.Context, high bool) error {
+	lane := 1
+	if high {
+		lane = 0
+	}
+
+	s.mu.Lock()
+	// 自分より優先される待ちがいなければ、すぐに確保する
+	if s.slots > 0 && len(s.queues[0]) == 0 && (high || len(s.queues[1]) == 0) {
+		s.slots--
+		s.mu.Unlock()
+		return nil
+	}
+	if len(s.queues[lane]) >= s.limits[lane] {
+		s.mu.Unlock()
+		return errLaneFull
+	}
+	ready := make(chan struct{})
+	s.queues[lane] = append(s.queues[lane], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, ch := range s.queues[lane] {
+			if ch == ready {
+				s.queues[lane] = append(s.queues[lane][:i], s.queues[lane][i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// キャンセルと同時に割り当てられていた場合は、その空きを次の待ちに渡す
+		s.releaseLocked()
+		return ctx.Err()
+	}
+}
+
+// Release は確保した空きを返します。
+func (s *prioritySemaphore) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+func (s *prioritySemaphore) releaseLocked() {
+	for lane := range s.queues {
+		if len(s.queues[lane]) > 0 {
+			ready := s.queues[lane][0]
+			s.queues[lane] = s.queues[lane][1:]
+			close(ready)
+			return
+		}
+	}
+	s.slots++
+}
+
+// isHighPriority は読み取りとヘルスチェックを高優先度として扱います。
+func isHighPriority(c echo.Context) bool {
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return c.Path() == "/healthz"
+}
+
+// qosMiddleware はリクエストの優先度に応じてセマフォを確保してからハンドラを実行します。
+// 待ち行列が満杯の場合やタイムアウトした場合は503を返します。
+func qosMiddleware(sem *prioritySemaphore) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := sem.Acquire(c.Request().Context(), isHighPriority(c)); err != nil {
+				setRetryAfter(c, 1)
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "server is busy").SetInternal(err)
+			}
+			defer sem.Release()
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "strings"
+
+// whereBuilder はWHERE句の条件と引数を組み立てます。
+// 条件はすべて AND で結合し、値は文字列に埋め込まずにプレースホルダー（?）の引数として渡します。
+// 一覧、件数、書き出しなどで同じ条件を使うため、SQLの文字列を個別に連結しないようにまとめています。
+type whereBuilder struct {
+	conds []string
+	args  []interface{}
+}
+
+// add は条件を1つ追加します。args は cond に含まれるプレースホルダーの数と同じだけ渡します。
+func (b *whereBuilder) add(cond string, args ...interface{}) {
+	b.conds = append(b.conds, cond)
+	b.args = append(b.args, args...)
+}
+
+// addIn は column が values のいずれかに一致する条件を追加します。values が空の場合は何にも一致しません。
+func (b *whereBuilder) addIn(column string, values []int) {
+	if len(values) == 0 {
+		b.add("0 = 1")
+		return
+	}
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	b.add(column+" IN ("+placeholders(len(values))+")", args...)
+}
+
+// build はWHERE句（先頭に " WHERE" を含む）と引数を返します。条件がなければ空文字を返します。
+func (b *whereBuilder) build() (string, []interface{}) {
+	if len(b.conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(b.conds, " AND "), b.args
+}
+
+// placeholders は IN句用に n 個の "?" をカンマ区切りで返します。
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUserFilterWhere(t *testing.T) {
+	age := func(n int) *int { return &n }
+	tests := []struct {
+		filter userFilter
+		want   string
+		args   []interface{}
+	}{
+		{userFilter{}, " WHERE deleted_at IS NULL", nil},
+		{userFilter{IncludeDeleted: true}, "", nil},
+		{userFilter{Status: statusDeleted}, " WHERE deleted_at IS NOT NULL", nil},
+		{userFilter{Status: "suspended", MinAge: age(18), MaxAge: age(65)},
+			" WHERE deleted_at IS NULL AND status = ? AND age >= ? AND age <= ?", []interface{}{"suspended", 18, 65}},
+		{userFilter{Name: "50%_off", NamePrefix: `a\b`},
+			` WHERE deleted_at IS NULL AND name LIKE ? ESCAPE '\' AND name LIKE ? ESCAPE '\'`,
+			[]interface{}{`%50\%\_off%`, `a\\b%`}},
+		{userFilter{IDs: []int{3, 1}, Ages: []int{}, AfterID: 1},
+			" WHERE deleted_at IS NULL AND id IN (?,?) AND 0 = 1 AND id > ?", []interface{}{3, 1, 1}},
+		{userFilter{Email: "taro@example.com"},
+			" WHERE deleted_at IS NULL AND (email = ? COLLATE NOCASE) AND email <> ''", []interface{}{"taro@example.com"}},
+		// 値はSQLに埋め込まない
+		{userFilter{Name: "'; DROP TABLE users; --"},
+			` WHERE deleted_at IS NULL AND name LIKE ? ESCAPE '\'`, []interface{}{"%'; DROP TABLE users; --%"}},
+	}
+	for _, tt := range tests {
+		where, args := tt.filter.where(nil)
+		if where != tt.want || fmt.Sprint(args) != fmt.Sprint(tt.args) {
+			t.Errorf("where(%+v) = %q %v, want %q %v", tt.filter, where, args, tt.want, tt.args)
+		}
+	}
+}
+
+func TestUserFilterCombinations(t *testing.T) {
+	// 一覧・件数・書き出しが同じ条件で絞り込む
+	s := newTestServer(t, nil)
+	for i, name := range []string{"Alice", "Alfred", "Bob", "Alan"} {
+		createUser(t, s, name, 20+i*10, "")
+	}
+	expectStatus(t, request(s, http.MethodPost, "/users/2/status", `{"status":"suspended"}`), http.StatusOK)
+	expectStatus(t, request(s, http.MethodDelete, "/users/3", ""), http.StatusNoContent)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"name_prefix=Al&min_age=30", "Alfred,Alan"},
+		{"name=l&max_age=30", "Alice,Alfred"},
+		{"name_prefix=Al&status=active", "Alice,Alan"},
+		{"status=suspended&min_age=30&max_age=30", "Alfred"},
+		{"status=deleted", "Bob"},
+		{"name=b&min_age=100", ""},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users/export.csv?columns=name&"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		names := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")[1:]
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("export?%s = %s, want %s", tt.query, got, tt.want)
+		}
+
+		rec = request(s, http.MethodGet, "/users?as=page&"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		var page struct {
+			Users         []User `json:"users"`
+			FilteredTotal int    `json:"filtered_total"`
+		}
+		decode(t, rec, &page)
+		if page.FilteredTotal != len(names) || len(page.Users) != len(names) {
+			t.Errorf("page?%s = %+v, want %d users", tt.query, page, len(names))
+		}
+	}
+}
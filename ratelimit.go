@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// rateLimiter はクライアントごとに一定時間内のリクエスト数を制限する固定ウィンドウ方式のレートリミッターです。
+type rateLimiter struct {
+	now func() time.Time
+
+	// mu は以下のフィールドを守ります。limit、window、warnAt は configure で変更されることがあります。
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	// warnAt はこの回数に達したら X-RateLimit-Warning を付ける閾値です。
+	warnAt    int
+	clients   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// newRateLimiter はレートリミッターを作成します。warnPercent は上限に対する警告の割合（%）です。
+// limit が0以下の場合は制限しません。
+func newRateLimiter(limit int, window time.Duration, warnPercent int) *rateLimiter {
+	l := &rateLimiter{now: time.Now, clients: map[string]*rateWindow{}}
+	l.configure(limit, window, warnPercent)
+	return l
+}
+
+// configure は上限、ウィンドウ、警告の割合を変更します（SIGHUP による設定の再読み込みで使います）。
+// 現在のウィンドウで数えた回数はそのまま引き継ぎます。
+func (l *rateLimiter) configure(limit int, window time.Duration, warnPercent int) {
+	warnAt := limit * warnPercent / 100
+	if warnAt < 1 {
+		warnAt = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.window, l.warnAt = limit, window, warnAt
+}
+
+// take はクライアントのリクエストを1回数え、現在のウィンドウでの使用回数とウィンドウの終了時刻、
+// そのときの上限と警告の閾値を返します。制限しない設定の場合は limit に0を返します。
+func (l *rateLimiter) take(client string) (count int, reset time.Time, limit, warnAt int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 {
+		return 0, time.Time{}, 0, 0
+	}
+
+	now := l.now()
+	// 期限切れのウィンドウを定期的に削除してメモリが増え続けないようにする
+	if now.Sub(l.lastSweep) >= l.window {
+		for key, w := range l.clients {
+			if now.Sub(w.start) >= l.window {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.clients[client]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.clients[client] = w
+	}
+	w.count++
+	return w.count, w.start.Add(l.window), l.limit, l.warnAt
+}
+
+// rateLimitClient はレート制限の単位となるクライアントを返します。
+// APIキーで認証されている場合はキーのラベル、それ以外はIPアドレスです。
+func rateLimitClient(c echo.Context) string {
+	if key := currentKey(c); key != nil {
+		return "key:" + key.Label
+	}
+	return "ip:" + c.RealIP()
+}
+
+// rateLimitMiddleware は全てのレスポンスに X-RateLimit-Limit と X-RateLimit-Remaining を付け、
+// 使用回数が警告の閾値を超えたら X-RateLimit-Warning を追加します。
+// 上限を超えた場合は Retry-After 付きの429を返します。ヘッダーは standardHeaders が付けます。
+func rateLimitMiddleware(l *rateLimiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			count, reset, limit, warnAt := l.take(rateLimitClient(c))
+			if limit <= 0 {
+				return next(c)
+			}
+			remaining := limit - count
+			if remaining < 0 {
+				remaining = 0
+			}
+
+			headers := rateLimitHeaders{Limit: limit, Remaining: remaining, Reset: reset}
+			if count > limit {
+				retryAfter := int(reset.Sub(l.now()).Seconds() + 0.999)
+				if retryAfter < 1 {
+					retryAfter = 1
+				}
+				setRateLimitHeaders(c, headers)
+				setRetryAfter(c, retryAfter)
+				return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			if count >= warnAt {
+				headers.Warning = "approaching rate limit: " + strconv.Itoa(remaining) + " requests remaining"
+			}
+			setRateLimitHeaders(c, headers)
+			return next(c)
+		}
+	}
+}
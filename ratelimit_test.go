@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	s := newTestServer(t, map[string]string{"RATE_LIMIT": "5", "RATE_LIMIT_WARN_PERCENT": "80"})
+	for i := 1; i <= 6; i++ {
+		rec := request(s, http.MethodGet, "/users", "")
+		h := rec.Header()
+		if got := h.Get("X-RateLimit-Limit"); got != "5" {
+			t.Errorf("request %d: X-RateLimit-Limit = %q", i, got)
+		}
+		remaining := 5 - i
+		if remaining < 0 {
+			remaining = 0
+		}
+		if got := h.Get("X-RateLimit-Remaining"); got != strconv.Itoa(remaining) {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %d", i, got, remaining)
+		}
+		if h.Get("X-RateLimit-Reset") == "" {
+			t.Errorf("request %d: X-RateLimit-Reset is missing", i)
+		}
+		// 5回の80%（4回目）から警告し、上限を超えたら429
+		switch {
+		case i < 4:
+			expectStatus(t, rec, http.StatusOK)
+			if w := h.Get("X-RateLimit-Warning"); w != "" {
+				t.Errorf("request %d: unexpected warning %q", i, w)
+			}
+		case i <= 5:
+			expectStatus(t, rec, http.StatusOK)
+			if w := h.Get("X-RateLimit-Warning"); w != "approaching rate limit: "+strconv.Itoa(remaining)+" requests remaining" {
+				t.Errorf("request %d: X-RateLimit-Warning = %q", i, w)
+			}
+		default:
+			expectStatus(t, rec, http.StatusTooManyRequests)
+			if h.Get("Retry-After") == "" {
+				t.Errorf("429 without Retry-After")
+			}
+		}
+	}
+
+}
+
+func TestRateLimitPerKey(t *testing.T) {
+	// APIキーで認証したリクエストは、キーごとに数える
+	s := newTestServer(t, map[string]string{"RATE_LIMIT": "2", "API_KEYS": testAPIKeys})
+	for i := 0; i < 2; i++ {
+		expectStatus(t, request(s, http.MethodGet, "/users", "", "X-API-Key", "reader-secret"), http.StatusOK)
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users", "", "X-API-Key", "reader-secret"), http.StatusTooManyRequests)
+	rec := request(s, http.MethodGet, "/users", "", "X-API-Key", "admin-secret")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("X-RateLimit-Remaining"); got != "1" {
+		t.Errorf("X-RateLimit-Remaining for another key = %q", got)
+	}
+}
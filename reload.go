@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+	glog "github.com/labstack/gommon/log"
+)
+
+// reloadableKeys は SIGHUP で再読み込みできる設定です。これ以外（DBのパスやポート、TLSなど）は再起動が必要です。
+var reloadableKeys = map[string]bool{
+	"LOG_LEVEL":               true,
+	"RATE_LIMIT":              true,
+	"RATE_LIMIT_WINDOW_S":     true,
+	"RATE_LIMIT_WARN_PERCENT": true,
+	"READ_ONLY":               true,
+}
+
+// logLevels は LOG_LEVEL に指定できる echo のログレベルです。
+var logLevels = map[string]glog.Lvl{
+	"debug": glog.DEBUG,
+	"info":  glog.INFO,
+	"warn":  glog.WARN,
+	"error": glog.ERROR,
+	"off":   glog.OFF,
+}
+
+// readConfigFile は KEY=VALUE を1行ずつ書いた設定ファイルを読み込みます。空行と # で始まる行は無視します。
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values, scanner.Err()
+}
+
+// applyConfigFile は設定ファイルの値を環境変数に設定します。loadConfig はその後で呼び出します。
+// reloading がtrueの場合は reloadableKeys の設定だけを反映し、それ以外は無視したことをログに残します。
+func applyConfigFile(path string, reloading bool) error {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if reloading && !reloadableKeys[key] {
+			if os.Getenv(key) != values[key] {
+				log.Printf("config reload: %s cannot be changed without a restart; ignored", key)
+			}
+			continue
+		}
+		if err := os.Setenv(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runtimeSettings は再起動せずに変更できる設定を反映する先です。
+type runtimeSettings struct {
+	e        *echo.Echo
+	limiter  *rateLimiter
+	readOnly *atomic.Bool
+}
+
+// apply は設定を反映します。それぞれの値は1つずつ入れ替わるので、リクエストの処理を止める必要はありません。
+func (s runtimeSettings) apply(cfg config) error {
+	level, ok := logLevels[strings.ToLower(cfg.LogLevel)]
+	if !ok {
+		return fmt.Errorf("LOG_LEVEL must be debug, info, warn, error or off: %q", cfg.LogLevel)
+	}
+	s.e.Logger.SetLevel(level)
+	s.limiter.configure(cfg.RateLimit, cfg.RateLimitWindow, cfg.RateLimitWarnPercent)
+	s.readOnly.Store(cfg.ReadOnly)
+	return nil
+}
+
+// reloadOnSIGHUP は SIGHUP を受け取るたびに CONFIG_FILE（path）を読み直し、再読み込みできる設定を反映します。
+// path が空の場合は環境変数が変わらないため、何もしないことをログに残します。
+func reloadOnSIGHUP(path string, settings runtimeSettings) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if path == "" {
+					log.Printf("config reload: CONFIG_FILE is not set; nothing to reload")
+					continue
+				}
+				err := applyConfigFile(path, true)
+				if err == nil {
+					err = settings.apply(loadConfig())
+				}
+				if err != nil {
+					log.Printf("config reload: %v", err)
+					continue
+				}
+				log.Printf("config reload: reloaded %s", path)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// readOnlyMiddleware は読み取り専用モードの間、GET/HEAD/OPTIONS 以外のリクエストに503を返します。
+// メンテナンス作業中に書き込みだけを止めるためのもので、SIGHUP で切り替えられます。
+func readOnlyMiddleware(readOnly *atomic.Bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+			if readOnly.Load() {
+				return withCode(echo.NewHTTPError(http.StatusServiceUnavailable, "server is in read-only mode"), codeReadOnly)
+			}
+			return next(c)
+		}
+	}
+}
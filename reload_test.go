@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	glog "github.com/labstack/gommon/log"
+)
+
+// writeConfigFile は content を設定ファイルとして書き出し、そのパスを返します。
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.env")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigReload(t *testing.T) {
+	// applyConfigFile は os.Setenv を使うので、テストの後に元へ戻るよう先に t.Setenv しておく
+	for key, value := range map[string]string{
+		"LOG_LEVEL":           "info",
+		"READ_ONLY":           "false",
+		"RATE_LIMIT":          "0",
+		"RATE_LIMIT_WINDOW_S": "60",
+		"BODY_LIMIT":          "4M",
+	} {
+		t.Setenv(key, value)
+	}
+	settings := runtimeSettings{e: echo.New(), limiter: newRateLimiter(0, 0, 0), readOnly: new(atomic.Bool)}
+	if err := settings.apply(loadConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if got := settings.e.Logger.Level(); got != glog.INFO {
+		t.Fatalf("initial log level = %v, want INFO", got)
+	}
+
+	path := writeConfigFile(t, `
+# 再読み込みできる設定
+LOG_LEVEL=debug
+READ_ONLY=true
+RATE_LIMIT=5
+RATE_LIMIT_WINDOW_S=10
+# 再起動が必要な設定は無視する
+BODY_LIMIT=1K
+`)
+	if err := applyConfigFile(path, true); err != nil {
+		t.Fatal(err)
+	}
+	cfg := loadConfig()
+	if err := settings.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := settings.e.Logger.Level(); got != glog.DEBUG {
+		t.Errorf("log level after reload = %v, want DEBUG", got)
+	}
+	if !settings.readOnly.Load() {
+		t.Error("READ_ONLY was not reloaded")
+	}
+	if settings.limiter.limit != 5 || settings.limiter.window != 10*time.Second {
+		t.Errorf("rate limit after reload = %d per %v, want 5 per 10s", settings.limiter.limit, settings.limiter.window)
+	}
+	if cfg.BodyLimit != "4M" {
+		t.Errorf("BODY_LIMIT after reload = %q, want it unchanged", cfg.BodyLimit)
+	}
+
+	// 起動時の読み込みでは、再起動が必要な設定も反映する
+	if err := applyConfigFile(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadConfig().BodyLimit; got != "1K" {
+		t.Errorf("BODY_LIMIT at startup = %q, want 1K", got)
+	}
+
+	// KEY=VALUE の形でない行があれば、何も反映しない
+	if err := applyConfigFile(writeConfigFile(t, "LOG_LEVEL=warn\nREAD_ONLY\n"), true); err == nil {
+		t.Error("a line without = was accepted")
+	}
+	if got := os.Getenv("LOG_LEVEL"); got != "debug" {
+		t.Errorf("LOG_LEVEL after a malformed file = %q, want debug", got)
+	}
+
+	// 不正なログレベルは反映せず、それまでの設定を残す
+	if err := applyConfigFile(writeConfigFile(t, "LOG_LEVEL=verbose\n"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.apply(loadConfig()); err == nil {
+		t.Error("LOG_LEVEL=verbose was accepted")
+	}
+	if got := settings.e.Logger.Level(); got != glog.DEBUG {
+		t.Errorf("log level after an invalid reload = %v, want DEBUG", got)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// readRequestKey はコンテキストに、読み取りだけのリクエスト（GET/HEAD）であることを保存するためのキーです。
+type readRequestKey struct{}
+
+// initReadDB は読み取り用のデータベースを読み取り専用で開きます。
+// SQLiteではレプリカの代わりに同じファイルを指定することもでき、その場合も書き込もうとするとエラーになります。
+func initReadDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// readRouting は GET/HEAD のリクエストのクエリを読み取り用のデータベース（readDB）で実行するようにします。
+// それ以外のメソッドは、書き込んだ直後の読み込みでも最新の内容を返せるよう、すべて書き込み用のデータベースを使います。
+// 本物のレプリカでは反映に遅れがあるため、GET では直前の書き込みが見えないことがあります。
+func readRouting(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead:
+			req := c.Request()
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), readRequestKey{}, true)))
+		}
+		return next(c)
+	}
+}
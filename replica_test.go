@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadDB(t *testing.T) {
+	// 読み取り用には、書き込み用とは別の内容のDBを用意して、どちらで読んだかを区別する
+	replicaPath := filepath.Join(t.TempDir(), "replica.db")
+	replica, err := newServer(loadConfig(), replicaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createUser(t, replica, "Replica", 40, "replica@example.com")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replica.close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, map[string]string{"READ_DB_PATH": replicaPath})
+	primary := createUser(t, s, "Primary", 30, "primary@example.com")
+
+	names := func(method, target, body string) []string {
+		t.Helper()
+		rec := request(s, method, target, body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: status = %d: %s", method, target, rec.Code, rec.Body.String())
+		}
+		var users []User
+		if target == "/users" {
+			decode(t, rec, &users)
+		} else {
+			var u User
+			decode(t, rec, &u)
+			users = append(users, u)
+		}
+		got := []string{}
+		for _, u := range users {
+			got = append(got, u.Name)
+		}
+		return got
+	}
+	// GET は読み取り用のDBで実行する
+	if got := fmt.Sprint(names(http.MethodGet, "/users", "")); got != "[Replica]" {
+		t.Errorf("GET /users = %s, want [Replica]", got)
+	}
+	if got := fmt.Sprint(names(http.MethodGet, fmt.Sprintf("/users/%d", primary.ID), "")); got != "[Replica]" {
+		t.Errorf("GET /users/%d = %s, want [Replica]", primary.ID, got)
+	}
+	// それ以外のメソッドは、読み込みも書き込み用のDBで実行する
+	if got := fmt.Sprint(names(http.MethodPatch, fmt.Sprintf("/users/%d", primary.ID), `{"age":31}`)); got != "[Primary]" {
+		t.Errorf("PATCH /users/%d = %s, want [Primary]", primary.ID, got)
+	}
+
+	// 読み取り用のDBは読み取り専用で開く
+	if _, err := s.readDB.Exec("DELETE FROM users"); err == nil {
+		t.Error("write through the read database succeeded")
+	}
+}
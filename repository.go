@@ -0,0 +1,968 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mattn/go-sqlite3"
+)
+
+// errAgeOutOfRange は更新後の年齢が有効範囲外になる場合に返されます。
+var errAgeOutOfRange = errors.New("age out of range")
+
+// errDuplicateName は UNIQUE_NAMES が有効なときに、既に使われている名前で登録・更新しようとした場合に返されます。
+var errDuplicateName = errors.New("name already exists")
+
+// uniqueViolation は一意制約の違反を errDuplicateName に変換します。
+// usersテーブルの一意制約は名前（idx_users_name_unique）だけです。
+func uniqueViolation(err error) error {
+	var se sqlite3.Error
+	if errors.As(err, &se) && se.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return errDuplicateName
+	}
+	return err
+}
+
+// errUserNotFound は操作の対象となるユーザーが存在しない場合に返されます。
+type errUserNotFound struct {
+	ID int
+}
+
+func (e errUserNotFound) Error() string {
+	return fmt.Sprintf("user %d not found", e.ID)
+}
+
+// userRepository はusersテーブルへのアクセスをまとめたものです。
+type userRepository struct {
+	db *sql.DB
+	// readDB が nil でない場合、GET/HEAD のリクエストのクエリはこちらで実行します（readRouting を参照）。
+	readDB *sql.DB
+	// snapshotDB は読み取りだけのトランザクション（withReadTx）に使う、db と同じファイルを _txlock=deferred で開いたDBです。
+	// TX_LOCK=immediate の db で BEGIN すると、読み取りだけでも書き込みのロックを取ってしまうためです。
+	snapshotDB *sql.DB
+	// now は created_at / updated_at に使う現在時刻を返します。テストでは固定の時刻に差し替えられます。
+	now func() time.Time
+	// emails が nil でない場合、メールアドレスを暗号化して保存します。
+	emails *emailCipher
+	// normalizeEmails がtrueの場合、メールアドレスを前後の空白を除いた小文字にそろえてから保存・検索します。
+	normalizeEmails bool
+}
+
+func newUserRepository(db *sql.DB) *userRepository {
+	return &userRepository{db: db, snapshotDB: db, now: time.Now}
+}
+
+// normalizeEmail は normalizeEmails が有効な場合、メールアドレスを前後の空白を除いた小文字にします。
+// 暗号化して保存する場合は大文字小文字を区別せずに検索できないため、保存と検索の両方で同じ形にそろえます。
+func (r *userRepository) normalizeEmail(email string) string {
+	if !r.normalizeEmails {
+		return email
+	}
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// where は filter のメールアドレスを正規化してから条件を組み立てます。
+func (r *userRepository) where(filter userFilter) (string, []interface{}) {
+	filter.Email = r.normalizeEmail(filter.Email)
+	return filter.where(r.emails)
+}
+
+// querier は *sql.DB と *sql.Tx の共通のインターフェースです。
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn は ctx がトランザクション内であればそのトランザクションを、そうでなければDBを返します。
+// 読み取り用のDBがある場合、読み取りだけのリクエストではそちらを返します。
+// SQL_REQUEST_ID_COMMENT=true の場合はクエリにリクエストIDのコメントを付け、
+// ?explain=true の場合は、実行計画を記録する querier で包んで返します。
+func (r *userRepository) conn(ctx context.Context) querier {
+	var q querier = r.db
+	if state, ok := ctx.Value(txKey{}).(*txState); ok {
+		q = state.tx
+	} else if r.readDB != nil && ctx.Value(readRequestKey{}) != nil {
+		q = r.readDB
+	}
+	if comment, ok := ctx.Value(sqlCommentKey{}).(string); ok {
+		q = commentQuerier{q: q, comment: comment}
+	}
+	if state, ok := ctx.Value(explainKey{}).(*explainState); ok {
+		return explainQuerier{q: q, state: state}
+	}
+	return q
+}
+
+// userColumns はSELECTするusersのカラムです。scanUser はこの順番で読み込みます。
+const userColumns = "id, name, age, email, created_at, updated_at, deleted_at, status, created_by, updated_by, anonymized_at"
+
+// timestampFormat はDBに保存する日時の形式です。UTCで桁数を固定しているので、文字列のまま大小比較できます。
+const timestampFormat = "2006-01-02T15:04:05.000Z"
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampFormat)
+}
+
+// rowScanner は *sql.Row と *sql.Rows の共通のインターフェースです。
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser は userColumns の順番で1行を読み込みます。暗号化されたメールアドレスは復号します。
+func (r *userRepository) scanUser(row rowScanner) (User, error) {
+	var user User
+	var createdAt, updatedAt string
+	var deletedAt, anonymizedAt sql.NullString
+	if err := row.Scan(&user.ID, &user.Name, &user.Age, &user.Email, &createdAt, &updatedAt, &deletedAt, &user.Status, &user.CreatedBy, &user.UpdatedBy, &anonymizedAt); err != nil {
+		return User{}, err
+	}
+	user.CreatedAt, _ = time.Parse(timestampFormat, createdAt)
+	user.UpdatedAt, _ = time.Parse(timestampFormat, updatedAt)
+	if deletedAt.Valid {
+		t, _ := time.Parse(timestampFormat, deletedAt.String)
+		user.DeletedAt = &t
+		user.Status = statusDeleted
+	}
+	if anonymizedAt.Valid {
+		t, _ := time.Parse(timestampFormat, anonymizedAt.String)
+		user.AnonymizedAt = &t
+	}
+	// 復号できない1件のために一覧全体を失敗させないよう、メールアドレスを空にして続ける
+	email, err := r.emails.decrypt(user.Email)
+	if err != nil {
+		log.Printf("user %d: %v", user.ID, err)
+	}
+	user.Email = email
+	return user, nil
+}
+
+// queryUsers はクエリを実行し、結果のユーザーをスライスで返します。
+func (r *userRepository) queryUsers(ctx context.Context, query string, args ...interface{}) ([]User, error) {
+	rows, err := r.conn(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := r.scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// userFilter はユーザー一覧を絞り込む条件です。ゼロ値の項目は条件に含めません。
+// 削除済み（deleted_at が設定された）ユーザーは IncludeDeleted がtrueの場合のみ含めます。
+type userFilter struct {
+	Email string
+	// Name は名前の部分一致（LIKE '%x%'）です。インデックスは使えないため全件を走査します。
+	Name string
+	// NamePrefix は名前の前方一致（LIKE 'x%'）です。name のインデックスがあれば使われます。
+	NamePrefix string
+	// MinAge と MaxAge は年齢の範囲（両端を含む）です。nil の場合は条件に含めません。
+	MinAge, MaxAge *int
+	// IDs が nil でない場合、これらのIDのユーザーだけを対象にします（空の場合は何にも一致しません）。
+	IDs []int
+	// Ages が nil でない場合、年齢がこれらのいずれかに一致するユーザーだけを対象にします（空の場合は何にも一致しません）。
+	Ages []int
+	// Status は状態での絞り込みです。deleted を指定すると論理削除済みのユーザーだけを対象にします。
+	Status string
+	// AfterID を指定すると、IDがこの値より大きいユーザーだけを対象にします（キーセットによるページ送り）。
+	AfterID        int
+	IncludeDeleted bool
+}
+
+// empty は絞り込みの条件が1つもないかどうかを返します。
+func (f userFilter) empty() bool {
+	return f.Email == "" && f.Name == "" && f.NamePrefix == "" && f.MinAge == nil && f.MaxAge == nil &&
+		f.IDs == nil && f.Ages == nil && f.Status == ""
+}
+
+// where は条件をWHERE句（先頭に " WHERE" を含む）と引数に変換します。条件がなければ空文字を返します。
+// emails はメールアドレスの条件を保存されている形式に合わせるために使います。
+func (f userFilter) where(emails *emailCipher) (string, []interface{}) {
+	var b whereBuilder
+	switch f.Status {
+	case "":
+		if !f.IncludeDeleted {
+			b.add("deleted_at IS NULL")
+		}
+	case statusDeleted:
+		b.add("deleted_at IS NOT NULL")
+	default:
+		b.add("deleted_at IS NULL")
+		b.add("status = ?", f.Status)
+	}
+	if f.Email != "" {
+		values := emails.lookupValues(f.Email)
+		b.add(emailCondition(len(values)), values...)
+	}
+	if f.Name != "" {
+		b.add(`name LIKE ? ESCAPE '\'`, "%"+escapeLike(f.Name)+"%")
+	}
+	if f.NamePrefix != "" {
+		b.add(`name LIKE ? ESCAPE '\'`, escapeLike(f.NamePrefix)+"%")
+	}
+	if f.IDs != nil {
+		b.addIn("id", f.IDs)
+	}
+	if f.Ages != nil {
+		b.addIn("age", f.Ages)
+	}
+	if f.AfterID > 0 {
+		b.add("id > ?", f.AfterID)
+	}
+	if f.MinAge != nil {
+		b.add("age >= ?", *f.MinAge)
+	}
+	if f.MaxAge != nil {
+		b.add("age <= ?", *f.MaxAge)
+	}
+	return b.build()
+}
+
+// escapeLike はLIKEのワイルドカード（% と _）をエスケープします。
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// sortFields は ?sort= で指定できる並び順のカラムです。
+var sortFields = []string{"id", "name", "age", "created_at", "updated_at"}
+
+// userSort は一覧の並び順です。Field が空の場合はID順です。
+type userSort struct {
+	Field string
+	Desc  bool
+}
+
+// orderBy はORDER BY句を返します。同じ値のユーザーはID順に並べます。
+// Field は sortFields に含まれていることを呼び出し側で確認します。
+func (s userSort) orderBy() string {
+	field := s.Field
+	if field == "" {
+		field = "id"
+	}
+	clause := " ORDER BY " + field
+	if s.Desc {
+		clause += " DESC"
+	}
+	if field != "id" {
+		clause += ", id"
+	}
+	return clause
+}
+
+// ForEach は条件に一致するユーザーを sort の順に1件ずつ読み込み、fn を呼び出します。
+// 全件をメモリに読み込まないので、大量のデータの書き出しや一括処理に使えます。
+// fn がエラーを返した場合はそこで読み込みを止め、そのエラーを返します。
+func (r *userRepository) ForEach(ctx context.Context, filter userFilter, sort userSort, fn func(User) error) error {
+	where, args := r.where(filter)
+	rows, err := r.conn(ctx).QueryContext(ctx, "SELECT "+userColumns+" FROM users"+where+sort.orderBy(), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := r.scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ForEachChunked は ForEach と同じくユーザーをID順に fn に渡しますが、chunkSize 件ずつ別々のクエリで読み込みます。
+// 1つの長い読み取りを続けないので、件数が多くても書き込みを長く待たせません。
+// 読み込みの途中で追加・削除されたユーザーは、まだ読んでいない範囲であれば結果に反映されます。
+func (r *userRepository) ForEachChunked(ctx context.Context, filter userFilter, chunkSize int, fn func(User) error) error {
+	if chunkSize <= 0 {
+		return r.ForEach(ctx, filter, userSort{}, fn)
+	}
+	for {
+		users, err := r.List(ctx, filter, userSort{}, chunkSize, 0)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < chunkSize {
+			return nil
+		}
+		filter.AfterID = users[len(users)-1].ID
+	}
+}
+
+// List は条件に一致するユーザーを sort の順に、offset 件目から最大 limit 件返します。
+func (r *userRepository) List(ctx context.Context, filter userFilter, sort userSort, limit, offset int) ([]User, error) {
+	where, args := r.where(filter)
+	return r.queryUsers(ctx, "SELECT "+userColumns+" FROM users"+where+sort.orderBy()+" LIMIT ? OFFSET ?",
+		append(args, limit, offset)...)
+}
+
+// Count は条件に一致するユーザーの件数を返します。
+func (r *userRepository) Count(ctx context.Context, filter userFilter) (int, error) {
+	where, args := r.where(filter)
+	var n int
+	err := r.conn(ctx).QueryRowContext(ctx, "SELECT COUNT(*) FROM users"+where, args...).Scan(&n)
+	return n, err
+}
+
+// Get は指定されたIDのユーザーを返します。見つからない場合は sql.ErrNoRows を返します。
+func (r *userRepository) Get(ctx context.Context, id int) (User, error) {
+	return r.scanUser(r.conn(ctx).QueryRowContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE id = ? AND deleted_at IS NULL", id))
+}
+
+// GetIncludingDeleted は Get と同じですが、論理削除済みのユーザーも返します。
+func (r *userRepository) GetIncludingDeleted(ctx context.Context, id int) (User, error) {
+	return r.scanUser(r.conn(ctx).QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+// Exists は指定されたIDの（削除されていない）ユーザーがいるかどうかを返します。
+// 行の中身が不要な場合に、Get の代わりに使います。
+func (r *userRepository) Exists(ctx context.Context, id int) (bool, error) {
+	var one int
+	err := r.conn(ctx).QueryRowContext(ctx,
+		"SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL LIMIT 1", id).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NeighborIDs は id の前後で最も近い、存在するユーザーのIDを返します。該当がない側は0です。
+// 主キーの範囲検索なので、件数が多くても速く終わります。
+func (r *userRepository) NeighborIDs(ctx context.Context, id int) (prev, next int, err error) {
+	var p, n sql.NullInt64
+	err = r.conn(ctx).QueryRowContext(ctx,
+		"SELECT (SELECT MAX(id) FROM users WHERE id < ? AND deleted_at IS NULL), (SELECT MIN(id) FROM users WHERE id > ? AND deleted_at IS NULL)",
+		id, id).Scan(&p, &n)
+	return int(p.Int64), int(n.Int64), err
+}
+
+// LastModified は条件に一致するユーザーの updated_at の最大値を返します。該当がない場合はゼロ値です。
+// 削除も updated_at を更新するため、削除済みのユーザーも含めて計算し、削除を変更として検出します。
+func (r *userRepository) LastModified(ctx context.Context, filter userFilter) (time.Time, error) {
+	filter.IncludeDeleted = true
+	where, args := r.where(filter)
+	var max sql.NullString
+	if err := r.conn(ctx).QueryRowContext(ctx, "SELECT MAX(updated_at) FROM users"+where, args...).Scan(&max); err != nil {
+		return time.Time{}, err
+	}
+	if !max.Valid {
+		return time.Time{}, nil
+	}
+	return time.Parse(timestampFormat, max.String)
+}
+
+// GetByEmail はメールアドレスが一致するユーザーを1件返します。
+// 大文字小文字は区別しません。見つからない場合は sql.ErrNoRows を返します。
+func (r *userRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	values := r.emails.lookupValues(r.normalizeEmail(email))
+	return r.scanUser(r.conn(ctx).QueryRowContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE "+emailCondition(len(values))+" AND deleted_at IS NULL LIMIT 1", values...))
+}
+
+// emailCondition は n 個の値のいずれかにメールアドレスが一致する条件を返します。
+func emailCondition(n int) string {
+	conds := make([]string, n)
+	for i := range conds {
+		conds[i] = "email = ? COLLATE NOCASE"
+	}
+	// email <> '' を条件に含めることで、部分インデックス idx_users_email が使われます。
+	return "(" + strings.Join(conds, " OR ") + ") AND email <> ''"
+}
+
+// GetByIDs は指定されたIDのユーザーをまとめて返します。存在しないIDは結果に含まれません。
+func (r *userRepository) GetByIDs(ctx context.Context, ids []int) ([]User, error) {
+	if len(ids) == 0 {
+		return []User{}, nil
+	}
+	where, args := r.where(userFilter{IDs: ids})
+	return r.queryUsers(ctx, "SELECT "+userColumns+" FROM users"+where, args...)
+}
+
+// GetByIDsInOrder は GetByIDs と同じですが、結果を ids の順番に並べ替えて返します。
+// IN の条件で取得した行の順番は決まっていないため、指定した順番で表示したいクライアントのためのものです。
+// 同じIDが複数回指定された場合は、その位置ごとに同じユーザーを含めます。
+func (r *userRepository) GetByIDsInOrder(ctx context.Context, ids []int) ([]User, error) {
+	found, err := r.GetByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]User, len(found))
+	for _, user := range found {
+		byID[user.ID] = user
+	}
+	users := make([]User, 0, len(found))
+	for _, id := range ids {
+		if user, ok := byID[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// Recent は新しく作成された順に最大 n 件のユーザーを返します。
+// created_at が同じ場合はIDの降順です。
+func (r *userRepository) Recent(ctx context.Context, n int) ([]User, error) {
+	return r.queryUsers(ctx,
+		"SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL ORDER BY created_at DESC, id DESC LIMIT ?", n)
+}
+
+// groupableColumns は CountGroupedBy で集計できるカラムです。
+// カラム名はSQLに直接埋め込むため、ここにあるものだけを受け付けます。
+var groupableColumns = map[string]bool{"age": true, "name": true}
+
+// errInvalidGroupColumn は集計できないカラムが指定された場合に返されます。
+var errInvalidGroupColumn = errors.New("invalid group column")
+
+// groupCount は CountGroupedBy の1グループです。Value はカラムの型のまま（age は数値、name は文字列）です。
+type groupCount struct {
+	Value interface{} `json:"value"`
+	Count int64       `json:"count"`
+}
+
+// CountGroupedBy は column の値ごとのユーザー数を値の順に返します（削除済みのユーザーは含めません）。
+// column が groupableColumns にない場合は errInvalidGroupColumn を返します。
+func (r *userRepository) CountGroupedBy(ctx context.Context, column string) ([]groupCount, error) {
+	if !groupableColumns[column] {
+		return nil, errInvalidGroupColumn
+	}
+	rows, err := r.conn(ctx).QueryContext(ctx,
+		"SELECT "+column+", COUNT(*) FROM users WHERE deleted_at IS NULL GROUP BY "+column+" ORDER BY "+column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []groupCount{}
+	for rows.Next() {
+		var g groupCount
+		if err := rows.Scan(&g.Value, &g.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, g)
+	}
+	return counts, rows.Err()
+}
+
+// txKey はコンテキストに実行中のトランザクションを保存するためのキーです。
+type txKey struct{}
+
+// txState は実行中のトランザクションと、セーブポイントの入れ子の深さです。
+type txState struct {
+	tx    *sql.Tx
+	depth int
+}
+
+// withTx は fn をトランザクション内で実行します。fn がエラーを返した場合はロールバックし、
+// それ以外はコミットします。
+// ctx がすでにトランザクション内の場合は新しいトランザクションを開始せず、SAVEPOINT を作成します。
+// 内側の fn が失敗した場合はセーブポイントまでロールバックするだけなので、
+// 外側のトランザクションは続行できます。
+func (r *userRepository) withTx(ctx context.Context, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	if state, ok := ctx.Value(txKey{}).(*txState); ok {
+		return withSavepoint(ctx, state, fn)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(context.WithValue(ctx, txKey{}, &txState{tx: tx}), tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// withReadTx は fn を読み取りだけのトランザクション内で実行し、fn の中のクエリが同じ時点の内容を読むようにします。
+// BEGIN（DEFERRED）で開始するので、最初に読み込んだ時点で読み取りのロックを取るだけで、書き込みのロックは取りません。
+// WALモードでは書き込みを待たせませんが、それ以外のジャーナルモードでは、終わるまで他の書き込みのコミットを待たせます。
+// 読み取り用のDB（readDB）を使うリクエストではそちらで、ctx がすでにトランザクション内の場合はそのトランザクションで実行します。
+func (r *userRepository) withReadTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*txState); ok {
+		return fn(ctx)
+	}
+	db := r.snapshotDB
+	if r.readDB != nil && ctx.Value(readRequestKey{}) != nil {
+		db = r.readDB
+	}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	// 書き込んでいないので、コミットせずに終える
+	defer tx.Rollback()
+	return fn(context.WithValue(ctx, txKey{}, &txState{tx: tx}))
+}
+
+// txMiddleware はリクエスト全体を1つのトランザクションで実行するミドルウェアを返します。
+// ハンドラ内のリポジトリ操作は conn(ctx) を通じてこのトランザクションを使い、withTx はセーブポイントになります。
+// ハンドラが2xxで終わればコミットし、エラーやパニックの場合はロールバックします。
+// レスポンスはコミットより先に書き込まれるため、コミット自体が失敗した場合はログに残すだけになります。
+func (r *userRepository) txMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			req := c.Request()
+			tx, err := r.db.BeginTx(req.Context(), nil)
+			if err != nil {
+				return err
+			}
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), txKey{}, &txState{tx: tx})))
+
+			defer func() {
+				if p := recover(); p != nil {
+					tx.Rollback()
+					panic(p)
+				}
+			}()
+
+			if err := next(c); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if status := c.Response().Status; status < 200 || status >= 300 {
+				tx.Rollback()
+				return nil
+			}
+			if err := tx.Commit(); err != nil {
+				log.Printf("failed to commit request transaction: %v", err)
+			}
+			return nil
+		}
+	}
+}
+
+func withSavepoint(ctx context.Context, state *txState, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	inner := &txState{tx: state.tx, depth: state.depth + 1}
+	// セーブポイント名はプレースホルダを使えないため、入れ子の深さから生成します。
+	name := fmt.Sprintf("sp_%d", inner.depth)
+	if _, err := state.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	if err := fn(context.WithValue(ctx, txKey{}, inner), state.tx); err != nil {
+		// ROLLBACK TO はセーブポイント自体を残すため、続けて RELEASE で取り除きます。
+		state.tx.ExecContext(ctx, "ROLLBACK TO "+name)
+		state.tx.ExecContext(ctx, "RELEASE "+name)
+		return err
+	}
+	_, err := state.tx.ExecContext(ctx, "RELEASE "+name)
+	return err
+}
+
+// Create はユーザーを登録し、採番されたIDを設定して返します。
+// withTx の中から呼ばれた場合はセーブポイントとして実行されます。
+func (r *userRepository) Create(ctx context.Context, user User) (User, error) {
+	now := r.now().UTC().Truncate(time.Millisecond)
+	user.CreatedAt, user.UpdatedAt = now, now
+	user.Email = r.normalizeEmail(user.Email)
+	user.Status = statusActive
+	user.CreatedBy, user.UpdatedBy = actor(ctx), actor(ctx)
+	err := r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx,
+			"INSERT INTO users(name, age, email, created_at, updated_at, created_by, updated_by) VALUES(?, ?, ?, ?, ?, ?, ?)",
+			user.Name, user.Age, r.emails.encrypt(user.Email), formatTimestamp(now), formatTimestamp(now), user.CreatedBy, user.UpdatedBy)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		user.ID = int(id)
+		return err
+	})
+	if err != nil {
+		return User{}, uniqueViolation(err)
+	}
+	return user, nil
+}
+
+// Update は指定されたユーザーの名前、年齢、メールアドレスを更新し、更新後のユーザーを返します。
+// 見つからない場合は sql.ErrNoRows を返します。
+func (r *userRepository) Update(ctx context.Context, user User) (User, error) {
+	updated, err := r.scanUser(r.conn(ctx).QueryRowContext(ctx,
+		"UPDATE users SET name = ?, age = ?, email = ?, updated_at = ?, updated_by = ? WHERE id = ? AND deleted_at IS NULL RETURNING "+userColumns,
+		user.Name, user.Age, r.emails.encrypt(r.normalizeEmail(user.Email)), formatTimestamp(r.now()), actor(ctx), user.ID))
+	return updated, uniqueViolation(err)
+}
+
+// errPreconditionFailed はユーザーは存在するものの、更新の条件に一致しなかった場合に返されます。
+var errPreconditionFailed = errors.New("precondition failed")
+
+// Patch は patch で指定されたフィールドだけを更新し、更新後のユーザーを返します。
+// pre の条件は WHERE 句に含めます。ユーザーがいない場合は sql.ErrNoRows を、
+// いるものの条件に一致しない場合は errPreconditionFailed を返します。
+func (r *userRepository) Patch(ctx context.Context, id int, patch userPatch, pre userPrecondition) (User, error) {
+	sets := []string{"updated_at = ?", "updated_by = ?"}
+	args := []interface{}{formatTimestamp(r.now()), actor(ctx)}
+	if patch.Name != nil {
+		sets = append(sets, "name = ?")
+		args = append(args, *patch.Name)
+	}
+	if patch.Age != nil {
+		sets = append(sets, "age = ?")
+		args = append(args, *patch.Age)
+	}
+	if patch.Email != nil {
+		sets = append(sets, "email = ?")
+		args = append(args, r.emails.encrypt(r.normalizeEmail(*patch.Email)))
+	}
+
+	var b whereBuilder
+	b.add("id = ?", id)
+	b.add("deleted_at IS NULL")
+	if pre.Name != nil {
+		b.add("name = ?", *pre.Name)
+	}
+	if pre.Age != nil {
+		b.add("age = ?", *pre.Age)
+	}
+	if pre.Email != nil {
+		if *pre.Email == "" {
+			b.add("email = ''")
+		} else {
+			values := r.emails.lookupValues(r.normalizeEmail(*pre.Email))
+			b.add(emailCondition(len(values)), values...)
+		}
+	}
+	where, whereArgs := b.build()
+	args = append(args, whereArgs...)
+
+	var user User
+	err := r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		user, err = r.scanUser(tx.QueryRowContext(ctx,
+			"UPDATE users SET "+strings.Join(sets, ", ")+where+" RETURNING "+userColumns,
+			args...))
+		if !errors.Is(err, sql.ErrNoRows) {
+			return uniqueViolation(err)
+		}
+		// 更新されなかった理由が、ユーザーがいないのか条件に一致しないのかを区別する
+		if ok, existsErr := r.Exists(ctx, id); existsErr != nil {
+			return existsErr
+		} else if ok {
+			return errPreconditionFailed
+		}
+		return err
+	})
+	return user, err
+}
+
+// Delete はユーザーを論理削除します（deleted_at を設定するだけで行は残ります）。
+// 削除した場合はtrue、該当するユーザーがいない場合はfalseを返します。
+func (r *userRepository) Delete(ctx context.Context, id int) (bool, error) {
+	now := formatTimestamp(r.now())
+	result, err := r.conn(ctx).ExecContext(ctx,
+		"UPDATE users SET deleted_at = ?, updated_at = ?, updated_by = ? WHERE id = ? AND deleted_at IS NULL", now, now, actor(ctx), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteMatching は条件に一致するユーザーをまとめて論理削除し、削除した件数を返します。
+// 1つのUPDATE文で実行するので、途中までしか削除されないことはありません。
+func (r *userRepository) DeleteMatching(ctx context.Context, filter userFilter) (int64, error) {
+	filter.IncludeDeleted = false
+	where, args := r.where(filter)
+	now := formatTimestamp(r.now())
+	result, err := r.conn(ctx).ExecContext(ctx,
+		"UPDATE users SET deleted_at = ?, updated_at = ?, updated_by = ?"+where, append([]interface{}{now, now, actor(ctx)}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeDeleted は before より前に論理削除されたユーザーを物理削除し、削除した件数を返します。
+// そのユーザーの投稿も外部キー（ON DELETE CASCADE）で一緒に削除されます。
+func (r *userRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.conn(ctx).ExecContext(ctx,
+		"DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < ?", formatTimestamp(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// anonymizedName は匿名化したユーザーの名前です。
+const anonymizedName = "Anonymous"
+
+// Anonymize は条件に一致するユーザーの名前を anonymizedName に、メールアドレスを空文字にして anonymized_at を記録し、
+// 匿名化した件数を返します。投稿からの参照が切れないよう、行は削除しません（論理削除済みのユーザーも対象です）。
+// 匿名化済みのユーザーは数えません。uniqueNames がtrue（UNIQUE_NAMES）の場合は、名前が重複しないよう末尾にIDを付けます。
+func (r *userRepository) Anonymize(ctx context.Context, filter userFilter, uniqueNames bool) (int64, error) {
+	filter.IncludeDeleted = true
+	where, args := r.where(filter)
+	if where == "" {
+		where = " WHERE anonymized_at IS NULL"
+	} else {
+		where += " AND anonymized_at IS NULL"
+	}
+	name := "?"
+	if uniqueNames {
+		name = "? || ' ' || id"
+	}
+	now := formatTimestamp(r.now())
+	var anonymized int64
+	err := r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := r.conn(ctx).ExecContext(ctx,
+			"UPDATE users SET name = "+name+", email = '', anonymized_at = ?, updated_at = ?, updated_by = ?"+where,
+			append([]interface{}{anonymizedName, now, now, actor(ctx)}, args...)...)
+		if err != nil {
+			return uniqueViolation(err)
+		}
+		anonymized, err = result.RowsAffected()
+		return err
+	})
+	return anonymized, err
+}
+
+// Merge は remove のユーザーの投稿を keep のユーザーに付け替えてから remove を論理削除し、
+// 残った keep のユーザーを返します。どちらかが存在しない場合は errUserNotFound を返します。
+func (r *userRepository) Merge(ctx context.Context, keep, remove int) (User, error) {
+	var merged User
+	err := r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		for _, id := range []int{keep, remove} {
+			if ok, err := r.Exists(ctx, id); err != nil {
+				return err
+			} else if !ok {
+				return errUserNotFound{ID: id}
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE posts SET user_id = ? WHERE user_id = ?", keep, remove); err != nil {
+			return err
+		}
+		if _, err := r.Delete(ctx, remove); err != nil {
+			return err
+		}
+		var err error
+		merged, err = r.Get(ctx, keep)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return merged, nil
+}
+
+// upsertResult は UpsertByEmail の1件ごとの結果です。Outcome は "created" か "updated" です。
+type upsertResult struct {
+	Index   int    `json:"index"`
+	ID      int    `json:"id"`
+	Outcome string `json:"outcome"`
+	// User は登録・更新後のユーザーです（レスポンスには含めません）。
+	User User `json:"-"`
+}
+
+// bulkRecordError は一括処理で index 番目（0始まり）のレコードが失敗したことを表します。
+type bulkRecordError struct {
+	Index int
+	Err   error
+}
+
+func (e bulkRecordError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Index, e.Err)
+}
+
+func (e bulkRecordError) Unwrap() error {
+	return e.Err
+}
+
+// bulkRecord は一括処理の1件と、リクエスト内での番号（0始まり）です。
+type bulkRecord struct {
+	Index int
+	User  User
+}
+
+// UpsertByEmail はユーザーをメールアドレスで照合し、既存のユーザー（大文字小文字を区別しない）は更新、
+// いなければ新しく登録します。すべてを1つのトランザクションで行います。
+// partial がfalseの場合、1件でも失敗したら何も変更せずに bulkRecordError を返します。
+// partial がtrueの場合は1件ずつセーブポイントで実行し、失敗したレコードだけを取り消して failed に返します。
+// メールアドレスはスキーマ上一意ではないため ON CONFLICT は使えず、1件ずつ検索してから書き込みます。
+func (r *userRepository) UpsertByEmail(ctx context.Context, records []bulkRecord, partial bool) (results []upsertResult, failed []bulkRecordError, err error) {
+	results = make([]upsertResult, 0, len(records))
+	err = r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		for _, rec := range records {
+			var result upsertResult
+			// withTx はトランザクションの中ではセーブポイントになる
+			err := r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+				var err error
+				result, err = r.upsertOne(ctx, rec)
+				return err
+			})
+			if err != nil {
+				recErr := bulkRecordError{Index: rec.Index, Err: err}
+				if !partial {
+					return recErr
+				}
+				failed = append(failed, recErr)
+				continue
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, failed, nil
+}
+
+func (r *userRepository) upsertOne(ctx context.Context, rec bulkRecord) (upsertResult, error) {
+	user := rec.User
+	outcome := "updated"
+	existing, err := r.GetByEmail(ctx, user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		outcome = "created"
+		user, err = r.Create(ctx, user)
+	} else if err == nil {
+		user.ID = existing.ID
+		user, err = r.Update(ctx, user)
+	}
+	if err != nil {
+		return upsertResult{}, err
+	}
+	return upsertResult{Index: rec.Index, ID: user.ID, Outcome: outcome, User: user}, nil
+}
+
+// CompareAndSwapAge は、ユーザーの年齢が expected の場合にだけ new に変更します。
+// 確認と変更を1つのUPDATE文で行うので、他のリクエストの更新と競合しても取りこぼしや上書きは起きません。
+// 変更した場合はtrue、年齢が expected でない場合やユーザーがいない場合はfalseを返します。
+func (r *userRepository) CompareAndSwapAge(ctx context.Context, id, expected, new int) (bool, error) {
+	result, err := r.conn(ctx).ExecContext(ctx,
+		"UPDATE users SET age = ?, updated_at = ?, updated_by = ? WHERE id = ? AND age = ? AND deleted_at IS NULL",
+		new, formatTimestamp(r.now()), actor(ctx), id, expected)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// AdjustAges は指定されたユーザーの年齢に delta を加算し、更新した件数を返します。
+// ids が nil の場合は全ユーザーが対象です。1人でも有効範囲（minAge 以上 maxAge 未満）の外に
+// なる場合は何も更新せず errAgeOutOfRange を返します。
+func (r *userRepository) AdjustAges(ctx context.Context, delta int, ids []int, minAge int) (int64, error) {
+	if ids != nil && len(ids) == 0 {
+		return 0, nil
+	}
+	where, args := r.where(userFilter{IDs: ids})
+
+	var updated int64
+	err := r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		// 更新後に範囲外となるユーザーがいないかを先に確認
+		var outOfRange int
+		checkArgs := append(append([]interface{}{}, args...), delta, minAge, delta, maxAge)
+		if err := tx.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM users"+where+" AND (age + ? < ? OR age + ? >= ?)", checkArgs...,
+		).Scan(&outOfRange); err != nil {
+			return err
+		}
+		if outOfRange > 0 {
+			return errAgeOutOfRange
+		}
+
+		result, err := tx.ExecContext(ctx,
+			"UPDATE users SET age = age + ?, updated_at = ?, updated_by = ?"+where,
+			append([]interface{}{delta, formatTimestamp(r.now()), actor(ctx)}, args...)...)
+		if err != nil {
+			return err
+		}
+		updated, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return updated, nil
+}
+
+// errTableNotEmpty はusersテーブルに行が残っている場合に返されます。
+var errTableNotEmpty = errors.New("users table is not empty")
+
+// CompactIDs はユーザーのIDを1からの連番に振り直し、投稿の user_id も合わせて書き換えます。
+// 変更したIDの旧→新の対応を返します。削除済みのユーザーも行が残っているため振り直しの対象です。
+// IDの小さい順に処理するので、新しいIDは常に空いています（それより前のユーザーはすでに手前に詰めてある）。
+// 外部キーは途中で一時的に不整合になるため、検査をコミット時まで遅らせます。
+func (r *userRepository) CompactIDs(ctx context.Context) (map[int]int, error) {
+	mapping := map[int]int{}
+	err := r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "PRAGMA defer_foreign_keys = ON"); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, "SELECT id FROM users ORDER BY id")
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i, old := range ids {
+			id := i + 1
+			if id == old {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE users SET id = ? WHERE id = ?", id, old); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE posts SET user_id = ? WHERE user_id = ?", id, old); err != nil {
+				return err
+			}
+			mapping[old] = id
+		}
+		// 次に登録するユーザーが最後のIDの次から採番されるようにする
+		_, err = tx.ExecContext(ctx, "UPDATE sqlite_sequence SET seq = ? WHERE name = 'users'", len(ids))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// ResetSequence はusersのAUTOINCREMENTの採番をリセットし、次のIDが1から始まるようにします。
+// 論理削除された行もIDを使っているため、テーブルが完全に空でない場合は errTableNotEmpty を返します。
+func (r *userRepository) ResetSequence(ctx context.Context) error {
+	return r.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return errTableNotEmpty
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM sqlite_sequence WHERE name = 'users'")
+		return err
+	})
+}
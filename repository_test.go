@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func TestWithTxSavepoint(t *testing.T) {
+	s := newTestServer(t, nil)
+	repo := newUserRepository(s.db)
+	ctx := context.Background()
+	errInner := errors.New("inner failed")
+
+	err := repo.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := repo.Create(ctx, User{Name: "Outer", Age: 30}); err != nil {
+			return err
+		}
+		// 内側の失敗はセーブポイントまでのロールバックで、外側は続けられる
+		err := repo.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := repo.Create(ctx, User{Name: "Inner", Age: 20}); err != nil {
+				return err
+			}
+			return errInner
+		})
+		if !errors.Is(err, errInner) {
+			t.Errorf("inner withTx = %v, want %v", err, errInner)
+		}
+		_, err = repo.Create(ctx, User{Name: "After", Age: 40})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUserNames(t, repo, "Outer", "After")
+
+	// 外側が失敗した場合は、成功した内側の変更も含めてすべてロールバックする
+	err = repo.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		if err := repo.withTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+			_, err := repo.Create(ctx, User{Name: "Nested", Age: 20})
+			return err
+		}); err != nil {
+			return err
+		}
+		return errInner
+	})
+	if !errors.Is(err, errInner) {
+		t.Fatalf("outer withTx = %v, want %v", err, errInner)
+	}
+	assertUserNames(t, repo, "Outer", "After")
+}
+
+// assertUserNames は削除されていないユーザーの名前が、ID順で want と一致することを確認します。
+func assertUserNames(t *testing.T, repo *userRepository, want ...string) {
+	t.Helper()
+	users, err := repo.List(context.Background(), userFilter{}, userSort{}, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, u := range users {
+		got = append(got, u.Name)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("users = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("users = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestForEachStopsOnError(t *testing.T) {
+	s := newTestServer(t, nil)
+	insertUsers(t, s, 5)
+	repo := newUserRepository(s.db)
+	ctx := context.Background()
+	errStop := errors.New("stop")
+
+	for _, chunkSize := range []int{0, 2} {
+		var got []string
+		err := repo.ForEachChunked(ctx, userFilter{}, chunkSize, func(u User) error {
+			got = append(got, u.Name)
+			if len(got) == 3 {
+				return errStop
+			}
+			return nil
+		})
+		if !errors.Is(err, errStop) {
+			t.Errorf("chunk size %d: err = %v, want %v", chunkSize, err, errStop)
+		}
+		if len(got) != 3 || got[0] != "user0" || got[2] != "user2" {
+			t.Errorf("chunk size %d: visited %v", chunkSize, got)
+		}
+	}
+
+	// 途中で止めても行は閉じられ、続けて書き込める
+	if _, err := repo.Create(ctx, User{Name: "After", Age: 40}); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := repo.ForEach(ctx, userFilter{}, userSort{Desc: true}, func(u User) error {
+		if n == 0 && u.Name != "After" {
+			t.Errorf("first user in descending order = %s", u.Name)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("ForEach visited %d users, want 6", n)
+	}
+}
+
+func TestTxMiddleware(t *testing.T) {
+	s := newTestServer(t, nil)
+	repo := newUserRepository(s.db)
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) { c.NoContent(http.StatusInternalServerError) }
+	create := func(c echo.Context, name string) {
+		if _, err := repo.Create(c.Request().Context(), User{Name: name, Age: 20}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.POST("/ok", func(c echo.Context) error {
+		create(c, "First")
+		create(c, "Second")
+		return c.NoContent(http.StatusCreated)
+	}, repo.txMiddleware())
+	e.POST("/error", func(c echo.Context) error {
+		create(c, "Error")
+		return errors.New("failed midway")
+	}, repo.txMiddleware())
+	e.POST("/status", func(c echo.Context) error {
+		create(c, "Status")
+		return c.NoContent(http.StatusConflict)
+	}, repo.txMiddleware())
+	e.POST("/panic", func(c echo.Context) error {
+		create(c, "Panic")
+		panic("boom")
+	}, middleware.Recover(), repo.txMiddleware())
+
+	for _, path := range []string{"/ok", "/error", "/status", "/panic"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+	}
+	// 2xxで終わったリクエストの書き込みだけが残る
+	assertUserNames(t, repo, "First", "Second")
+}
+
+func TestExists(t *testing.T) {
+	s := newTestServer(t, nil)
+	insertUsers(t, s, 2)
+	if _, err := s.db.Exec("UPDATE users SET deleted_at = updated_at WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	repo := newUserRepository(s.db)
+	for id, want := range map[int]bool{1: true, 2: false, 3: false} {
+		got, err := repo.Exists(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Exists(%d) = %v, want %v", id, got, want)
+		}
+	}
+
+	// 投稿の一覧も存在の確認だけで404を返す
+	expectStatus(t, request(s, http.MethodGet, "/users/1/posts", ""), http.StatusOK)
+	expectStatus(t, request(s, http.MethodGet, "/users/3/posts", ""), http.StatusNotFound)
+}
+
+func TestCompareAndSwapAge(t *testing.T) {
+	s := newTestServer(t, nil)
+	insertUsers(t, s, 1)
+	repo := newUserRepository(s.db)
+	ctx := context.Background()
+
+	tests := []struct {
+		id, expected, new int
+		want              bool
+	}{
+		{1, 20, 21, true},
+		// 直前の交換で年齢が変わったので、同じ expected では交換しない
+		{1, 20, 22, false},
+		{1, 21, 22, true},
+		{2, 20, 21, false},
+	}
+	for _, tt := range tests {
+		swapped, err := repo.CompareAndSwapAge(ctx, tt.id, tt.expected, tt.new)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if swapped != tt.want {
+			t.Errorf("CompareAndSwapAge(%d, %d, %d) = %v, want %v", tt.id, tt.expected, tt.new, swapped, tt.want)
+		}
+	}
+	u, err := repo.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Age != 22 {
+		t.Errorf("age = %d, want 22", u.Age)
+	}
+
+	// エンドポイントは失敗の理由を区別する
+	expectStatus(t, request(s, http.MethodPost, "/users/1/age/cas", `{"expected":22,"new":23}`), http.StatusOK)
+	rec := request(s, http.MethodPost, "/users/1/age/cas", `{"expected":22,"new":24}`)
+	expectStatus(t, rec, http.StatusConflict)
+	var body errorResponse
+	decode(t, rec, &body)
+	if body.Code != codeAgeMismatch {
+		t.Errorf("code = %q", body.Code)
+	}
+	expectStatus(t, request(s, http.MethodPost, "/users/2/age/cas", `{"expected":20,"new":21}`), http.StatusNotFound)
+	expectStatus(t, request(s, http.MethodPost, "/users/1/age/cas", `{"new":21}`), http.StatusBadRequest)
+	expectStatus(t, request(s, http.MethodPost, "/users/1/age/cas", `{"expected":23,"new":500}`), http.StatusBadRequest)
+}
+
+func TestGetByIDsInOrder(t *testing.T) {
+	s := newTestServer(t, nil)
+	insertUsers(t, s, 5)
+	repo := newUserRepository(s.db)
+	idsOf := func(users []User) string {
+		ids := []int{}
+		for _, u := range users {
+			ids = append(ids, u.ID)
+		}
+		return fmt.Sprint(ids)
+	}
+
+	// IN の条件だけではIDの順番に返ってくるので、指定した順番とは異なる
+	ids := []int{4, 2, 99, 5, 1, 2}
+	found, err := repo.GetByIDs(context.Background(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idsOf(found) == "[4 2 5 1 2]" {
+		t.Fatalf("GetByIDs already returned the requested order: %s", idsOf(found))
+	}
+
+	tests := []struct {
+		ids  []int
+		want string
+	}{
+		{ids, "[4 2 5 1 2]"},
+		{[]int{5, 4, 3, 2, 1}, "[5 4 3 2 1]"},
+		{[]int{3}, "[3]"},
+		{[]int{98, 99}, "[]"},
+		{nil, "[]"},
+	}
+	for _, tt := range tests {
+		users, err := repo.GetByIDsInOrder(context.Background(), tt.ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := idsOf(users); got != tt.want {
+			t.Errorf("GetByIDsInOrder(%v) = %s, want %s", tt.ids, got, tt.want)
+		}
+	}
+
+	rec := request(s, http.MethodGet, "/users/batch?ids=5,1,3", "")
+	expectStatus(t, rec, http.StatusOK)
+	var res batchResponse
+	decode(t, rec, &res)
+	if got := idsOf(res.Found); got != "[5 1 3]" {
+		t.Errorf("GET /users/batch?ids=5,1,3 = %s", got)
+	}
+}
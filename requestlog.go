@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// requestLogEntry は requests_log テーブルに保存するリクエストの情報です。
+type requestLogEntry struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+}
+
+// requestLogger はサンプリングしたリクエストを requests_log テーブルに保存します。
+// 書き込みのリクエストは sampleRate、読み取り（GET/HEAD/OPTIONS）は readSampleRate の割合で記録します。
+// 書き込みはバックグラウンドで行い、キューが満杯のときは破棄するのでリクエストを遅らせません。
+type requestLogger struct {
+	db             *sql.DB
+	sampleRate     float64
+	readSampleRate float64
+	queue          chan requestLogEntry
+}
+
+func newRequestLogger(db *sql.DB, sampleRate, readSampleRate float64, workers *workerGroup) *requestLogger {
+	l := &requestLogger{db: db, sampleRate: sampleRate, readSampleRate: readSampleRate, queue: make(chan requestLogEntry, 256)}
+	workers.Go("request log", l.run)
+	return l
+}
+
+// run はキューの記録を書き込みます。ctx がキャンセルされたら、キューに残っている分を書き込んでから戻ります。
+func (l *requestLogger) run(ctx context.Context) {
+	for {
+		select {
+		case entry := <-l.queue:
+			l.write(entry)
+		case <-ctx.Done():
+			for {
+				select {
+				case entry := <-l.queue:
+					l.write(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *requestLogger) write(entry requestLogEntry) {
+	_, err := l.db.Exec(
+		"INSERT INTO requests_log(created_at, method, path, status, latency_ms) VALUES(?, ?, ?, ?, ?)",
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano), entry.Method, entry.Path, entry.Status, entry.LatencyMS)
+	if err != nil {
+		log.Printf("failed to write request log: %v", err)
+	}
+}
+
+// middleware はリクエストを種類に応じた割合で記録するミドルウェアを返します。
+func (l *requestLogger) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			rate := l.sampleRate
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				rate = l.readSampleRate
+			}
+			if rand.Float64() >= rate {
+				return err
+			}
+			// ステータスコードを確定させるため、ここでエラーハンドラを呼ぶ
+			if err != nil {
+				c.Error(err)
+			}
+			entry := requestLogEntry{
+				CreatedAt: start,
+				Method:    c.Request().Method,
+				Path:      c.Request().URL.Path,
+				Status:    c.Response().Status,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			select {
+			case l.queue <- entry:
+			default:
+				// キューが満杯の場合は記録を諦める
+			}
+			return nil
+		}
+	}
+}
+
+// requestLogHandler は記録されたリクエストを新しい順に返します。
+// ?method=, ?path=（前方一致）, ?status=, ?limit= で絞り込めます。
+func requestLogHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		query := "SELECT id, created_at, method, path, status, latency_ms FROM requests_log WHERE 1 = 1"
+		args := []interface{}{}
+		if method := c.QueryParam("method"); method != "" {
+			query += " AND method = ?"
+			args = append(args, method)
+		}
+		if path := c.QueryParam("path"); path != "" {
+			query += " AND substr(path, 1, ?) = ?"
+			args = append(args, len(path), path)
+		}
+		if v := c.QueryParam("status"); v != "" {
+			status, err := strconv.Atoi(v)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "status must be an integer")
+			}
+			query += " AND status = ?"
+			args = append(args, status)
+		}
+		limit := 50
+		if v := c.QueryParam("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+			}
+			if limit > 500 {
+				limit = 500
+			}
+		}
+		query += " ORDER BY id DESC LIMIT ?"
+		args = append(args, limit)
+
+		rows, err := db.QueryContext(c.Request().Context(), query, args...)
+		if err != nil {
+			return dbError(c, err)
+		}
+		defer rows.Close()
+
+		entries := []requestLogEntry{}
+		for rows.Next() {
+			var entry requestLogEntry
+			var createdAt string
+			if err := rows.Scan(&entry.ID, &createdAt, &entry.Method, &entry.Path, &entry.Status, &entry.LatencyMS); err != nil {
+				return dbError(c, err)
+			}
+			entry.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+			entries = append(entries, entry)
+		}
+		if err := rows.Err(); err != nil {
+			return dbError(c, err)
+		}
+		return c.JSON(http.StatusOK, entries)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// loggedMethods はPOSTの記録が書き込まれるまで待って、/users への記録のメソッドを古い順に返します。
+// 記録は1つのキューから順に書き込むので、POSTより前のリクエストの記録も揃っています。
+func loggedMethods(t *testing.T, s *server) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec := request(s, http.MethodGet, "/admin/requests?path=/users", "")
+		expectStatus(t, rec, http.StatusOK)
+		var entries []requestLogEntry
+		decode(t, rec, &entries)
+		if len(entries) > 0 && entries[0].Method == http.MethodPost {
+			methods := []string{}
+			for i := len(entries) - 1; i >= 0; i-- {
+				methods = append(methods, entries[i].Method)
+			}
+			return methods
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("POST was not logged: %+v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRequestLogReads(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		// 読み取りは既定では記録しない
+		{"default", map[string]string{"REQUEST_LOG_SAMPLE_RATE": "1"}, "[POST]"},
+		{"rate without reads", map[string]string{"REQUEST_LOG_SAMPLE_RATE": "1", "REQUEST_LOG_READ_SAMPLE_RATE": "1"}, "[POST]"},
+		{"reads", map[string]string{"REQUEST_LOG_SAMPLE_RATE": "1", "REQUEST_LOG_READS": "true"}, "[GET OPTIONS POST]"},
+		{"reads sampled out", map[string]string{"REQUEST_LOG_SAMPLE_RATE": "1", "REQUEST_LOG_READS": "true", "REQUEST_LOG_READ_SAMPLE_RATE": "0"}, "[POST]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newAdminTestServer(t, tt.env)
+			expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusOK)
+			expectStatus(t, request(s, http.MethodOptions, "/users", ""), http.StatusNoContent)
+			createUser(t, s, "Taro", 30, "taro@example.com")
+			if got := fmt.Sprint(loggedMethods(t, s)); got != tt.want {
+				t.Errorf("logged %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// 読み取りだけを記録する設定でも、記録のミドルウェアを使う
+	s := newAdminTestServer(t, map[string]string{"REQUEST_LOG_READS": "true"})
+	expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusOK)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var entries []requestLogEntry
+		decode(t, request(s, http.MethodGet, "/admin/requests?path=/users", ""), &entries)
+		if len(entries) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("GET was not logged with REQUEST_LOG_READS alone")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
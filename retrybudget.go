@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// retryAttemptHeader はクライアントが再試行であることを示すヘッダーです（1回目の再試行が1）。
+const retryAttemptHeader = "X-Retry-Attempt"
+
+// retryBudget はクライアントごとに、一定時間内の再試行の数をリクエスト数に対する割合で制限します。
+// 障害中にクライアントが一斉に再試行を繰り返すと、回復しかけたサーバーがまた過負荷になるため、
+// 予算を超えた再試行だけを429で断ります（再試行でないリクエストは断りません）。
+// リクエストが少ないクライアントでも再試行できるよう、割合とは別に最低限の回数 min は常に許可します。
+type retryBudget struct {
+	now     func() time.Time
+	percent int
+	min     int
+	window  time.Duration
+
+	// mu は以下のフィールドを守ります。
+	mu        sync.Mutex
+	clients   map[string]*retryWindow
+	lastSweep time.Time
+	// retries は許可した再試行、rejected は予算を超えて断った再試行の累計です。
+	retries, rejected int64
+}
+
+type retryWindow struct {
+	start    time.Time
+	requests int
+	retries  int
+	// keys はこのウィンドウで受け取った Idempotency-Key です。同じキーの2回目以降を再試行とみなします。
+	keys map[string]bool
+}
+
+// newRetryBudget は再試行の予算を作成します。percent はリクエスト数に対して許可する再試行の割合（%）です。
+func newRetryBudget(percent, min int, window time.Duration) *retryBudget {
+	return &retryBudget{now: time.Now, percent: percent, min: min, window: window, clients: map[string]*retryWindow{}}
+}
+
+// take はクライアントのリクエストを数え、再試行であれば予算の範囲内かどうかを返します。
+// attempt は X-Retry-Attempt が1以上の場合にtrue、key は Idempotency-Key です（なければ空文字）。
+// 予算を超えた場合は、ウィンドウの終了時刻とともにfalseを返します。
+func (b *retryBudget) take(client string, attempt bool, key string) (ok bool, reset time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	// 期限切れのウィンドウを定期的に削除してメモリが増え続けないようにする
+	if now.Sub(b.lastSweep) >= b.window {
+		for c, w := range b.clients {
+			if now.Sub(w.start) >= b.window {
+				delete(b.clients, c)
+			}
+		}
+		b.lastSweep = now
+	}
+
+	w, found := b.clients[client]
+	if !found || now.Sub(w.start) >= b.window {
+		w = &retryWindow{start: now, keys: map[string]bool{}}
+		b.clients[client] = w
+	}
+	w.requests++
+	retry := attempt
+	if key != "" {
+		retry = retry || w.keys[key]
+		w.keys[key] = true
+	}
+	if !retry {
+		return true, time.Time{}
+	}
+	if w.retries >= b.allowed(w) {
+		b.rejected++
+		return false, w.start.Add(b.window)
+	}
+	w.retries++
+	b.retries++
+	return true, time.Time{}
+}
+
+// allowed はウィンドウ内で許可する再試行の数です。
+func (b *retryBudget) allowed(w *retryWindow) int {
+	if n := w.requests * b.percent / 100; n > b.min {
+		return n
+	}
+	return b.min
+}
+
+// retryBudgetStats は /metrics に出力する再試行の予算の状態です。
+type retryBudgetStats struct {
+	Clients    int
+	Exhausted  int
+	Retries    int64
+	Rejected   int64
+	Percent    int
+	Min        int
+	WindowSecs float64
+}
+
+// stats は現在のウィンドウで追跡しているクライアント数と、予算を使い切ったクライアント数、累計を返します。
+func (b *retryBudget) stats() retryBudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := retryBudgetStats{Retries: b.retries, Rejected: b.rejected, Percent: b.percent, Min: b.min, WindowSecs: b.window.Seconds()}
+	now := b.now()
+	for _, w := range b.clients {
+		if now.Sub(w.start) >= b.window {
+			continue
+		}
+		s.Clients++
+		if w.retries >= b.allowed(w) {
+			s.Exhausted++
+		}
+	}
+	return s
+}
+
+// retryBudgetMiddleware は X-Retry-Attempt が1以上のリクエストと、同じ Idempotency-Key で再送されたリクエストを再試行として数え、
+// クライアントの予算を超えた再試行に Retry-After 付きの429を返します。クライアントはレート制限と同じ単位（キーのラベルかIP）です。
+func retryBudgetMiddleware(b *retryBudget) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			attempt, _ := strconv.Atoi(req.Header.Get(retryAttemptHeader))
+			ok, reset := b.take(rateLimitClient(c), attempt > 0, req.Header.Get(idempotencyKeyHeader))
+			if ok {
+				return next(c)
+			}
+			retryAfter := int(reset.Sub(b.now()).Seconds() + 0.999)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			setRetryAfter(c, retryAfter)
+			return withCode(echo.NewHTTPError(http.StatusTooManyRequests, "retry budget exceeded: too many retries, back off"),
+				codeRetryBudgetExceeded)
+		}
+	}
+}
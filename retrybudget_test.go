@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetTake(t *testing.T) {
+	now := time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)
+	b := newRetryBudget(50, 1, time.Minute)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		if ok, _ := b.take("a", false, ""); !ok {
+			t.Fatalf("request %d was rejected", i)
+		}
+	}
+	// 再試行もリクエストとして数えるので、50%では再試行でないリクエストと同じ数まで再試行できる
+	for i := 0; i < 4; i++ {
+		if ok, _ := b.take("a", true, ""); !ok {
+			t.Fatalf("retry %d was rejected", i)
+		}
+	}
+	ok, reset := b.take("a", true, "")
+	if ok || !reset.Equal(now.Add(time.Minute)) {
+		t.Errorf("retry over the budget: ok %v, reset %v", ok, reset)
+	}
+	// 再試行でないリクエストと、他のクライアントは断らない
+	if ok, _ := b.take("a", false, ""); !ok {
+		t.Error("non-retry request was rejected")
+	}
+	if ok, _ := b.take("b", true, ""); !ok {
+		t.Error("minimum retry of another client was rejected")
+	}
+	// 同じ Idempotency-Key の2回目以降は、ヘッダーがなくても再試行として数える
+	if ok, _ := b.take("b", false, "key-1"); !ok {
+		t.Error("first request with a key was rejected")
+	}
+	if ok, _ := b.take("b", false, "key-1"); ok {
+		t.Error("resent key was not counted as a retry")
+	}
+
+	// a は再試行でないリクエストが増えたので、まだ予算が残っている
+	stats := b.stats()
+	if stats.Clients != 2 || stats.Exhausted != 1 || stats.Retries != 5 || stats.Rejected != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// ウィンドウが変われば、また再試行できる
+	now = now.Add(time.Minute)
+	if ok, _ := b.take("a", true, ""); !ok {
+		t.Error("retry in a new window was rejected")
+	}
+	if stats := b.stats(); stats.Clients != 1 || stats.Retries != 6 {
+		t.Errorf("stats in a new window = %+v", stats)
+	}
+}
+
+func TestRetryBudgetServer(t *testing.T) {
+	s := newTestServer(t, map[string]string{"RETRY_BUDGET_PERCENT": "10", "RETRY_BUDGET_MIN": "2"})
+	expectStatus(t, request(s, http.MethodGet, "/users", ""), http.StatusOK)
+	for i := 0; i < 2; i++ {
+		expectStatus(t, request(s, http.MethodGet, "/users", "", retryAttemptHeader, "1"), http.StatusOK)
+	}
+	// 予算を超えた再試行は、Retry-After 付きの429で断る
+	rec := request(s, http.MethodGet, "/users", "", retryAttemptHeader, "3")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	var res errorResponse
+	decode(t, rec, &res)
+	if res.Code != codeRetryBudgetExceeded || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("response = %s, Retry-After %q", rec.Body.String(), rec.Header().Get("Retry-After"))
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users", "", retryAttemptHeader, "0"), http.StatusOK)
+
+	rec = request(s, http.MethodGet, "/metrics", "")
+	expectStatus(t, rec, http.StatusOK)
+	for _, want := range []string{"\nretry_budget_retries_total 2\n", "\nretry_budget_rejected_total 1\n", "\nretry_budget_exhausted_clients 1\n"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
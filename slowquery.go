@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// measureQuery は fn の実行時間を計ります。threshold を超えた場合はログに記録し、slow にtrueを返します。
+// threshold が0の場合は判定しません。
+func measureQuery(label string, threshold time.Duration, fn func() error) (slow bool, err error) {
+	start := time.Now()
+	err = fn()
+	elapsed := time.Since(start)
+	if threshold > 0 && elapsed > threshold {
+		log.Printf("slow query: %s took %s (threshold %s)", label, elapsed.Round(time.Millisecond), threshold)
+		return true, err
+	}
+	return false, err
+}
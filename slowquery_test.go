@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMeasureQuery(t *testing.T) {
+	errQuery := errors.New("query failed")
+	tests := []struct {
+		threshold time.Duration
+		sleep     time.Duration
+		err       error
+		want      bool
+	}{
+		{10 * time.Millisecond, 30 * time.Millisecond, nil, true},
+		{10 * time.Millisecond, 30 * time.Millisecond, errQuery, true},
+		{time.Second, 0, nil, false},
+		{0, 30 * time.Millisecond, nil, false},
+	}
+	for _, tt := range tests {
+		slow, err := measureQuery("test", tt.threshold, func() error {
+			time.Sleep(tt.sleep)
+			return tt.err
+		})
+		if slow != tt.want || err != tt.err {
+			t.Errorf("threshold %s, sleep %s: slow = %v, err = %v", tt.threshold, tt.sleep, slow, err)
+		}
+	}
+}
+
+func TestSlowListHeader(t *testing.T) {
+	// 一覧の読み込みそのもので待つよう、その前に行う最終更新日時と件数の取得は無効にする
+	s := newTestServer(t, map[string]string{"SLOW_QUERY_MS": "50", "LIST_CONDITIONAL": "false", "STREAM_THRESHOLD": "0"})
+	createUser(t, s, "Taro", 30, "taro@example.com")
+
+	rec := request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("X-Slow-Query"); got != "" {
+		t.Errorf("X-Slow-Query on a fast query = %q", got)
+	}
+
+	// 別の接続が排他ロックを持っている間、一覧の読み込みは解放されるまで待たされる
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN EXCLUSIVE"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		conn.ExecContext(ctx, "COMMIT")
+	}()
+	rec = request(s, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("X-Slow-Query"); got != "true" {
+		t.Errorf("X-Slow-Query on a slow query = %q", got)
+	}
+	var list []User
+	decode(t, rec, &list)
+	if len(list) != 1 {
+		t.Errorf("GET /users = %+v", list)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// sqlCommentKey はコンテキストにクエリへ付けるコメントを保存するためのキーです。
+type sqlCommentKey struct{}
+
+// sqlCommentMiddleware は、リクエスト中に実行するクエリの先頭に /* reqid:... */ を付けるようにします。
+// SQLiteのトレースやクエリのログから、どのHTTPリクエストのクエリかをたどれるようにするためのものです。
+func sqlCommentMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := sanitizeSQLComment(c.Response().Header().Get(echo.HeaderXRequestID))
+		if id == "" {
+			return next(c)
+		}
+		req := c.Request()
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), sqlCommentKey{}, "/* reqid:"+id+" */ ")))
+		return next(c)
+	}
+}
+
+// sanitizeSQLComment は英数字と - _ . 以外の文字を取り除きます。
+// リクエストIDはクライアントが X-Request-Id で指定できるため、"*/" でコメントを閉じてSQLを書き換えられないようにします。
+// 値はコメントの中にしか入らないので、プレースホルダーの引数には影響しません。
+func sanitizeSQLComment(s string) string {
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// commentQuerier はクエリの先頭にコメントを付けて実行する querier です。
+type commentQuerier struct {
+	q       querier
+	comment string
+}
+
+func (q commentQuerier) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return q.q.ExecContext(ctx, q.comment+query, args...)
+}
+
+func (q commentQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return q.q.QueryContext(ctx, q.comment+query, args...)
+}
+
+func (q commentQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return q.q.QueryRowContext(ctx, q.comment+query, args...)
+}
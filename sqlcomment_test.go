@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// recordingQuerier は実行されたクエリと引数を記録する querier です。
+type recordingQuerier struct {
+	querier
+	queries []string
+	args    [][]interface{}
+}
+
+func (q *recordingQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	q.queries = append(q.queries, query)
+	q.args = append(q.args, args)
+	return q.querier.QueryContext(ctx, query, args...)
+}
+
+func TestSanitizeSQLComment(t *testing.T) {
+	tests := map[string]string{
+		"abc-123_x.y":                   "abc-123_x.y",
+		"id */ DROP TABLE users; /*":    "idDROPTABLEusers",
+		"改行\n'quote'":                   "quote",
+		string(make([]byte, 100)) + "x": "",
+	}
+	for in, want := range tests {
+		if got := sanitizeSQLComment(in); got != want {
+			t.Errorf("sanitizeSQLComment(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSQLRequestIDComment(t *testing.T) {
+	s := newTestServer(t, map[string]string{"SQL_REQUEST_ID_COMMENT": "true"})
+	insertUsers(t, s, 1)
+	repo := newUserRepository(s.db)
+
+	e := echo.New()
+	e.Use(middleware.RequestID(), sqlCommentMiddleware)
+	var issued *recordingQuerier
+	e.GET("/", func(c echo.Context) error {
+		cq, ok := repo.conn(c.Request().Context()).(commentQuerier)
+		if !ok {
+			t.Fatalf("conn = %T, want commentQuerier", repo.conn(c.Request().Context()))
+		}
+		issued = &recordingQuerier{querier: s.db}
+		cq.q = issued
+		rows, err := cq.QueryContext(c.Request().Context(), "SELECT name FROM users WHERE id = ?", 1)
+		if err != nil {
+			return err
+		}
+		rows.Close()
+		return c.NoContent(http.StatusOK)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderXRequestID, "req-1 */ DELETE FROM users; /*")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	expectStatus(t, rec, http.StatusOK)
+
+	// コメントは閉じられずに先頭に付き、引数はそのまま渡る
+	if len(issued.queries) != 1 || issued.queries[0] != "/* reqid:req-1DELETEFROMusers */ SELECT name FROM users WHERE id = ?" {
+		t.Errorf("issued SQL = %q", issued.queries)
+	}
+	if len(issued.args) != 1 || len(issued.args[0]) != 1 || issued.args[0][0] != 1 {
+		t.Errorf("args = %v", issued.args)
+	}
+
+	// サーバー全体でも、コメント付きのクエリが正しく実行される
+	rec = request(s, http.MethodGet, "/users?name=user", "", echo.HeaderXRequestID, "*/ x")
+	expectStatus(t, rec, http.StatusOK)
+	var list []User
+	decode(t, rec, &list)
+	if len(list) != 1 {
+		t.Errorf("GET /users = %+v", list)
+	}
+}
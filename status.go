@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザーの状態です。deleted は status カラムには保存せず、deleted_at が設定されていることで表します。
+const (
+	statusActive    = "active"
+	statusSuspended = "suspended"
+	statusDeleted   = "deleted"
+)
+
+// userStatuses は指定できる状態です。
+var userStatuses = map[string]bool{statusActive: true, statusSuspended: true, statusDeleted: true}
+
+// statusTransitions は状態ごとに、変更できる先の状態です。削除済みからは変更できません。
+var statusTransitions = map[string]map[string]bool{
+	statusActive:    {statusSuspended: true, statusDeleted: true},
+	statusSuspended: {statusActive: true, statusDeleted: true},
+}
+
+// SetStatus はユーザーの状態を from から to（active か suspended）に変更し、変更後のユーザーを返します。
+// 状態がすでに from でない場合（他のリクエストが先に変更した場合を含む）やユーザーがいない場合は sql.ErrNoRows を返します。
+func (r *userRepository) SetStatus(ctx context.Context, id int, from, to string) (User, error) {
+	return r.scanUser(r.conn(ctx).QueryRowContext(ctx,
+		"UPDATE users SET status = ?, updated_at = ?, updated_by = ? WHERE id = ? AND status = ? AND deleted_at IS NULL RETURNING "+userColumns,
+		to, formatTimestamp(r.now()), actor(ctx), id, from))
+}
+
+// statusHandler はユーザーの状態を {"status": "suspended"} のように変更します。
+// 変更できない組み合わせ（statusTransitions にないもの）は409を返します。deleted への変更は論理削除と同じです。
+func statusHandler(repo *userRepository, cfg config, webhooks *webhookNotifier) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := parseID(c)
+		if err != nil {
+			return err
+		}
+		var req struct {
+			Status string `json:"status"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		if !userStatuses[req.Status] {
+			return validationError(http.StatusBadRequest, "status must be active, suspended or deleted")
+		}
+
+		ctx := c.Request().Context()
+		current, err := repo.GetIncludingDeleted(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return userNotFound()
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		if !statusTransitions[current.Status][req.Status] {
+			return echo.NewHTTPError(http.StatusConflict,
+				"cannot change status from "+current.Status+" to "+req.Status)
+		}
+
+		if req.Status == statusDeleted {
+			if _, err := repo.Delete(ctx, id); err != nil {
+				return dbError(c, err)
+			}
+			user, err := repo.GetIncludingDeleted(ctx, id)
+			if err != nil {
+				return dbError(c, err)
+			}
+			webhooks.notify("user.deleted", map[string]int{"id": id})
+			return c.JSON(http.StatusOK, responseSelection(c, cfg).user(user))
+		}
+		user, err := repo.SetStatus(ctx, id, current.Status, req.Status)
+		if errors.Is(err, sql.ErrNoRows) {
+			// 読み込んでから変更するまでの間に、他のリクエストが状態を変えた
+			return echo.NewHTTPError(http.StatusConflict, "status was changed by another request")
+		}
+		if err != nil {
+			return dbError(c, err)
+		}
+		webhooks.notify("user.updated", user)
+		return c.JSON(http.StatusOK, responseSelection(c, cfg).user(user))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	s := newTestServer(t, nil)
+	tests := []struct {
+		from, to string
+		want     int
+	}{
+		{statusActive, statusSuspended, http.StatusOK},
+		{statusActive, statusDeleted, http.StatusOK},
+		{statusActive, statusActive, http.StatusConflict},
+		{statusSuspended, statusActive, http.StatusOK},
+		{statusSuspended, statusDeleted, http.StatusOK},
+		{statusSuspended, statusSuspended, http.StatusConflict},
+		// 削除済みからは変更できない
+		{statusDeleted, statusActive, http.StatusConflict},
+		{statusDeleted, statusSuspended, http.StatusConflict},
+		{statusDeleted, statusDeleted, http.StatusConflict},
+	}
+	for i, tt := range tests {
+		u := createUser(t, s, fmt.Sprintf("user%d", i), 20, "")
+		path := fmt.Sprintf("/users/%d/status", u.ID)
+		if tt.from != statusActive {
+			expectStatus(t, request(s, http.MethodPost, path, `{"status":"`+tt.from+`"}`), http.StatusOK)
+		}
+		rec := request(s, http.MethodPost, path, `{"status":"`+tt.to+`"}`)
+		if rec.Code != tt.want {
+			t.Errorf("%s -> %s: status = %d, want %d: %s", tt.from, tt.to, rec.Code, tt.want, rec.Body.String())
+			continue
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+		var got User
+		decode(t, rec, &got)
+		if got.Status != tt.to {
+			t.Errorf("%s -> %s: user status = %q", tt.from, tt.to, got.Status)
+		}
+	}
+
+	expectStatus(t, request(s, http.MethodPost, "/users/1/status", `{"status":"banned"}`), http.StatusBadRequest)
+	expectStatus(t, request(s, http.MethodPost, "/users/99/status", `{"status":"active"}`), http.StatusNotFound)
+}
+
+func TestStatusFilter(t *testing.T) {
+	s := newTestServer(t, nil)
+	for i, status := range []string{statusActive, statusSuspended, statusDeleted, statusActive} {
+		u := createUser(t, s, fmt.Sprintf("user%d", i), 20, "")
+		if status != statusActive {
+			expectStatus(t, request(s, http.MethodPost, fmt.Sprintf("/users/%d/status", u.ID), `{"status":"`+status+`"}`), http.StatusOK)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// 既定では削除済みを除く
+		{"", "[user0 user1 user3]"},
+		{"?status=active", "[user0 user3]"},
+		{"?status=suspended", "[user1]"},
+		{"?status=deleted", "[user2]"},
+	}
+	for _, tt := range tests {
+		rec := request(s, http.MethodGet, "/users"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		var users []User
+		decode(t, rec, &users)
+		names := []string{}
+		for _, u := range users {
+			names = append(names, u.Name)
+		}
+		if fmt.Sprint(names) != tt.want {
+			t.Errorf("GET /users%s = %v, want %s", tt.query, names, tt.want)
+		}
+	}
+	expectStatus(t, request(s, http.MethodGet, "/users?status=banned", ""), http.StatusBadRequest)
+}
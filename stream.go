@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// streamFlushEvery は何件ごとにクライアントへ送信するかです。
+const streamFlushEvery = 100
+
+// bufferWriter は JSONSerializer の出力をメモリに受け取る http.ResponseWriter です。
+type bufferWriter struct {
+	header http.Header
+	bytes.Buffer
+}
+
+func (w *bufferWriter) Header() http.Header { return w.header }
+func (w *bufferWriter) WriteHeader(int)     {}
+
+// bufferedJSON は v を一度メモリ上でJSONにしてから、Content-Length を付けて送ります。
+// c.JSON と同じシリアライザを使うので、?pretty や CANONICAL_JSON も同じように効きます。
+func bufferedJSON(c echo.Context, code int, v interface{}) error {
+	indent := ""
+	if _, pretty := c.QueryParams()["pretty"]; c.Echo().Debug || pretty {
+		indent = "  "
+	}
+	w := &bufferWriter{header: http.Header{}}
+	if err := c.Echo().JSONSerializer.Serialize(c.Echo().NewContext(c.Request(), w), v, indent); err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(w.Len()))
+	return c.Blob(code, echo.MIMEApplicationJSONCharsetUTF8, w.Bytes())
+}
+
+// streamUsers はユーザーの一覧をJSONの配列として、DBから読み込みながら少しずつ送ります。
+// 全件をメモリに置かないので件数が多くてもメモリ使用量は一定ですが、Content-Length は付けられず、
+// 送り始めた後にエラーになった場合は途中で接続を閉じるしかありません（X-Slow-Query と ?pretty も効きません）。
+// canonical がtrueの場合は、各ユーザーを CANONICAL_JSON と同じ形式で出力します。
+func streamUsers(c echo.Context, repo *userRepository, filter userFilter, order userSort, fields fieldSelection, canonical bool) error {
+	res := c.Response()
+	n := 0
+	err := repo.ForEach(c.Request().Context(), filter, order, func(user User) error {
+		var b []byte
+		var err error
+		if canonical {
+			b, err = canonicalJSON(fields.user(user))
+		} else {
+			b, err = json.Marshal(fields.user(user))
+		}
+		if err != nil {
+			return err
+		}
+		// 最初のユーザーを読み込めた時点でヘッダーを送信する（クエリ自体の失敗はJSONのエラーで返せる）
+		if n == 0 {
+			res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+			res.WriteHeader(http.StatusOK)
+			markPartialBody(c)
+			b = append([]byte{'['}, b...)
+		} else {
+			b = append([]byte{','}, b...)
+		}
+		if _, err := res.Write(b); err != nil {
+			return err
+		}
+		n++
+		if n%streamFlushEvery == 0 {
+			res.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if !res.Committed {
+			return dbError(c, err)
+		}
+		return err
+	}
+	if n == 0 {
+		return c.JSON(http.StatusOK, []User{})
+	}
+	_, err = res.Write([]byte("]\n"))
+	return err
+}
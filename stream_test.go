@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStreamThreshold(t *testing.T) {
+	s := newTestServer(t, map[string]string{"STREAM_THRESHOLD": "3"})
+	insertUsers(t, s, 3)
+	list := func(t *testing.T, query string, want int) (contentLength string) {
+		t.Helper()
+		rec := request(s, http.MethodGet, "/users"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		var users []User
+		decode(t, rec, &users)
+		if len(users) != want {
+			t.Errorf("GET /users%s: %d users, want %d", query, len(users), want)
+		}
+		return rec.Header().Get("Content-Length")
+	}
+
+	// しきい値ちょうどまではメモリに溜めて、Content-Length を付けて返す
+	if cl := list(t, "", 3); cl == "" {
+		t.Error("3 users were streamed")
+	}
+	insertUsers(t, s, 1)
+	if cl := list(t, "", 4); cl != "" {
+		t.Errorf("4 users were buffered (Content-Length %s)", cl)
+	}
+	// 判定には絞り込んだ後の件数を使う
+	if cl := list(t, "?name_prefix=user0", 2); cl == "" {
+		t.Error("filtered list was streamed")
+	}
+	if cl := list(t, "?as=array&sort=name", 4); cl != "" {
+		t.Errorf("?as=array was buffered (Content-Length %s)", cl)
+	}
+}
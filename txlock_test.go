@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// incrementConcurrently は、読み取りのロックを持ったトランザクションを開いたまま、別のトランザクションで
+// カウンタを増やし、その後で最初のトランザクションでも読み取った値に1を足して書き込みます。
+// 2つのトランザクションのエラーと、最後のカウンタの値を返します。
+func incrementConcurrently(t *testing.T, txLock string) (first, second error, count int) {
+	t.Helper()
+	db, err := initDB(filepath.Join(t.TempDir(), "tx.db"), txLock, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE counter(n INTEGER NOT NULL); INSERT INTO counter VALUES(0)"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := tx.QueryRow("SELECT n FROM counter").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		tx, err := db.Begin()
+		if err != nil {
+			done <- err
+			return
+		}
+		var n int
+		if err := tx.QueryRow("SELECT n FROM counter").Scan(&n); err != nil {
+			tx.Rollback()
+			done <- err
+			return
+		}
+		if _, err := tx.Exec("UPDATE counter SET n = ?", n+1); err != nil {
+			tx.Rollback()
+			done <- err
+			return
+		}
+		done <- tx.Commit()
+	}()
+	// 2つ目のトランザクションが書き込むか、開始を待つまでの時間
+	time.Sleep(100 * time.Millisecond)
+	if _, first = tx.Exec("UPDATE counter SET n = ?", n+1); first == nil {
+		first = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	select {
+	case second = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("second transaction did not finish")
+	}
+	if err := db.QueryRow("SELECT n FROM counter").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return first, second, count
+}
+
+func TestTxLock(t *testing.T) {
+	// BEGIN（deferred）では、読み取りのロックを持ったまま書き込もうとした方が SQLITE_BUSY で失敗する
+	first, second, count := incrementConcurrently(t, "deferred")
+	if first == nil || !strings.Contains(first.Error(), "locked") {
+		t.Errorf("deferred: first error = %v (count %d, second error %v), want database is locked", first, count, second)
+	}
+
+	// BEGIN IMMEDIATE では、2つ目のトランザクションが開始時に待つので、どちらも成功して更新も失われない
+	first, second, count = incrementConcurrently(t, "immediate")
+	if first != nil || second != nil || count != 2 {
+		t.Errorf("immediate: errors %v, %v, count %d, want no errors and 2", first, second, count)
+	}
+
+	if _, err := initDB(filepath.Join(t.TempDir(), "tx.db"), "serializable", ""); err == nil {
+		t.Error("initDB accepted an unknown TX_LOCK")
+	}
+}
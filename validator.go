@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ValidatorFunc はデプロイ先ごとの独自の検証ルールです。組み込みの検証（validateUser、validateEmail）の後に、
+// 登録・更新後のユーザーを受け取って呼び出されます。コードをフォークせずにルールを追加するためのものです。
+// POST /users、PUT /users/:id、PATCH /users/:id、POST /users/bulk-upsert で実行します。
+//
+// 返したエラーが *echo.HTTPError の場合はそのまま返し（400 にしたい場合など）、
+// それ以外のエラーはメッセージを付けた 422 Unprocessable Entity にします。
+//
+// 例えば、run で newServer の後に次のように設定すると、名前が "admin" のユーザーを拒否できます。
+//
+//	s.ValidatorFunc = func(u User) error {
+//		if strings.EqualFold(u.Name, "admin") {
+//			return errors.New("name is reserved")
+//		}
+//		return nil
+//	}
+type ValidatorFunc func(User) error
+
+// runUserValidator は s.ValidatorFunc を実行し、エラーをHTTPエラーに変換します。ValidatorFunc が nil の場合は何もしません。
+func (s *server) runUserValidator(user User) error {
+	if s.ValidatorFunc == nil {
+		return nil
+	}
+	err := s.ValidatorFunc(user)
+	if err == nil {
+		return nil
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he
+	}
+	return validationError(http.StatusUnprocessableEntity, err.Error())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCustomValidator(t *testing.T) {
+	s := newAdminTestServer(t, nil)
+	var called []string
+	s.ValidatorFunc = func(u User) error {
+		called = append(called, u.Name)
+		switch {
+		case strings.EqualFold(u.Name, "admin"):
+			return errors.New("name is reserved")
+		case u.Name == "root":
+			return echo.NewHTTPError(http.StatusBadRequest, "name is not allowed")
+		}
+		return nil
+	}
+
+	rec := request(s, http.MethodPost, "/users", `{"name":"Admin","age":30,"email":"admin@example.com"}`)
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	var res errorResponse
+	decode(t, rec, &res)
+	if res.Message != "name is reserved" || res.Code != codeValidationFailed {
+		t.Errorf("response = %+v", res)
+	}
+	expectStatus(t, request(s, http.MethodPost, "/users", `{"name":"root","age":30,"email":"root@example.com"}`), http.StatusBadRequest)
+
+	// 組み込みの検証で失敗した場合は独自の検証を呼ばない
+	called = nil
+	expectStatus(t, request(s, http.MethodPost, "/users", `{"name":"admin","age":-1,"email":"admin@example.com"}`), http.StatusBadRequest)
+	if len(called) != 0 {
+		t.Errorf("validator called before validateUser: %v", called)
+	}
+
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+	path := fmt.Sprintf("/users/%d", u.ID)
+	expectStatus(t, request(s, http.MethodPut, path, `{"name":"admin","age":30,"email":"taro@example.com"}`), http.StatusUnprocessableEntity)
+	expectStatus(t, request(s, http.MethodPatch, path, `{"name":"admin"}`), http.StatusUnprocessableEntity)
+	expectStatus(t, request(s, http.MethodPost, "/users/bulk-upsert", `[{"name":"admin","age":30,"email":"a@example.com"}]`), http.StatusUnprocessableEntity)
+}
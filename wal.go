@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// walCheckpointModes は ?mode= に指定できる PRAGMA wal_checkpoint のモードです。
+var walCheckpointModes = map[string]bool{"PASSIVE": true, "FULL": true, "RESTART": true, "TRUNCATE": true}
+
+// walCheckpointResult は PRAGMA wal_checkpoint の結果です。
+type walCheckpointResult struct {
+	Mode string `json:"mode"`
+	// OK は他の接続に妨げられずに最後まで実行できたかどうかです（falseの場合は一部だけ反映されています）。
+	OK bool `json:"ok"`
+	// LogFrames はWALファイルのフレーム数、CheckpointedFrames はそのうちDBファイルに書き戻されたフレーム数です。
+	LogFrames          int `json:"log_frames"`
+	CheckpointedFrames int `json:"checkpointed_frames"`
+}
+
+// walCheckpointHandler はWALファイルの内容をDBファイルに書き戻します（既定は TRUNCATE でWALファイルを空にします）。
+// 一括の書き込みの後、バックアップの前にWALを小さくするためのものです。
+// 実行中は書き込みを待たせることがあり、TRUNCATE と RESTART は読み取り中の接続が終わるのを待つこともあります。
+// DBがWALモード（JOURNAL_MODE=wal）でない場合は409を返します。
+func walCheckpointHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		mode := strings.ToUpper(c.QueryParam("mode"))
+		if mode == "" {
+			mode = "TRUNCATE"
+		}
+		if !walCheckpointModes[mode] {
+			return echo.NewHTTPError(http.StatusBadRequest, "mode must be passive, full, restart or truncate")
+		}
+
+		var busy int
+		result := walCheckpointResult{Mode: mode}
+		// mode は上で確認した値だけなので、そのままSQLに含めてよい
+		err := db.QueryRowContext(c.Request().Context(), "PRAGMA wal_checkpoint("+mode+")").
+			Scan(&busy, &result.LogFrames, &result.CheckpointedFrames)
+		if err != nil {
+			return dbError(c, err)
+		}
+		// WALモードでない場合は -1 が返る
+		if result.LogFrames < 0 {
+			return echo.NewHTTPError(http.StatusConflict, "database is not in WAL journal mode")
+		}
+		result.OK = busy == 0
+		return c.JSON(http.StatusOK, result)
+	}
+}
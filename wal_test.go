@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestWALCheckpoint(t *testing.T) {
+	// 既定のジャーナルモード（delete）では使えない
+	t.Run("not WAL", func(t *testing.T) {
+		s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys})
+		expectStatus(t, request(s, http.MethodPost, "/admin/wal-checkpoint", "", "X-API-Key", "admin-secret"), http.StatusConflict)
+	})
+
+	s := newTestServer(t, map[string]string{"API_KEYS": testAPIKeys, "JOURNAL_MODE": "WAL"})
+	admin := []string{"X-API-Key", "admin-secret"}
+	expectStatus(t, request(s, http.MethodPost, "/admin/wal-checkpoint", "", "X-API-Key", "reader-secret"), http.StatusForbidden)
+	var mode string
+	if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Fatalf("journal_mode = %q, want wal", mode)
+	}
+	insertUsers(t, s, 20)
+
+	checkpoint := func(t *testing.T, query string) walCheckpointResult {
+		t.Helper()
+		rec := request(s, http.MethodPost, "/admin/wal-checkpoint"+query, "", admin...)
+		expectStatus(t, rec, http.StatusOK)
+		var res walCheckpointResult
+		decode(t, rec, &res)
+		return res
+	}
+	// 書き込みの後はWALにフレームが残っていて、すべて書き戻せる
+	res := checkpoint(t, "?mode=passive")
+	if res.Mode != "PASSIVE" || !res.OK || res.LogFrames == 0 || res.CheckpointedFrames != res.LogFrames {
+		t.Errorf("passive checkpoint = %+v", res)
+	}
+	// TRUNCATE（既定）はWALファイルを空にする
+	res = checkpoint(t, "")
+	if res.Mode != "TRUNCATE" || !res.OK || res.LogFrames != 0 {
+		t.Errorf("truncate checkpoint = %+v", res)
+	}
+	expectStatus(t, request(s, http.MethodPost, "/admin/wal-checkpoint?mode=fast", "", admin...), http.StatusBadRequest)
+}
+
+func TestJournalMode(t *testing.T) {
+	for _, mode := range []string{"", "delete", "truncate", "persist", "wal"} {
+		db, err := initDB(filepath.Join(t.TempDir(), "journal.db"), "immediate", mode)
+		if err != nil {
+			t.Fatalf("JOURNAL_MODE=%s: %v", mode, err)
+		}
+		var got string
+		if err := db.QueryRow("PRAGMA journal_mode").Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		want := mode
+		if want == "" {
+			want = "delete"
+		}
+		if got != want {
+			t.Errorf("JOURNAL_MODE=%s: journal_mode = %q", mode, got)
+		}
+	}
+	// メモリ上のジャーナルなど、クラッシュでDBが壊れるモードは受け付けない
+	for _, mode := range []string{"memory", "off", "wall"} {
+		if _, err := initDB(filepath.Join(t.TempDir(), "journal.db"), "immediate", mode); err == nil {
+			t.Errorf("initDB accepted JOURNAL_MODE=%s", mode)
+		}
+	}
+}
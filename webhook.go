@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhookEvent はユーザーの変更を外部に通知するイベントです。
+type webhookEvent struct {
+	Type string      `json:"type"` // user.created, user.updated, user.deleted, panic（PANIC_REPORT_URL）
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// webhookNotifier はイベントを WEBHOOK_URL にPOSTで送ります。
+// 送信はバックグラウンドのワーカーで行い、キューが満杯のときはイベントを破棄するので、リクエストを遅らせません。
+// 失敗した送信は間隔を倍にしながら maxAttempts 回まで再送し、それでも失敗した場合はログに記録して諦めます。
+type webhookNotifier struct {
+	url         string
+	secret      string
+	client      *http.Client
+	queue       chan webhookEvent
+	maxAttempts int
+	backoff     time.Duration
+	workers     *workerGroup
+}
+
+func newWebhookNotifier(url, secret string, queueSize int, workers *workerGroup) *webhookNotifier {
+	w := &webhookNotifier{
+		url:         url,
+		secret:      secret,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		queue:       make(chan webhookEvent, queueSize),
+		maxAttempts: 5,
+		backoff:     500 * time.Millisecond,
+		workers:     workers,
+	}
+	workers.Go("webhook", w.run)
+	return w
+}
+
+// notify はイベントをキューに入れます。w が nil の場合（WEBHOOK_URL 未設定）は何もしません。
+func (w *webhookNotifier) notify(typ string, data interface{}) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.queue <- webhookEvent{Type: typ, Time: time.Now().UTC(), Data: data}:
+	default:
+		log.Printf("webhook: queue is full, dropped %s event", typ)
+	}
+}
+
+// run はキューのイベントを送信します。ctx がキャンセルされたら、キューに残っているイベントを
+// 再送なしで1回ずつ送信してから戻ります。終了の期限（DrainContext）が切れた場合は、残りを破棄して戻ります。
+func (w *webhookNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case event := <-w.queue:
+			w.deliver(ctx, event)
+		case <-ctx.Done():
+			drain := w.workers.DrainContext()
+			for {
+				if drain.Err() != nil {
+					if n := len(w.queue); n > 0 {
+						log.Printf("webhook: shutdown timeout, dropped %d queued events", n)
+					}
+					return
+				}
+				select {
+				case event := <-w.queue:
+					w.deliver(ctx, event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver はイベントを送信します。2xx 以外の応答や通信エラーの場合は再送します。
+// 終了中（ctx がキャンセル済み）の場合は再送しません。送信中のリクエストは、終了の期限が切れた時点で中断します。
+func (w *webhookNotifier) deliver(ctx context.Context, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+	wait := w.backoff
+	for attempt := 1; ; attempt++ {
+		err := w.post(w.workers.DrainContext(), body)
+		if err == nil {
+			return
+		}
+		if attempt == w.maxAttempts || ctx.Err() != nil {
+			log.Printf("webhook: dropped %s event after %d attempts: %v", event.Type, attempt, err)
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		wait *= 2
+	}
+}
+
+func (w *webhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// 受信側が送信元と改ざんの有無を確認できるよう、本文のHMAC-SHA256を付ける
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
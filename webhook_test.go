@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	events := make(chan webhookEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if got, want := r.Header.Get("X-Webhook-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		var event webhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid event %s: %v", body, err)
+		}
+		events <- event
+	}))
+	defer hook.Close()
+	s := newTestServer(t, map[string]string{"WEBHOOK_URL": hook.URL, "WEBHOOK_SECRET": "secret"})
+
+	u := createUser(t, s, "Taro", 30, "taro@example.com")
+	expectStatus(t, request(s, http.MethodDelete, fmt.Sprintf("/users/%d", u.ID), ""), http.StatusNoContent)
+	for _, want := range []string{"user.created", "user.deleted"} {
+		select {
+		case event := <-events:
+			if event.Type != want {
+				t.Errorf("event = %s, want %s", event.Type, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not delivered", want)
+		}
+	}
+}
+
+func TestWebhookShutdownStopsAtDeadline(t *testing.T) {
+	// 受信側が応答しないままでも、終了の期限で送信を諦める
+	var received atomic.Int32
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer hook.Close()
+	defer close(release)
+	s := newTestServer(t, map[string]string{"WEBHOOK_URL": hook.URL})
+	for i := 0; i < 5; i++ {
+		createUser(t, s, fmt.Sprintf("user%d", i), 20, fmt.Sprintf("user%d@example.com", i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.workers.Shutdown(ctx); err == nil {
+		t.Fatal("Shutdown succeeded while the webhook receiver was hanging")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.workers.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("webhook worker kept draining after the shutdown deadline")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+	if n := received.Load(); n > 2 {
+		t.Errorf("receiver got %d requests after the deadline", n)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+// workerGroup はバックグラウンドで動くワーカー（リクエストの記録、Webhookの送信など）をまとめて管理します。
+// 各ワーカーには共通のコンテキストを渡し、終了時にはそれをキャンセルして、
+// ワーカーがバッファに残った仕事を片付けて止まるのを待ちます。
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// drain は Shutdown の期限が切れたときにキャンセルされます（DrainContext）。
+	drain     context.Context
+	stopDrain context.CancelFunc
+}
+
+func newWorkerGroup() *workerGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	drain, stopDrain := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, cancel: cancel, drain: drain, stopDrain: stopDrain}
+}
+
+// DrainContext は、ワーカーが外部とやり取りしたり残りの仕事を片付けたりするときに使うコンテキストです。
+// Go に渡す ctx と違って終了が始まってもキャンセルされず、Shutdown の期限（SHUTDOWN_TIMEOUT_S）が切れた時点でキャンセルされます。
+// 片付けの途中の送信などは、これを使えば期限で中断できます。
+func (g *workerGroup) DrainContext() context.Context {
+	return g.drain
+}
+
+// Go は fn を新しいゴルーチンで実行します。fn は ctx がキャンセルされたら、残りの仕事を片付けて戻る必要があります。
+func (g *workerGroup) Go(name string, fn func(ctx context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn(g.ctx)
+		log.Printf("shutdown: worker %q stopped", name)
+	}()
+}
+
+// Shutdown はすべてのワーカーに終了を伝え、止まるまで待ちます。
+// ctx の期限までに止まらなかった場合はエラーを返します（残った仕事は失われます）。
+func (g *workerGroup) Shutdown(ctx context.Context) error {
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		g.stopDrain()
+		return nil
+	case <-ctx.Done():
+		// 片付けの途中のワーカーにも、期限が切れたことを伝える
+		g.stopDrain()
+		return errors.New("shutdown: workers did not stop before the timeout")
+	}
+}
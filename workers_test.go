@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsRequestLog(t *testing.T) {
+	s := newTestServer(t, nil)
+	workers := newWorkerGroup()
+	l := newRequestLogger(s.db, 1, 1, workers)
+
+	// 書き込みより速くキューに積むので、Shutdown の時点ではほとんどがキューに残っている
+	const n = 200
+	for i := 0; i < n; i++ {
+		l.queue <- requestLogEntry{CreatedAt: time.Now(), Method: http.MethodPost, Path: "/users", Status: http.StatusCreated}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := workers.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutdown が戻った時点で、キューに残っていた分も書き込まれている
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM requests_log").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("request log entries = %d, want %d", count, n)
+	}
+	if len(l.queue) != 0 {
+		t.Errorf("%d entries left in the queue", len(l.queue))
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	workers := newWorkerGroup()
+	drained := make(chan struct{})
+	workers.Go("slow", func(ctx context.Context) {
+		<-ctx.Done()
+		// 片付けが期限までに終わらない
+		<-workers.DrainContext().Done()
+		close(drained)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := workers.Shutdown(ctx); err == nil {
+		t.Error("Shutdown returned nil for a worker that did not stop in time")
+	}
+	// 期限が切れたら DrainContext もキャンセルされ、片付けの途中のワーカーも止まる
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Error("DrainContext was not cancelled after the timeout")
+	}
+}